@@ -0,0 +1,21 @@
+module github.com/kelseyhightower/weather-local
+
+go 1.16
+
+require (
+	cloud.google.com/go v0.26.0
+	github.com/kelseyhightower/weather-api v0.0.0
+	github.com/kelseyhightower/weather-assistant v0.0.0
+	github.com/kelseyhightower/weather-data-collector v0.0.0
+	github.com/kelseyhightower/weather-frontend v0.0.0
+	google.golang.org/api v0.0.0-20180826000528-7954115fcf34
+	google.golang.org/grpc v1.14.0
+)
+
+replace (
+	github.com/kelseyhightower/weather-api => ../../weather-api
+	github.com/kelseyhightower/weather-assistant => ../../weather-assistant
+	github.com/kelseyhightower/weather-data-collector => ../../weather-data-collector
+	github.com/kelseyhightower/weather-frontend => ../../weather-frontend
+	github.com/kelseyhightower/weather-internal => ../../internal
+)
@@ -0,0 +1,279 @@
+// Command weather-local runs the weather demo on a single machine
+// against a local Postgres database.
+//
+// The weather-api, weather-frontend and weather-assistant functions are
+// served by one HTTP server:
+//
+//	/                   weather-frontend
+//	/weather-api        weather-api
+//	/weather-assistant  weather-assistant
+//
+// The functions publish to a fake Pub/Sub server running in the same
+// process. Messages published to the weather-events topic are delivered
+// to the weather-data-collector background function, F, and the
+// scheduler publishes to the weather-dispatch topic every interval,
+// which runs the dispatcher, the same way Cloud Scheduler does.
+//
+// The schema migrations seed the events registry with the demo events.
+// Other events can be added at startup with the event files matching
+// -events, using the weather-api admin endpoint and the admin-token
+// secret. Events that already exist are left unchanged.
+//
+// Logs are written to stdout, tracing is disabled and secrets are read
+// from the -secrets directory. Environment variables that are already
+// set, such as PGHOST or PGSSLMODE, take precedence over the defaults.
+//
+// Usage:
+//
+//	weather-local -secrets ./secrets
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	api "github.com/kelseyhightower/weather-api"
+	assistant "github.com/kelseyhightower/weather-assistant"
+	collector "github.com/kelseyhightower/weather-data-collector"
+	frontend "github.com/kelseyhightower/weather-frontend"
+)
+
+const (
+	eventsTopic   = "weather-events"
+	dispatchTopic = "weather-dispatch"
+	project       = "local"
+
+	// maxDeliveryAttempts is how many times a message is delivered
+	// before it's dropped.
+	maxDeliveryAttempts = 5
+
+	// deliveryAttemptAttribute is the attribute Pub/Sub sets to the
+	// delivery attempt on subscriptions with a dead-letter policy.
+	deliveryAttemptAttribute = "googclient_deliveryattempt"
+)
+
+// retryBackoff is how long a failed delivery waits before it's
+// retried. It doubles after every attempt.
+var retryBackoff = 10 * time.Second
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "HTTP listen address")
+	secrets := flag.String("secrets", "secrets", "directory holding the function secrets")
+	static := flag.String("static", "../../weather-frontend/static", "weather-frontend static files directory")
+	events := flag.String("events", "", "glob of event files added to the events registry at startup")
+	interval := flag.Duration("interval", time.Minute, "scheduler interval")
+	flag.Parse()
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	baseURL := "http://" + l.Addr().String()
+	srv := pstest.NewServer()
+
+	setDefaults(map[string]string{
+		"GCP_PROJECT":          project,
+		"LOGGER":               "stdout",
+		"TRACE_EXPORTER":       "none",
+		"SECRET_SOURCE":        "dir",
+		"SECRETS_DIR":          *secrets,
+		"PGSSLMODE":            "disable",
+		"MIGRATE_ON_START":     "true",
+		"EVENTS_TOPIC":         eventsTopic,
+		"PUBSUB_EMULATOR_HOST": srv.Addr,
+		"STATIC_DIR":           *static,
+
+		// The frontend adds /api to the URL; weather-api serves the
+		// weather for an event at any path that isn't an events path.
+		"WEATHER_API_URL": baseURL + "/weather-api",
+	})
+
+	// The client library connects to PUBSUB_EMULATOR_HOST.
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, project)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := subscribe(ctx, client, eventsTopic, collector.F); err != nil {
+		log.Fatal(err)
+	}
+	if err := subscribe(ctx, client, dispatchTopic, collector.Dispatch); err != nil {
+		log.Fatal(err)
+	}
+
+	mux := newMux(api.F, assistant.F, frontend.F)
+
+	go func() {
+		if *events != "" {
+			token, err := ioutil.ReadFile(filepath.Join(*secrets, "admin-token"))
+			if err != nil {
+				log.Printf("not adding events without an admin-token secret: %v", err)
+			} else {
+				n := seedEvents(baseURL+"/weather-api", strings.TrimSpace(string(token)), *events)
+				log.Printf("added %d events to the events registry from %s", n, *events)
+			}
+		}
+
+		schedule(client.Topic(dispatchTopic), *interval)
+	}()
+
+	log.Printf("serving the weather demo at %s", baseURL)
+	log.Fatal(http.Serve(l, mux))
+}
+
+// newMux returns the routes of the HTTP functions.
+func newMux(api, assistant, frontend http.HandlerFunc) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/weather-api", api)
+	mux.HandleFunc("/weather-api/", api)
+	mux.HandleFunc("/weather-assistant", assistant)
+	mux.HandleFunc("/", frontend)
+	return mux
+}
+
+// setDefaults sets the environment variables in env that are unset.
+func setDefaults(env map[string]string) {
+	for k, v := range env {
+		if _, ok := os.LookupEnv(k); !ok {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// schedule publishes a message to the dispatch topic every interval.
+func schedule(topic *pubsub.Topic, interval time.Duration) {
+	ctx := context.Background()
+	for {
+		result := topic.Publish(ctx, &pubsub.Message{Data: []byte("{}")})
+		if _, err := result.Get(ctx); err != nil {
+			log.Printf("error publishing to %s: %v", topic.ID(), err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// seedEvents creates the events in the files matching pattern with the
+// weather-api admin endpoint at apiURL, authenticated with token, and
+// returns the number of events created. weather-api publishes new
+// events, so they're collected right away.
+func seedEvents(apiURL, token, pattern string) int {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		log.Printf("invalid events pattern %q: %v", pattern, err)
+		return 0
+	}
+
+	var created int
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			log.Printf("error reading event file: %v", err)
+			continue
+		}
+
+		request, err := http.NewRequest("POST", apiURL+"/events", bytes.NewReader(data))
+		if err != nil {
+			log.Printf("error creating event from %s: %v", name, err)
+			continue
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+		request.Header.Set("Content-Type", "application/json")
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			log.Printf("error creating event from %s: %v", name, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		switch response.StatusCode {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			log.Printf("error creating event from %s: %s: %s", name, response.Status, bytes.TrimSpace(body))
+		}
+	}
+
+	return created
+}
+
+// subscribe creates topic and a subscription that delivers each message
+// published to it to the background function f the way Cloud Functions
+// does, with the message attributes in the payload. Failed deliveries
+// are retried with backoff, and the message is dropped after
+// maxDeliveryAttempts.
+func subscribe(ctx context.Context, client *pubsub.Client, topic string, f func(ctx context.Context, m collector.PubSubMessage) error) error {
+	t, err := client.CreateTopic(ctx, topic)
+	if status.Code(err) == codes.AlreadyExists {
+		t, err = client.Topic(topic), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sub, err := client.CreateSubscription(ctx, topic, pubsub.SubscriptionConfig{Topic: t})
+	if status.Code(err) == codes.AlreadyExists {
+		sub, err = client.Subscription(topic), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := sub.Receive(ctx, func(ctx context.Context, m *pubsub.Message) {
+			deliver(ctx, topic, m, f)
+			m.Ack()
+		})
+		if err != nil {
+			log.Printf("error receiving messages published to %s: %v", topic, err)
+		}
+	}()
+
+	return nil
+}
+
+// deliver calls f with m until it succeeds or maxDeliveryAttempts is
+// reached. Each attempt sets the delivery attempt attribute, as Pub/Sub
+// does for subscriptions with a dead-letter policy.
+func deliver(ctx context.Context, topic string, m *pubsub.Message, f func(ctx context.Context, m collector.PubSubMessage) error) {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		attributes := map[string]string{deliveryAttemptAttribute: strconv.Itoa(attempt)}
+		for k, v := range m.Attributes {
+			attributes[k] = v
+		}
+
+		err := f(ctx, collector.PubSubMessage{Data: m.Data, Attributes: attributes})
+		if err == nil {
+			return
+		}
+
+		if attempt == maxDeliveryAttempts {
+			log.Printf("dropping message %s published to %s after %d attempts: %v", m.ID, topic, attempt, err)
+			return
+		}
+
+		log.Printf("error delivering message %s published to %s, retrying in %s: %v", m.ID, topic, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
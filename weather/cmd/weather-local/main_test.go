@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	collector "github.com/kelseyhightower/weather-data-collector"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// handler returns a handler that writes name.
+func handler(name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}
+}
+
+func TestMux(t *testing.T) {
+	mux := newMux(handler("weather-api"), handler("weather-assistant"), handler("weather-frontend"))
+
+	tests := []struct {
+		method, path string
+		want         string
+	}{
+		{"GET", "/weather-api", "weather-api"},
+		{"GET", "/weather-api/api", "weather-api"},
+		{"POST", "/weather-api/events", "weather-api"},
+		{"POST", "/weather-assistant", "weather-assistant"},
+		{"GET", "/", "weather-frontend"},
+		{"GET", "/?event=GothamGo", "weather-frontend"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+
+		if got := w.Body.String(); got != tt.want {
+			t.Errorf("wrong handler for %s %s: got %v want %v", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	defer func(d time.Duration) { retryBackoff = d }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	srv := pstest.NewServer()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := pubsub.NewClient(ctx, project, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// The first delivery fails and is retried.
+	delivered := make(chan collector.PubSubMessage, 1)
+	f := func(ctx context.Context, m collector.PubSubMessage) error {
+		if m.Attributes[deliveryAttemptAttribute] == "1" {
+			return errors.New("connection refused")
+		}
+		delivered <- m
+		return nil
+	}
+
+	if err := subscribe(ctx, client, eventsTopic, f); err != nil {
+		t.Fatal(err)
+	}
+
+	id := srv.Publish("projects/local/topics/weather-events", []byte(`{"event": "gophercon"}`),
+		map[string]string{"publishId": "5f0c2ad3a1e04b7e"})
+
+	select {
+	case m := <-delivered:
+		if string(m.Data) != `{"event": "gophercon"}` {
+			t.Errorf("wrong message data: got %s want %s", m.Data, `{"event": "gophercon"}`)
+		}
+		if m.Attributes["publishId"] != "5f0c2ad3a1e04b7e" {
+			t.Errorf("wrong message attributes: got %v", m.Attributes)
+		}
+		if m.Attributes[deliveryAttemptAttribute] != "2" {
+			t.Errorf("wrong delivery attempt: got %v want %v", m.Attributes[deliveryAttemptAttribute], 2)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message wasn't delivered to the background function")
+	}
+
+	for start := time.Now(); srv.Message(id).Acks == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("delivered message wasn't acked")
+		}
+	}
+}
+
+func TestSeedEvents(t *testing.T) {
+	var created []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/weather-api/events" {
+			t.Errorf("wrong request: got %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer s3cr3t" {
+			t.Errorf("wrong authorization: got %q want %q", got, "Bearer s3cr3t")
+		}
+
+		var e struct{ Slug string }
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+
+		// GopherCon is seeded by the schema migrations.
+		if e.Slug == "gophercon" {
+			http.Error(w, "an event with that slug or name already exists", http.StatusConflict)
+			return
+		}
+		created = append(created, e.Slug)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "weather-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events := map[string]string{
+		"gophercon.json": `{"Slug": "gophercon", "Name": "GopherCon", "Location": "Denver, Colorado, USA"}`,
+		"golab.json":     `{"Slug": "golab", "Name": "GoLab", "Location": "Florence, Italy", "Provider": "open-meteo"}`,
+	}
+	for name, data := range events {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := seedEvents(ts.URL+"/weather-api", "s3cr3t", filepath.Join(dir, "*.json"))
+	if n != 1 || len(created) != 1 || created[0] != "golab" {
+		t.Errorf("wrong events created: got %v want %v", created, []string{"golab"})
+	}
+}
@@ -1,5 +0,0 @@
-CREATE TABLE weather (
-    event varchar(200) PRIMARY KEY,
-    location varchar(200),
-    temperature integer NOT NULL
-)
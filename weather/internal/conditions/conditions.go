@@ -0,0 +1,39 @@
+// Package conditions describes the weather for weather-frontend and
+// weather-assistant.
+package conditions
+
+import (
+	"strings"
+)
+
+// windDescription describes a wind speed in kilometres per hour in the
+// terms used by National Weather Service forecasts.
+func windDescription(kmh float64) string {
+	switch {
+	case kmh < 2:
+		return "calm"
+	case kmh < 24:
+		return "light wind"
+	case kmh < 40:
+		return "breezy"
+	case kmh < 64:
+		return "windy"
+	default:
+		return "very windy"
+	}
+}
+
+// Summary summarizes the weather for display, for example
+// "sunny, light wind". windSpeed is in the given units, imperial or
+// metric.
+func Summary(shortForecast string, windSpeed float64, units string) string {
+	kmh := windSpeed
+	if units == "imperial" {
+		kmh = windSpeed * 1.609344
+	}
+
+	if shortForecast == "" {
+		return windDescription(kmh)
+	}
+	return strings.ToLower(shortForecast) + ", " + windDescription(kmh)
+}
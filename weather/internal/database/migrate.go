@@ -0,0 +1,856 @@
+// Package database opens the Postgres and SQLite weather databases and
+// migrates their schema.
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/kelseyhightower/weather-internal/secrets"
+)
+
+// Migration is a versioned change to the weather database schema. Up
+// applies the change and Down reverts it. SQLiteUp and SQLiteDown are
+// the same change for SQLite databases. Migrations are applied in
+// version order and each one runs in its own transaction.
+type Migration struct {
+	Version    int
+	Name       string
+	Up         string
+	Down       string
+	SQLiteUp   string
+	SQLiteDown string
+}
+
+// Migrations is the weather database schema used by weather-api and
+// weather-data-collector. Append new migrations to the end and never
+// edit one that has been applied. Every migration needs both the
+// Postgres and the SQLite statements so the two schemas stay the same.
+var Migrations = []Migration{
+	{
+		Version:    1,
+		Name:       "initial schema",
+		Up:         initialSchemaUp,
+		Down:       initialSchemaDown,
+		SQLiteUp:   sqliteInitialSchemaUp,
+		SQLiteDown: sqliteInitialSchemaDown,
+	},
+	{
+		Version:    2,
+		Name:       "events registry",
+		Up:         eventsUp,
+		Down:       eventsDown,
+		SQLiteUp:   sqliteEventsUp,
+		SQLiteDown: sqliteEventsDown,
+	},
+	{
+		Version:    3,
+		Name:       "event polling intervals",
+		Up:         pollIntervalUp,
+		Down:       pollIntervalDown,
+		SQLiteUp:   sqlitePollIntervalUp,
+		SQLiteDown: sqlitePollIntervalDown,
+	},
+	{
+		Version:    4,
+		Name:       "forecast, geocode, reading and alert tables",
+		Up:         tablesUp,
+		Down:       tablesDown,
+		SQLiteUp:   sqliteTablesUp,
+		SQLiteDown: sqliteTablesDown,
+	},
+	{
+		Version:    5,
+		Name:       "weather source",
+		Up:         weatherSourceUp,
+		Down:       weatherSourceDown,
+		SQLiteUp:   sqliteWeatherSourceUp,
+		SQLiteDown: sqliteWeatherSourceDown,
+	},
+	{
+		Version:    6,
+		Name:       "weather conditions",
+		Up:         conditionsUp,
+		Down:       conditionsDown,
+		SQLiteUp:   sqliteConditionsUp,
+		SQLiteDown: sqliteConditionsDown,
+	},
+	{
+		Version:    7,
+		Name:       "metric units",
+		Up:         metricUnitsUp,
+		Down:       metricUnitsDown,
+		SQLiteUp:   sqliteMetricUnitsUp,
+		SQLiteDown: sqliteMetricUnitsDown,
+	},
+	{
+		Version:    8,
+		Name:       "event publish times and claims",
+		Up:         eventClaimsUp,
+		Down:       eventClaimsDown,
+		SQLiteUp:   sqliteEventClaimsUp,
+		SQLiteDown: sqliteEventClaimsDown,
+	},
+	{
+		Version:    9,
+		Name:       "alerts without expiry",
+		Up:         alertExpiryUp,
+		Down:       alertExpiryDown,
+		SQLiteUp:   sqliteAlertExpiryUp,
+		SQLiteDown: sqliteAlertExpiryDown,
+	},
+}
+
+// migrationLockID is the Postgres advisory lock held while migrating,
+// so functions that cold start together don't race to apply the same
+// migration.
+const migrationLockID = 74237
+
+// Migrator applies Migrations to a database and records the applied
+// versions in the schema_migrations table. SQLite is set for SQLite
+// databases, which run the SQLite statements and rely on the database
+// lock instead of an advisory lock.
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+	SQLite     bool
+}
+
+// NewMigrator returns a Migrator for the weather database, connecting
+// the same way the functions do.
+func NewMigrator(ctx context.Context) (*Migrator, error) {
+	if os.Getenv("STORE") == "sqlite" {
+		db, err := OpenSQLite(os.Getenv("SQLITE_PATH"))
+		if err != nil {
+			return nil, err
+		}
+		return &Migrator{DB: db, Migrations: Migrations, SQLite: true}, nil
+	}
+
+	source, err := secrets.NewSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := OpenPostgres(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Migrator{DB: db, Migrations: Migrations}, nil
+}
+
+// Version returns the latest applied migration version, or 0 if none
+// have been applied.
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	if err := m.init(ctx); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := m.DB.QueryRowContext(ctx, migrationVersionQuery).Scan(&version)
+	return version, err
+}
+
+// Up applies the pending migrations and returns the ones it applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, migration := range m.sorted() {
+		ok, err := m.apply(ctx, migration, true)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied = append(applied, migration)
+		}
+	}
+
+	return applied, nil
+}
+
+// Down reverts the applied migrations newer than version and returns
+// the ones it reverted. Down(ctx, 0) reverts every migration.
+func (m *Migrator) Down(ctx context.Context, version int) ([]Migration, error) {
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+
+	migrations := m.sorted()
+
+	var reverted []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if migration.Version <= version {
+			break
+		}
+
+		ok, err := m.apply(ctx, migration, false)
+		if err != nil {
+			return reverted, err
+		}
+		if ok {
+			reverted = append(reverted, migration)
+		}
+	}
+
+	return reverted, nil
+}
+
+// init creates the schema_migrations table.
+func (m *Migrator) init(ctx context.Context) error {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := m.lock(ctx, tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, createMigrationsQuery); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// apply runs the up or down half of a migration unless it has already
+// been applied or reverted. ok is false when there was nothing to do.
+func (m *Migrator) apply(ctx context.Context, migration Migration, up bool) (ok bool, err error) {
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if err := m.lock(ctx, tx); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	var applied bool
+	err = tx.QueryRowContext(ctx, migrationAppliedQuery, migration.Version).Scan(&applied)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if applied == up {
+		return false, tx.Rollback()
+	}
+
+	statement, record := migration.Down, deleteMigrationQuery
+	if up {
+		statement, record = migration.Up, insertMigrationQuery
+	}
+	if m.SQLite {
+		statement = migration.SQLiteDown
+		if up {
+			statement = migration.SQLiteUp
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, statement); err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("migration %d (%s): %v", migration.Version, migration.Name, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, record, migration.Version, migration.Name)
+	} else {
+		_, err = tx.ExecContext(ctx, record, migration.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// lock holds the migration advisory lock until tx ends. SQLite
+// transactions already hold the database lock.
+func (m *Migrator) lock(ctx context.Context, tx *sql.Tx) error {
+	if m.SQLite {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, migrationLockQuery, migrationLockID)
+	return err
+}
+
+func (m *Migrator) sorted() []Migration {
+	migrations := make([]Migration, len(m.Migrations))
+	copy(migrations, m.Migrations)
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations
+}
+
+var migrationLockQuery = `SELECT pg_advisory_xact_lock($1)`
+
+var createMigrationsQuery = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version integer PRIMARY KEY,
+    name varchar(200) NOT NULL,
+    applied_at timestamp with time zone NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+var migrationVersionQuery = `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`
+
+var migrationAppliedQuery = `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`
+
+var insertMigrationQuery = `INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+
+var deleteMigrationQuery = `DELETE FROM schema_migrations WHERE version = $1`
+
+// initialSchemaUp is the schema that was created by hand from
+// create-tables.sql before any of the tables were changed. The table is
+// only created if it doesn't exist so databases created by hand adopt
+// it as version 1. Every later change is a migration of its own.
+var initialSchemaUp = `
+CREATE TABLE IF NOT EXISTS weather (
+    event varchar(200) PRIMARY KEY,
+    location varchar(200),
+    temperature integer NOT NULL
+);
+`
+
+var initialSchemaDown = `
+DROP TABLE IF EXISTS weather;
+`
+
+// sqliteInitialSchemaUp is initialSchemaUp for SQLite. Times are stored
+// as UTC text so they sort and compare in time order.
+var sqliteInitialSchemaUp = `
+CREATE TABLE IF NOT EXISTS weather (
+    event text PRIMARY KEY,
+    location text,
+    temperature integer NOT NULL
+);
+`
+
+var sqliteInitialSchemaDown = initialSchemaDown
+
+// eventsUp creates the events registry and seeds it with the events
+// that were previously listed in events/*.json. Events without lat and
+// lng are geocoded from their location.
+var eventsUp = `
+CREATE TABLE events (
+    slug varchar(100) PRIMARY KEY,
+    name varchar(200) NOT NULL UNIQUE,
+    location varchar(200) NOT NULL,
+    lat double precision,
+    lng double precision,
+    timezone varchar(100) NOT NULL DEFAULT '',
+    provider varchar(50) NOT NULL DEFAULT '',
+    start_date date,
+    end_date date,
+    active boolean NOT NULL DEFAULT true
+);
+
+INSERT INTO events (slug, name, location, timezone) VALUES
+    ('gophercon', 'GopherCon', 'Denver, Colorado, USA', 'America/Denver'),
+    ('florida-golang', 'Florida Golang', 'Orlando, Florida, USA', 'America/New_York'),
+    ('go-northwest', 'Go Northwest', 'Seattle, Washington, USA', 'America/Los_Angeles'),
+    ('gotham-go', 'GothamGo', 'New York, New York, USA', 'America/New_York'),
+    ('capital-go', 'CapitalGo', 'Arlington, Virginia, USA', 'America/New_York'),
+    ('gopherpalooza', 'Gopherpalooza', 'San Francisco, California, USA', 'America/Los_Angeles');
+`
+
+var eventsDown = `
+DROP TABLE IF EXISTS events;
+`
+
+// sqliteEventsUp is eventsUp for SQLite. The dates are YYYY-MM-DD text
+// so the driver doesn't parse them as times.
+var sqliteEventsUp = `
+CREATE TABLE events (
+    slug text PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    location text NOT NULL,
+    lat real,
+    lng real,
+    timezone text NOT NULL DEFAULT '',
+    provider text NOT NULL DEFAULT '',
+    start_date text,
+    end_date text,
+    active boolean NOT NULL DEFAULT true
+);
+
+INSERT INTO events (slug, name, location, timezone) VALUES
+    ('gophercon', 'GopherCon', 'Denver, Colorado, USA', 'America/Denver'),
+    ('florida-golang', 'Florida Golang', 'Orlando, Florida, USA', 'America/New_York'),
+    ('go-northwest', 'Go Northwest', 'Seattle, Washington, USA', 'America/Los_Angeles'),
+    ('gotham-go', 'GothamGo', 'New York, New York, USA', 'America/New_York'),
+    ('capital-go', 'CapitalGo', 'Arlington, Virginia, USA', 'America/New_York'),
+    ('gopherpalooza', 'Gopherpalooza', 'San Francisco, California, USA', 'America/Los_Angeles');
+`
+
+var sqliteEventsDown = eventsDown
+
+// pollIntervalUp adds how often the dispatcher publishes each event
+// and when it was last published.
+var pollIntervalUp = `
+ALTER TABLE events ADD COLUMN poll_interval integer NOT NULL DEFAULT 300; -- seconds
+ALTER TABLE events ADD COLUMN dispatched_at timestamp with time zone;
+`
+
+var pollIntervalDown = `
+ALTER TABLE events DROP COLUMN IF EXISTS dispatched_at;
+ALTER TABLE events DROP COLUMN IF EXISTS poll_interval;
+`
+
+var sqlitePollIntervalUp = `
+ALTER TABLE events ADD COLUMN poll_interval integer NOT NULL DEFAULT 300; -- seconds
+ALTER TABLE events ADD COLUMN dispatched_at timestamp;
+`
+
+var sqlitePollIntervalDown = `
+ALTER TABLE events DROP COLUMN dispatched_at;
+ALTER TABLE events DROP COLUMN poll_interval;
+`
+
+// tablesUp creates the tables that were added to create-tables.sql
+// after the baseline and before migrations were introduced. Databases
+// created from a later create-tables.sql already have some of them, so
+// they're only created if they don't exist.
+var tablesUp = `
+CREATE TABLE IF NOT EXISTS forecast (
+    event varchar(200) NOT NULL,
+    start_time timestamp with time zone NOT NULL,
+    end_time timestamp with time zone NOT NULL,
+    is_daytime boolean NOT NULL,
+    temperature double precision NOT NULL, -- degrees Celsius
+    humidity integer NOT NULL,
+    wind_speed double precision NOT NULL, -- kilometres per hour
+    wind_direction varchar(10) NOT NULL,
+    precipitation_probability integer NOT NULL,
+    short_forecast varchar(200) NOT NULL,
+    icon varchar(300) NOT NULL,
+    PRIMARY KEY (event, start_time)
+);
+
+CREATE TABLE IF NOT EXISTS geocodes (
+    event varchar(200) PRIMARY KEY,
+    location varchar(200) NOT NULL,
+    place_id varchar(300) NOT NULL,
+    formatted_address varchar(300) NOT NULL,
+    lat double precision NOT NULL,
+    lng double precision NOT NULL,
+    updated_at timestamp with time zone NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS readings (
+    id bigserial PRIMARY KEY,
+    event varchar(200) NOT NULL,
+    temperature double precision NOT NULL, -- degrees Celsius
+    source varchar(20) NOT NULL,
+    provider varchar(50) NOT NULL,
+    observed_at timestamp with time zone NOT NULL,
+    published_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS readings_event_observed_at_idx ON readings (event, observed_at);
+
+CREATE TABLE IF NOT EXISTS alerts (
+    event varchar(200) NOT NULL,
+    alert_id varchar(300) NOT NULL,
+    alert_type varchar(200) NOT NULL,
+    severity varchar(20) NOT NULL,
+    headline text NOT NULL,
+    expires_at timestamp with time zone NOT NULL,
+    PRIMARY KEY (event, alert_id)
+);
+
+CREATE TABLE IF NOT EXISTS daily_forecast (
+    event varchar(200) NOT NULL,
+    start_time timestamp with time zone NOT NULL,
+    end_time timestamp with time zone NOT NULL,
+    name varchar(50) NOT NULL,
+    is_daytime boolean NOT NULL,
+    temperature double precision NOT NULL, -- degrees Celsius
+    wind_speed double precision NOT NULL, -- kilometres per hour
+    wind_direction varchar(10) NOT NULL,
+    precipitation_probability integer NOT NULL,
+    short_forecast varchar(200) NOT NULL,
+    detailed_forecast text NOT NULL,
+    icon varchar(300) NOT NULL,
+    PRIMARY KEY (event, start_time)
+);
+
+CREATE TABLE IF NOT EXISTS processed_events (
+    event_id varchar(100) PRIMARY KEY,
+    processed_at timestamp with time zone NOT NULL DEFAULT now()
+);
+`
+
+var tablesDown = `
+DROP TABLE IF EXISTS processed_events;
+DROP TABLE IF EXISTS daily_forecast;
+DROP TABLE IF EXISTS alerts;
+DROP TABLE IF EXISTS readings;
+DROP TABLE IF EXISTS geocodes;
+DROP TABLE IF EXISTS forecast;
+`
+
+var sqliteTablesUp = `
+CREATE TABLE IF NOT EXISTS forecast (
+    event text NOT NULL,
+    start_time timestamp NOT NULL,
+    end_time timestamp NOT NULL,
+    is_daytime boolean NOT NULL,
+    temperature real NOT NULL, -- degrees Celsius
+    humidity integer NOT NULL,
+    wind_speed real NOT NULL, -- kilometres per hour
+    wind_direction text NOT NULL,
+    precipitation_probability integer NOT NULL,
+    short_forecast text NOT NULL,
+    icon text NOT NULL,
+    PRIMARY KEY (event, start_time)
+);
+
+CREATE TABLE IF NOT EXISTS geocodes (
+    event text PRIMARY KEY,
+    location text NOT NULL,
+    place_id text NOT NULL,
+    formatted_address text NOT NULL,
+    lat real NOT NULL,
+    lng real NOT NULL,
+    updated_at timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS readings (
+    id integer PRIMARY KEY,
+    event text NOT NULL,
+    temperature real NOT NULL, -- degrees Celsius
+    source text NOT NULL,
+    provider text NOT NULL,
+    observed_at timestamp NOT NULL,
+    published_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS readings_event_observed_at_idx ON readings (event, observed_at);
+
+CREATE TABLE IF NOT EXISTS alerts (
+    event text NOT NULL,
+    alert_id text NOT NULL,
+    alert_type text NOT NULL,
+    severity text NOT NULL,
+    headline text NOT NULL,
+    expires_at timestamp NOT NULL,
+    PRIMARY KEY (event, alert_id)
+);
+
+CREATE TABLE IF NOT EXISTS daily_forecast (
+    event text NOT NULL,
+    start_time timestamp NOT NULL,
+    end_time timestamp NOT NULL,
+    name text NOT NULL,
+    is_daytime boolean NOT NULL,
+    temperature real NOT NULL, -- degrees Celsius
+    wind_speed real NOT NULL, -- kilometres per hour
+    wind_direction text NOT NULL,
+    precipitation_probability integer NOT NULL,
+    short_forecast text NOT NULL,
+    detailed_forecast text NOT NULL,
+    icon text NOT NULL,
+    PRIMARY KEY (event, start_time)
+);
+
+CREATE TABLE IF NOT EXISTS processed_events (
+    event_id text PRIMARY KEY,
+    processed_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+`
+
+var sqliteTablesDown = tablesDown
+
+// weatherSourceUp records whether the weather is an observation from
+// the nearest station or the forecast, and when it was observed.
+var weatherSourceUp = `
+ALTER TABLE weather ADD COLUMN IF NOT EXISTS source varchar(20) NOT NULL DEFAULT 'forecast';
+ALTER TABLE weather ADD COLUMN IF NOT EXISTS observed_at timestamp with time zone NOT NULL DEFAULT now();
+`
+
+var weatherSourceDown = `
+ALTER TABLE weather DROP COLUMN IF EXISTS observed_at;
+ALTER TABLE weather DROP COLUMN IF EXISTS source;
+`
+
+// sqliteWeatherSourceUp is weatherSourceUp for SQLite, which can't add
+// a column with a non-constant default: existing rows are observed now,
+// and the stores always set observed_at.
+var sqliteWeatherSourceUp = `
+ALTER TABLE weather ADD COLUMN source text NOT NULL DEFAULT 'forecast';
+ALTER TABLE weather ADD COLUMN observed_at timestamp NOT NULL DEFAULT '';
+UPDATE weather SET observed_at = CURRENT_TIMESTAMP;
+`
+
+var sqliteWeatherSourceDown = `
+ALTER TABLE weather DROP COLUMN observed_at;
+ALTER TABLE weather DROP COLUMN source;
+`
+
+// conditionsUp adds humidity, wind, precipitation and the conditions to
+// the weather, and brings forecast tables created before they were
+// collected up to date. Their wind speed was text, such as "5 to 10
+// mph", and becomes the first number in it.
+var conditionsUp = `
+ALTER TABLE weather
+    ADD COLUMN IF NOT EXISTS humidity integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS wind_speed integer NOT NULL DEFAULT 0, -- miles per hour
+    ADD COLUMN IF NOT EXISTS wind_direction varchar(10) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS precipitation_probability integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS short_forecast varchar(200) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS icon varchar(300) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS is_daytime boolean NOT NULL DEFAULT true;
+
+ALTER TABLE forecast
+    ADD COLUMN IF NOT EXISTS is_daytime boolean NOT NULL DEFAULT true,
+    ADD COLUMN IF NOT EXISTS humidity integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS precipitation_probability integer NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS icon varchar(300) NOT NULL DEFAULT '';
+
+DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'forecast' AND column_name = 'wind_speed') = 'character varying' THEN
+        UPDATE forecast SET wind_direction = '' WHERE wind_direction IS NULL;
+        UPDATE forecast SET short_forecast = '' WHERE short_forecast IS NULL;
+        ALTER TABLE forecast ALTER COLUMN wind_speed
+            TYPE integer USING COALESCE(substring(wind_speed from '[0-9]+')::integer, 0);
+        ALTER TABLE forecast
+            ALTER COLUMN wind_speed SET NOT NULL,
+            ALTER COLUMN wind_direction SET NOT NULL,
+            ALTER COLUMN short_forecast SET NOT NULL;
+    END IF;
+END
+$$;
+`
+
+var conditionsDown = `
+ALTER TABLE forecast
+    DROP COLUMN IF EXISTS icon,
+    DROP COLUMN IF EXISTS precipitation_probability,
+    DROP COLUMN IF EXISTS humidity,
+    DROP COLUMN IF EXISTS is_daytime,
+    ALTER COLUMN wind_speed DROP NOT NULL,
+    ALTER COLUMN wind_direction DROP NOT NULL,
+    ALTER COLUMN short_forecast DROP NOT NULL;
+
+ALTER TABLE forecast ALTER COLUMN wind_speed TYPE varchar(50) USING wind_speed || ' mph';
+
+ALTER TABLE weather
+    DROP COLUMN IF EXISTS is_daytime,
+    DROP COLUMN IF EXISTS icon,
+    DROP COLUMN IF EXISTS short_forecast,
+    DROP COLUMN IF EXISTS precipitation_probability,
+    DROP COLUMN IF EXISTS wind_direction,
+    DROP COLUMN IF EXISTS wind_speed,
+    DROP COLUMN IF EXISTS humidity;
+`
+
+// sqliteConditionsUp is conditionsUp for SQLite. SQLite databases were
+// created with the current forecast table, so only the weather changes.
+var sqliteConditionsUp = `
+ALTER TABLE weather ADD COLUMN humidity integer NOT NULL DEFAULT 0;
+ALTER TABLE weather ADD COLUMN wind_speed integer NOT NULL DEFAULT 0; -- miles per hour
+ALTER TABLE weather ADD COLUMN wind_direction text NOT NULL DEFAULT '';
+ALTER TABLE weather ADD COLUMN precipitation_probability integer NOT NULL DEFAULT 0;
+ALTER TABLE weather ADD COLUMN short_forecast text NOT NULL DEFAULT '';
+ALTER TABLE weather ADD COLUMN icon text NOT NULL DEFAULT '';
+ALTER TABLE weather ADD COLUMN is_daytime boolean NOT NULL DEFAULT true;
+`
+
+var sqliteConditionsDown = `
+ALTER TABLE weather DROP COLUMN is_daytime;
+ALTER TABLE weather DROP COLUMN icon;
+ALTER TABLE weather DROP COLUMN short_forecast;
+ALTER TABLE weather DROP COLUMN precipitation_probability;
+ALTER TABLE weather DROP COLUMN wind_direction;
+ALTER TABLE weather DROP COLUMN wind_speed;
+ALTER TABLE weather DROP COLUMN humidity;
+`
+
+// metricUnitsUp converts temperatures from whole degrees Fahrenheit to
+// degrees Celsius and wind speeds from miles to kilometres per hour.
+// Only integer columns are converted; tables created after the change
+// already store metric units.
+var metricUnitsUp = `
+DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'weather' AND column_name = 'temperature') = 'integer' THEN
+        ALTER TABLE weather
+            ALTER COLUMN temperature TYPE double precision USING (temperature - 32) * 5 / 9.0,
+            ALTER COLUMN wind_speed TYPE double precision USING wind_speed * 1.609344;
+    END IF;
+
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'forecast' AND column_name = 'temperature') = 'integer' THEN
+        ALTER TABLE forecast
+            ALTER COLUMN temperature TYPE double precision USING (temperature - 32) * 5 / 9.0,
+            ALTER COLUMN wind_speed TYPE double precision USING wind_speed * 1.609344;
+    END IF;
+
+    IF (SELECT data_type FROM information_schema.columns
+        WHERE table_schema = current_schema() AND table_name = 'readings' AND column_name = 'temperature') = 'integer' THEN
+        ALTER TABLE readings
+            ALTER COLUMN temperature TYPE double precision USING (temperature - 32) * 5 / 9.0;
+    END IF;
+END
+$$;
+`
+
+var metricUnitsDown = `
+ALTER TABLE readings
+    ALTER COLUMN temperature TYPE integer USING round(temperature * 9 / 5 + 32);
+
+ALTER TABLE forecast
+    ALTER COLUMN temperature TYPE integer USING round(temperature * 9 / 5 + 32),
+    ALTER COLUMN wind_speed TYPE integer USING round(wind_speed / 1.609344);
+
+ALTER TABLE weather
+    ALTER COLUMN temperature TYPE integer USING round(temperature * 9 / 5 + 32),
+    ALTER COLUMN wind_speed TYPE integer USING round(wind_speed / 1.609344);
+`
+
+// sqliteMetricUnitsUp is metricUnitsUp for SQLite, which can't change a
+// column type, so the weather table is rebuilt. SQLite databases were
+// created with the current forecast and readings tables.
+var sqliteMetricUnitsUp = `
+CREATE TABLE weather_metric (
+    event text PRIMARY KEY,
+    location text,
+    temperature real NOT NULL, -- degrees Celsius
+    source text NOT NULL DEFAULT 'forecast',
+    observed_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    humidity integer NOT NULL DEFAULT 0,
+    wind_speed real NOT NULL DEFAULT 0, -- kilometres per hour
+    wind_direction text NOT NULL DEFAULT '',
+    precipitation_probability integer NOT NULL DEFAULT 0,
+    short_forecast text NOT NULL DEFAULT '',
+    icon text NOT NULL DEFAULT '',
+    is_daytime boolean NOT NULL DEFAULT true
+);
+
+INSERT INTO weather_metric
+    SELECT event, location, (temperature - 32) * 5 / 9.0, source, observed_at, humidity,
+        wind_speed * 1.609344, wind_direction, precipitation_probability, short_forecast, icon, is_daytime
+    FROM weather;
+
+DROP TABLE weather;
+ALTER TABLE weather_metric RENAME TO weather;
+`
+
+var sqliteMetricUnitsDown = `
+CREATE TABLE weather_imperial (
+    event text PRIMARY KEY,
+    location text,
+    temperature integer NOT NULL,
+    source text NOT NULL DEFAULT 'forecast',
+    observed_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    humidity integer NOT NULL DEFAULT 0,
+    wind_speed integer NOT NULL DEFAULT 0, -- miles per hour
+    wind_direction text NOT NULL DEFAULT '',
+    precipitation_probability integer NOT NULL DEFAULT 0,
+    short_forecast text NOT NULL DEFAULT '',
+    icon text NOT NULL DEFAULT '',
+    is_daytime boolean NOT NULL DEFAULT true
+);
+
+INSERT INTO weather_imperial
+    SELECT event, location, round(temperature * 9 / 5 + 32), source, observed_at, humidity,
+        round(wind_speed / 1.609344), wind_direction, precipitation_probability, short_forecast, icon, is_daytime
+    FROM weather;
+
+DROP TABLE weather;
+ALTER TABLE weather_imperial RENAME TO weather;
+`
+
+// eventClaimsUp records when the event that collected the weather and
+// readings was published, and when the claim on a processed event
+// expires. Existing claims expire an hour after they were made.
+var eventClaimsUp = `
+ALTER TABLE weather ADD COLUMN IF NOT EXISTS published_at timestamp with time zone NOT NULL DEFAULT now();
+ALTER TABLE readings ADD COLUMN IF NOT EXISTS published_at timestamp with time zone NOT NULL DEFAULT now();
+
+ALTER TABLE processed_events ADD COLUMN expires_at timestamp with time zone;
+UPDATE processed_events SET expires_at = processed_at + interval '1 hour';
+ALTER TABLE processed_events ALTER COLUMN expires_at SET NOT NULL;
+`
+
+var eventClaimsDown = `
+ALTER TABLE processed_events DROP COLUMN IF EXISTS expires_at;
+ALTER TABLE weather DROP COLUMN IF EXISTS published_at;
+`
+
+// sqliteEventClaimsUp is eventClaimsUp for SQLite. The readings table
+// was created with published_at, and the new columns get constant
+// defaults that the updates replace.
+var sqliteEventClaimsUp = `
+ALTER TABLE weather ADD COLUMN published_at timestamp NOT NULL DEFAULT '';
+UPDATE weather SET published_at = CURRENT_TIMESTAMP;
+
+ALTER TABLE processed_events ADD COLUMN expires_at timestamp NOT NULL DEFAULT '';
+UPDATE processed_events SET expires_at = datetime(processed_at, '+1 hour');
+`
+
+var sqliteEventClaimsDown = `
+ALTER TABLE processed_events DROP COLUMN expires_at;
+ALTER TABLE weather DROP COLUMN published_at;
+`
+
+// alertExpiryUp allows alerts without an expiry time, which stay active
+// until they're dropped from the feed.
+var alertExpiryUp = `
+ALTER TABLE alerts ALTER COLUMN expires_at DROP NOT NULL;
+`
+
+var alertExpiryDown = `
+DELETE FROM alerts WHERE expires_at IS NULL;
+ALTER TABLE alerts ALTER COLUMN expires_at SET NOT NULL;
+`
+
+// sqliteAlertExpiryUp is alertExpiryUp for SQLite, which can't drop a
+// NOT NULL constraint, so the alerts table is rebuilt.
+var sqliteAlertExpiryUp = `
+CREATE TABLE alerts_expiry (
+    event text NOT NULL,
+    alert_id text NOT NULL,
+    alert_type text NOT NULL,
+    severity text NOT NULL,
+    headline text NOT NULL,
+    expires_at timestamp,
+    PRIMARY KEY (event, alert_id)
+);
+
+INSERT INTO alerts_expiry SELECT * FROM alerts;
+DROP TABLE alerts;
+ALTER TABLE alerts_expiry RENAME TO alerts;
+`
+
+var sqliteAlertExpiryDown = `
+CREATE TABLE alerts_expiry (
+    event text NOT NULL,
+    alert_id text NOT NULL,
+    alert_type text NOT NULL,
+    severity text NOT NULL,
+    headline text NOT NULL,
+    expires_at timestamp NOT NULL,
+    PRIMARY KEY (event, alert_id)
+);
+
+INSERT INTO alerts_expiry SELECT * FROM alerts WHERE expires_at IS NOT NULL;
+DROP TABLE alerts;
+ALTER TABLE alerts_expiry RENAME TO alerts;
+`
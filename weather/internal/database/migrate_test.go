@@ -0,0 +1,442 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testDatabase is a database/sql driver that records the statements a
+// Migrator executes and tracks the schema_migrations table in memory.
+type testDatabase struct {
+	applied    map[int]string
+	statements []string
+	fail       string
+}
+
+func (d *testDatabase) Connect(ctx context.Context) (driver.Conn, error) { return d, nil }
+func (d *testDatabase) Driver() driver.Driver                            { return nil }
+
+func (d *testDatabase) Prepare(query string) (driver.Stmt, error) {
+	return &testStatement{db: d, query: query}, nil
+}
+
+func (d *testDatabase) Close() error              { return nil }
+func (d *testDatabase) Begin() (driver.Tx, error) { return d, nil }
+func (d *testDatabase) Commit() error             { return nil }
+func (d *testDatabase) Rollback() error           { return nil }
+
+type testStatement struct {
+	db    *testDatabase
+	query string
+}
+
+func (s *testStatement) Close() error  { return nil }
+func (s *testStatement) NumInput() int { return -1 }
+
+func (s *testStatement) Exec(args []driver.Value) (driver.Result, error) {
+	switch s.query {
+	case migrationLockQuery, createMigrationsQuery:
+	case insertMigrationQuery:
+		s.db.applied[int(args[0].(int64))] = args[1].(string)
+	case deleteMigrationQuery:
+		delete(s.db.applied, int(args[0].(int64)))
+	default:
+		if s.query == s.db.fail {
+			return nil, fmt.Errorf("syntax error")
+		}
+		s.db.statements = append(s.db.statements, s.query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testStatement) Query(args []driver.Value) (driver.Rows, error) {
+	switch s.query {
+	case migrationAppliedQuery:
+		_, ok := s.db.applied[int(args[0].(int64))]
+		return &testRows{values: []driver.Value{ok}}, nil
+	case migrationVersionQuery:
+		var version int64
+		for v := range s.db.applied {
+			if int64(v) > version {
+				version = int64(v)
+			}
+		}
+		return &testRows{values: []driver.Value{version}}, nil
+	}
+	return nil, fmt.Errorf("unexpected query: %s", s.query)
+}
+
+type testRows struct {
+	values []driver.Value
+	done   bool
+}
+
+func (r *testRows) Columns() []string { return make([]string, len(r.values)) }
+func (r *testRows) Close() error      { return nil }
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	copy(dest, r.values)
+	return nil
+}
+
+var testMigrations = []Migration{
+	{Version: 2, Name: "second", Up: "up 2", Down: "down 2"},
+	{Version: 1, Name: "first", Up: "up 1", Down: "down 1"},
+	{Version: 3, Name: "third", Up: "up 3", Down: "down 3"},
+}
+
+func TestMigratorUp(t *testing.T) {
+	ctx := context.Background()
+	db := &testDatabase{applied: map[int]string{1: "first"}}
+	m := &Migrator{DB: sql.OpenDB(db), Migrations: testMigrations}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 2 || applied[0].Version != 2 || applied[1].Version != 3 {
+		t.Errorf("wrong applied migrations: got %v", applied)
+	}
+
+	want := []string{"up 2", "up 3"}
+	if !reflect.DeepEqual(db.statements, want) {
+		t.Errorf("wrong statements: got %q want %q", db.statements, want)
+	}
+
+	version, err := m.Version(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 {
+		t.Errorf("wrong version: got %d want %d", version, 3)
+	}
+
+	applied, err = m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("wrong applied migrations: got %v want none", applied)
+	}
+}
+
+func TestMigratorUpError(t *testing.T) {
+	db := &testDatabase{applied: map[int]string{}, fail: "up 2"}
+	m := &Migrator{DB: sql.OpenDB(db), Migrations: testMigrations}
+
+	applied, err := m.Up(context.Background())
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if len(applied) != 1 || applied[0].Version != 1 {
+		t.Errorf("wrong applied migrations: got %v", applied)
+	}
+
+	want := map[int]string{1: "first"}
+	if !reflect.DeepEqual(db.applied, want) {
+		t.Errorf("wrong recorded versions: got %v want %v", db.applied, want)
+	}
+}
+
+func TestMigratorDown(t *testing.T) {
+	db := &testDatabase{applied: map[int]string{1: "first", 2: "second", 3: "third"}}
+	m := &Migrator{DB: sql.OpenDB(db), Migrations: testMigrations}
+
+	reverted, err := m.Down(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reverted) != 2 || reverted[0].Version != 3 || reverted[1].Version != 2 {
+		t.Errorf("wrong reverted migrations: got %v", reverted)
+	}
+
+	want := []string{"down 3", "down 2"}
+	if !reflect.DeepEqual(db.statements, want) {
+		t.Errorf("wrong statements: got %q want %q", db.statements, want)
+	}
+
+	if _, ok := db.applied[1]; !ok || len(db.applied) != 1 {
+		t.Errorf("wrong recorded versions: got %v want only version 1", db.applied)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	for i, m := range Migrations {
+		if m.Version != i+1 {
+			t.Errorf("wrong version for migration %q: got %d want %d", m.Name, m.Version, i+1)
+		}
+		if m.Name == "" || m.Up == "" || m.Down == "" {
+			t.Errorf("migration %d must have a name, up and down", m.Version)
+		}
+		if m.SQLiteUp == "" || m.SQLiteDown == "" {
+			t.Errorf("migration %d must have SQLite up and down", m.Version)
+		}
+	}
+}
+
+// newTestSQLiteDB returns a new SQLite database in a temporary
+// directory.
+func newTestSQLiteDB(t *testing.T) (*sql.DB, func()) {
+	dir, err := ioutil.TempDir("", "weather")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenSQLite(filepath.Join(dir, "weather.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrationsSQLite(t *testing.T) {
+	db, done := newTestSQLiteDB(t)
+	defer done()
+
+	ctx := context.Background()
+	m := &Migrator{DB: db, Migrations: Migrations, SQLite: true}
+
+	// Every migration applies, reverts and applies again.
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Down(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if tables := sqliteColumns(t, db); len(tables) != 1 {
+		t.Errorf("wrong tables after reverting every migration: got %v want only schema_migrations", tables)
+	}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) {
+		t.Errorf("wrong number of applied migrations: got %d want %d", len(applied), len(Migrations))
+	}
+}
+
+// newTestPostgresDB returns a connection to the Postgres database at
+// TEST_DATABASE_URL that uses schema, which is created empty and
+// dropped when the returned function is called. The test is skipped
+// when TEST_DATABASE_URL isn't set.
+func newTestPostgresDB(t *testing.T, schema string) (*sql.DB, func()) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL isn't set")
+	}
+
+	admin, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = admin.Exec(fmt.Sprintf("DROP SCHEMA IF EXISTS %[1]s CASCADE; CREATE SCHEMA %[1]s", schema))
+	if err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+
+	// Parameters lib/pq doesn't know are sent to the server as run-time
+	// parameters, so every connection uses the schema.
+	if strings.Contains(url, "://") {
+		if strings.Contains(url, "?") {
+			url += "&search_path=" + schema
+		} else {
+			url += "?search_path=" + schema
+		}
+	} else {
+		url += " search_path=" + schema
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		admin.Close()
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		admin.Exec(fmt.Sprintf("DROP SCHEMA %s CASCADE", schema))
+		admin.Close()
+	}
+}
+
+// TestMigrationsPostgres applies, reverts and applies every migration
+// to an empty Postgres database.
+func TestMigrationsPostgres(t *testing.T) {
+	db, done := newTestPostgresDB(t, "weather_test_migrations")
+	defer done()
+
+	ctx := context.Background()
+	m := &Migrator{DB: db, Migrations: Migrations}
+
+	for i := 0; i < 2; i++ {
+		applied, err := m.Up(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != len(Migrations) {
+			t.Errorf("wrong number of applied migrations: got %d want %d", len(applied), len(Migrations))
+		}
+
+		if i == 0 {
+			if _, err := m.Down(ctx, 0); err != nil {
+				t.Fatal(err)
+			}
+			if tables := postgresColumns(t, db); len(tables) != 1 {
+				t.Errorf("wrong tables after reverting every migration: got %v want only schema_migrations", tables)
+			}
+		}
+	}
+}
+
+// TestMigrationsPostgresBaseline migrates a database created by hand
+// from the original create-tables.sql, which stored temperatures in
+// degrees Fahrenheit, and compares it to a database migrated from
+// empty.
+func TestMigrationsPostgresBaseline(t *testing.T) {
+	db, done := newTestPostgresDB(t, "weather_test_baseline")
+	defer done()
+
+	ctx := context.Background()
+
+	_, err := db.Exec(`CREATE TABLE weather (
+    event varchar(200) PRIMARY KEY,
+    location varchar(200),
+    temperature integer NOT NULL
+);
+INSERT INTO weather VALUES ('GopherCon', 'Denver, Colorado, USA', 86)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := (&Migrator{DB: db, Migrations: Migrations}).Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(Migrations) {
+		t.Errorf("wrong number of applied migrations: got %d want %d", len(applied), len(Migrations))
+	}
+
+	var temperature float64
+	if err := db.QueryRow(`SELECT temperature FROM weather WHERE event = 'GopherCon'`).Scan(&temperature); err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(temperature-30) > 0.001 {
+		t.Errorf("wrong temperature: got %v want %v", temperature, 30)
+	}
+
+	empty, done := newTestPostgresDB(t, "weather_test_empty")
+	defer done()
+
+	if _, err := (&Migrator{DB: empty, Migrations: Migrations}).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := postgresColumns(t, db), postgresColumns(t, empty); !reflect.DeepEqual(got, want) {
+		t.Errorf("migrated baseline schema doesn't match a new database: got %v want %v", got, want)
+	}
+}
+
+// TestMigrationsSQLiteMatchPostgres compares the tables and columns
+// created by the Postgres and SQLite migrations. It runs against the
+// Postgres database at TEST_DATABASE_URL and is skipped without it.
+func TestMigrationsSQLiteMatchPostgres(t *testing.T) {
+	pg, done := newTestPostgresDB(t, "weather_test_sqlite")
+	defer done()
+
+	ctx := context.Background()
+
+	if _, err := (&Migrator{DB: pg, Migrations: Migrations}).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	db, done := newTestSQLiteDB(t)
+	defer done()
+
+	if _, err := (&Migrator{DB: db, Migrations: Migrations, SQLite: true}).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := sqliteColumns(t, db), postgresColumns(t, pg); !reflect.DeepEqual(got, want) {
+		t.Errorf("SQLite schema doesn't match Postgres: got %v want %v", got, want)
+	}
+}
+
+// postgresColumns returns the sorted column names of each table in the
+// current schema of a Postgres database.
+func postgresColumns(t *testing.T, db *sql.DB) map[string][]string {
+	rows, err := db.Query(`SELECT table_name, column_name FROM information_schema.columns
+  WHERE table_schema = current_schema()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	tables := make(map[string][]string)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			t.Fatal(err)
+		}
+		tables[table] = append(tables[table], column)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for _, columns := range tables {
+		sort.Strings(columns)
+	}
+
+	return tables
+}
+
+// sqliteColumns returns the sorted column names of each table in a
+// SQLite database.
+func sqliteColumns(t *testing.T, db *sql.DB) map[string][]string {
+	rows, err := db.Query(`SELECT m.name, c.name FROM sqlite_master m, pragma_table_info(m.name) c
+  WHERE m.type = 'table'
+  ORDER BY m.name, c.name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	tables := make(map[string][]string)
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			t.Fatal(err)
+		}
+		tables[table] = append(tables[table], column)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return tables
+}
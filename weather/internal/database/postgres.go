@@ -0,0 +1,243 @@
+package database
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kelseyhightower/weather-internal/secrets"
+	"github.com/lib/pq"
+)
+
+// sslRequestCode is the Postgres SSLRequest message code.
+//
+// See the Postgres docs for more details:
+//
+//	https://www.postgresql.org/docs/current/protocol-flow.html#id-1.10.6.7.11
+const sslRequestCode = 80877103
+
+// OpenPostgres opens the database using the password and TLS material
+// from source. The connection host, database and user are read from
+// the PGHOST, PGDATABASE and PGUSER environment variables by lib/pq.
+// Secrets are kept in memory; they're never written to disk or the
+// process environment.
+//
+// When PGSSLMODE is disable, for a local database, the connection isn't
+// encrypted and only the password secret is needed.
+func OpenPostgres(ctx context.Context, source secrets.Source) (*sql.DB, error) {
+	password, err := secrets.String(ctx, source, "password")
+	if err != nil {
+		return nil, err
+	}
+
+	if os.Getenv("PGSSLMODE") == "disable" {
+		dsn := postgresDSN(map[string]string{
+			"password": password,
+			"sslmode":  "disable",
+		})
+		return sql.OpenDB(&PostgresConnector{DSN: dsn}), nil
+	}
+
+	clientCert, err := source.Secret(ctx, "client.pem")
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey, err := source.Secret(ctx, "client.key")
+	if err != nil {
+		return nil, err
+	}
+
+	serverCert, err := source.Secret(ctx, "server.pem")
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := postgresTLSConfig(os.Getenv("PGSSLMODE"), os.Getenv("PGHOST"), clientCert, clientKey, serverCert)
+	if err != nil {
+		return nil, err
+	}
+
+	// TLS is negotiated by the connector, so lib/pq must not attempt it
+	// again; sslmode in the connection string overrides PGSSLMODE.
+	dsn := postgresDSN(map[string]string{
+		"password": password,
+		"sslmode":  "disable",
+	})
+
+	return sql.OpenDB(&PostgresConnector{DSN: dsn, TLSConfig: tlsConfig}), nil
+}
+
+// PostgresConnector is a driver.Connector that connects to Postgres
+// over TLS using an in-memory tls.Config, which lib/pq only supports
+// through certificate files.
+type PostgresConnector struct {
+	// DSN is the lib/pq connection string. It must set sslmode to
+	// disable.
+	DSN string
+
+	// TLSConfig is the TLS configuration for the connection. The
+	// connection isn't encrypted when it's nil.
+	TLSConfig *tls.Config
+}
+
+func (c *PostgresConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if c.TLSConfig == nil {
+		return pq.Open(c.DSN)
+	}
+	return pq.DialOpen(&tlsDialer{config: c.TLSConfig}, c.DSN)
+}
+
+func (c *PostgresConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// tlsDialer is a pq.Dialer that sends the Postgres SSLRequest message
+// and upgrades the connection to TLS before lib/pq starts up.
+type tlsDialer struct {
+	config *tls.Config
+}
+
+func (d *tlsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialTimeout(network, address, 0)
+}
+
+func (d *tlsDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	tlsConn, err := startTLS(conn, d.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return tlsConn, nil
+}
+
+func startTLS(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request[0:4], 8)
+	binary.BigEndian.PutUint32(request[4:8], sslRequestCode)
+
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+
+	if response[0] != 'S' {
+		return nil, fmt.Errorf("postgres server does not support SSL")
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// postgresTLSConfig returns the TLS configuration for sslmode, which is
+// one of require, verify-ca or verify-full and defaults to verify-ca.
+// Cloud SQL server certificates aren't issued for the instance IP
+// address, so verify-ca checks the certificate chain without checking
+// the host name, matching lib/pq.
+func postgresTLSConfig(sslmode, host string, clientCert, clientKey, serverCA []byte) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(serverCA) {
+		return nil, fmt.Errorf("invalid server certificate: no certificates found")
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+		ServerName:   host,
+	}
+
+	switch sslmode {
+	case "verify-full":
+	case "", "verify-ca":
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyChain(rawCerts, roots)
+		}
+	case "require":
+		config.InsecureSkipVerify = true
+	default:
+		return nil, fmt.Errorf("unsupported PGSSLMODE %q", sslmode)
+	}
+
+	return config, nil
+}
+
+func verifyChain(rawCerts [][]byte, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("postgres server sent no certificates")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// postgresDSN returns a lib/pq connection string for params with each
+// value quoted and escaped.
+func postgresDSN(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s='%s'", k, r.Replace(params[k])))
+	}
+
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,228 @@
+package database
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/weather-internal/secrets"
+)
+
+func TestPostgresDSN(t *testing.T) {
+	got := postgresDSN(map[string]string{
+		"password": `it's a \secret`,
+		"sslmode":  "disable",
+	})
+
+	want := `password='it\'s a \\secret' sslmode='disable'`
+	if got != want {
+		t.Errorf("wrong dsn: got %v want %v", got, want)
+	}
+}
+
+// testCertificate returns a PEM encoded certificate and key signed by
+// parent, or a self-signed CA certificate when parent is nil.
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) ([]byte, []byte, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, cert, key
+}
+
+func TestTLSDialer(t *testing.T) {
+	caPEM, _, ca, caKey := testCertificate(t, "Google Cloud SQL Server CA", nil, nil)
+	serverPEM, serverKeyPEM, _, _ := testCertificate(t, "hightowerlabs:weather", ca, caKey)
+	clientPEM, clientKeyPEM, _, _ := testCertificate(t, "client", ca, caKey)
+	otherCAPEM, _, _, _ := testCertificate(t, "Other CA", nil, nil)
+
+	serverCert, err := tls.X509KeyPair(serverPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Accept connections like a Postgres server: answer the SSLRequest
+	// message, then require a client certificate.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				request := make([]byte, 8)
+				if _, err := io.ReadFull(conn, request); err != nil {
+					return
+				}
+				if binary.BigEndian.Uint32(request[4:8]) != sslRequestCode {
+					return
+				}
+				conn.Write([]byte("S"))
+
+				tlsConn := tls.Server(conn, &tls.Config{
+					Certificates: []tls.Certificate{serverCert},
+					ClientAuth:   tls.RequireAndVerifyClientCert,
+					ClientCAs:    clientCAs,
+				})
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				tlsConn.Write([]byte("R"))
+			}(conn)
+		}
+	}()
+
+	// The server certificate isn't issued for the host, so verify-ca
+	// must succeed and verify-full must fail.
+	tests := []struct {
+		sslmode  string
+		serverCA []byte
+		ok       bool
+	}{
+		{"verify-ca", caPEM, true},
+		{"verify-ca", otherCAPEM, false},
+		{"verify-full", caPEM, false},
+		{"require", otherCAPEM, true},
+	}
+
+	for _, tt := range tests {
+		config, err := postgresTLSConfig(tt.sslmode, "127.0.0.1", clientPEM, clientKeyPEM, tt.serverCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := &tlsDialer{config: config}
+		conn, err := d.DialTimeout("tcp", l.Addr().String(), 5*time.Second)
+		if (err == nil) != tt.ok {
+			t.Errorf("wrong dial result for %s: got error %v want ok %v", tt.sslmode, err, tt.ok)
+		}
+		if err != nil {
+			continue
+		}
+
+		response := make([]byte, 1)
+		if _, err := io.ReadFull(conn, response); err != nil || response[0] != 'R' {
+			t.Errorf("wrong response over TLS for %s: got %q, %v", tt.sslmode, response, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestOpenPostgresSSLModeDisable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "password"), []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Record the first message sent by the client, which must be the
+	// startup message rather than an SSLRequest.
+	codes := make(chan uint32, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		request := make([]byte, 8)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		codes <- binary.BigEndian.Uint32(request[4:8])
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	for k, v := range map[string]string{"PGSSLMODE": "disable", "PGHOST": host, "PGPORT": port} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, v)
+	}
+
+	// Only the password secret is needed.
+	db, err := OpenPostgres(context.Background(), &secrets.DirSource{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.PingContext(context.Background())
+
+	select {
+	case code := <-codes:
+		if code == sslRequestCode {
+			t.Errorf("client requested SSL with sslmode disable")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the client")
+	}
+}
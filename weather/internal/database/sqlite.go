@@ -0,0 +1,33 @@
+package database
+
+import (
+	"database/sql"
+	"net/url"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// OpenSQLite opens the SQLite weather database at path, creating the
+// file if it doesn't exist. weather-api and the weather-data-collector
+// can open the same file.
+func OpenSQLite(path string) (*sql.DB, error) {
+	// Writers from both functions wait for each other rather than
+	// failing with SQLITE_BUSY, and transactions take the write lock
+	// when they begin so a read can't be upgraded into a deadlock.
+	dsn := "file:" + path + "?" + url.Values{
+		"_busy_timeout": {"5000"},
+		"_journal_mode": {"WAL"},
+		"_txlock":       {"immediate"},
+	}.Encode()
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite has a single writer; a single connection also keeps each
+	// transaction on the connection that began it.
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
@@ -0,0 +1,99 @@
+package firestoredb_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+	"github.com/kelseyhightower/weather-internal/firestoredb"
+	"github.com/kelseyhightower/weather-internal/firestoretest"
+	"google.golang.org/grpc/codes"
+)
+
+func TestNewClientEmulator(t *testing.T) {
+	s, err := firestoretest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	defer os.Setenv("FIRESTORE_EMULATOR_HOST", os.Getenv("FIRESTORE_EMULATOR_HOST"))
+	os.Setenv("FIRESTORE_EMULATOR_HOST", s.Addr)
+	defer os.Setenv("GCP_PROJECT", os.Getenv("GCP_PROJECT"))
+	os.Setenv("GCP_PROJECT", "hightowerlabs")
+
+	ctx := context.Background()
+	client, err := firestoredb.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Event names may contain slashes and escapes.
+	ref := client.Collection("weather").Doc(firestoredb.ID("Go/Northwest 100%"))
+	if _, err := ref.Set(ctx, map[string]interface{}{"event": "Go/Northwest 100%"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Doc("weather/Go%2FNorthwest+100%25").Get(ctx); err != nil {
+		t.Errorf("error reading the escaped document: %v", err)
+	}
+	if auth := s.Authorization(); len(auth) != 1 || auth[0] != "Bearer owner" {
+		t.Errorf("wrong emulator authorization: got %v want %v", auth, "Bearer owner")
+	}
+}
+
+func TestGet(t *testing.T) {
+	ctx := context.Background()
+	client, done, err := firestoretest.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	ref := client.Collection("weather").Doc(firestoredb.ID("GopherCon"))
+
+	d, err := firestoredb.Get(ctx, nil, ref)
+	if err != nil || d != nil {
+		t.Fatalf("wrong result for a missing document: got %v, %v", d, err)
+	}
+
+	if _, err := ref.Create(ctx, map[string]interface{}{"event": "GopherCon"}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ref.Create(ctx, map[string]interface{}{"event": "GopherCon"})
+	if !firestoredb.IsCode(err, codes.AlreadyExists) {
+		t.Errorf("wrong error creating an existing document: got %v", err)
+	}
+
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		d, err := firestoredb.Get(ctx, tx, ref)
+		if err != nil {
+			return err
+		}
+		if d == nil || d.Data()["event"] != "GopherCon" {
+			return fmt.Errorf("wrong document in transaction: got %v", d)
+		}
+
+		missing, err := firestoredb.Get(ctx, tx, client.Collection("weather").Doc(firestoredb.ID("GothamGo")))
+		if err != nil || missing != nil {
+			return fmt.Errorf("wrong result for a missing document in transaction: got %v, %v", missing, err)
+		}
+
+		return tx.Set(ref, map[string]interface{}{"temperature": 22.5}, firestore.MergeAll)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = firestoredb.Get(ctx, nil, ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := d.Data(); data["event"] != "GopherCon" || data["temperature"] != 22.5 {
+		t.Errorf("wrong document after merge: got %+v", data)
+	}
+}
@@ -0,0 +1,333 @@
+// Package firestoretest provides a fake Firestore server for testing
+// the Firestore stores without the Firestore emulator.
+package firestoretest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/kelseyhightower/weather-internal/firestoredb"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/firestore/v1beta1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Server is a fake of the Firestore API holding documents in memory.
+// It supports the requests made by the client library for the stores,
+// with transactions that are committed without locking and update
+// masks of top-level fields.
+type Server struct {
+	// Addr is the address the server is listening on.
+	Addr string
+
+	gsrv *grpc.Server
+	fake *firestoreServer
+}
+
+type firestoreServer struct {
+	pb.FirestoreServer
+
+	mu            sync.Mutex
+	documents     map[string]*pb.Document
+	authorization []string // of the last commit
+}
+
+// NewServer starts a Server listening on a local port.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Addr: l.Addr().String(),
+		gsrv: grpc.NewServer(),
+		fake: &firestoreServer{documents: make(map[string]*pb.Document)},
+	}
+	pb.RegisterFirestoreServer(s.gsrv, s.fake)
+	go s.gsrv.Serve(l)
+
+	return s, nil
+}
+
+// Authorization returns the authorization metadata of the last commit.
+func (s *Server) Authorization() []string {
+	s.fake.mu.Lock()
+	defer s.fake.mu.Unlock()
+	return s.fake.authorization
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.gsrv.Stop()
+}
+
+// NewClient returns a client for the Firestore emulator, using a new
+// project for each call, when FIRESTORE_EMULATOR_HOST is set, and for
+// a new Server otherwise. The returned function closes them.
+func NewClient(ctx context.Context) (*firestore.Client, func(), error) {
+	project := fmt.Sprintf("test-%d", time.Now().UnixNano())
+
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") != "" {
+		defer os.Setenv("GCP_PROJECT", os.Getenv("GCP_PROJECT"))
+		os.Setenv("GCP_PROJECT", project)
+
+		client, err := firestoredb.NewClient(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return client, func() { client.Close() }, nil
+	}
+
+	s, err := NewServer()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := grpc.Dial(s.Addr, grpc.WithInsecure())
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	client, err := firestore.NewClient(ctx, project, option.WithGRPCConn(conn))
+	if err != nil {
+		s.Close()
+		return nil, nil, err
+	}
+
+	return client, func() {
+		client.Close()
+		s.Close()
+	}, nil
+}
+
+func (f *firestoreServer) BatchGetDocuments(req *pb.BatchGetDocumentsRequest, stream pb.Firestore_BatchGetDocumentsServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, name := range req.Documents {
+		r := &pb.BatchGetDocumentsResponse{ReadTime: ptypes.TimestampNow()}
+		if d, ok := f.documents[name]; ok {
+			r.Result = &pb.BatchGetDocumentsResponse_Found{Found: d}
+		} else {
+			r.Result = &pb.BatchGetDocumentsResponse_Missing{Missing: name}
+		}
+		if err := stream.Send(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *firestoreServer) BeginTransaction(ctx context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	return &pb.BeginTransactionResponse{Transaction: []byte("transaction")}, nil
+}
+
+func (f *firestoreServer) Rollback(ctx context.Context, req *pb.RollbackRequest) (*empty.Empty, error) {
+	return &empty.Empty{}, nil
+}
+
+func (f *firestoreServer) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.authorization = md["authorization"]
+
+	for _, w := range req.Writes {
+		update := w.GetUpdate()
+		exists, ok := w.GetCurrentDocument().GetConditionType().(*pb.Precondition_Exists)
+		if update == nil || !ok {
+			continue
+		}
+		_, found := f.documents[update.Name]
+		switch {
+		case found && !exists.Exists:
+			return nil, status.Errorf(codes.AlreadyExists, "%s already exists", update.Name)
+		case !found && exists.Exists:
+			return nil, status.Errorf(codes.NotFound, "%s not found", update.Name)
+		}
+	}
+
+	now := ptypes.TimestampNow()
+	response := &pb.CommitResponse{CommitTime: now}
+	for _, w := range req.Writes {
+		response.WriteResults = append(response.WriteResults, &pb.WriteResult{UpdateTime: now})
+
+		if name := w.GetDelete(); name != "" {
+			delete(f.documents, name)
+			continue
+		}
+
+		update := w.GetUpdate()
+		fields := update.Fields
+		if w.UpdateMask != nil {
+			fields = make(map[string]*pb.Value)
+			if d, ok := f.documents[update.Name]; ok {
+				for name, v := range d.Fields {
+					fields[name] = v
+				}
+			}
+			for _, path := range w.UpdateMask.FieldPaths {
+				if v, ok := update.Fields[path]; ok {
+					fields[path] = v
+				} else {
+					delete(fields, path)
+				}
+			}
+		}
+
+		f.documents[update.Name] = &pb.Document{Name: update.Name, Fields: fields, CreateTime: now, UpdateTime: now}
+	}
+
+	return response, nil
+}
+
+func (f *firestoreServer) RunQuery(req *pb.RunQueryRequest, stream pb.Firestore_RunQueryServer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The client library sends the database as the parent of top-level
+	// collections.
+	parent := req.Parent
+	if !strings.Contains(parent, "/documents") {
+		parent += "/documents"
+	}
+
+	q := req.GetStructuredQuery()
+	prefix := parent + "/" + q.From[0].CollectionId + "/"
+
+	var filters []*pb.StructuredQuery_FieldFilter
+	if c := q.GetWhere().GetCompositeFilter(); c != nil {
+		for _, filter := range c.Filters {
+			filters = append(filters, filter.GetFieldFilter())
+		}
+	} else if filter := q.GetWhere().GetFieldFilter(); filter != nil {
+		filters = append(filters, filter)
+	}
+
+	var documents []*pb.Document
+	for name, d := range f.documents {
+		if !strings.HasPrefix(name, prefix) || strings.Contains(strings.TrimPrefix(name, prefix), "/") {
+			continue
+		}
+
+		ok := true
+		for _, filter := range filters {
+			if !match(d.Fields[filter.Field.FieldPath], filter.Op, filter.Value) {
+				ok = false
+			}
+		}
+		if ok {
+			documents = append(documents, d)
+		}
+	}
+
+	sort.Slice(documents, func(i, j int) bool {
+		for _, o := range q.OrderBy {
+			a, b := documents[i].Fields[o.Field.FieldPath], documents[j].Fields[o.Field.FieldPath]
+			if c, ok := compare(a, b); ok && c != 0 {
+				return (c < 0) == (o.Direction != pb.StructuredQuery_DESCENDING)
+			}
+		}
+		return documents[i].Name < documents[j].Name
+	})
+
+	if q.Limit != nil && len(documents) > int(q.Limit.Value) {
+		documents = documents[:q.Limit.Value]
+	}
+
+	now := ptypes.TimestampNow()
+	for _, d := range documents {
+		if err := stream.Send(&pb.RunQueryResponse{Document: d, ReadTime: now}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func match(v *pb.Value, op pb.StructuredQuery_FieldFilter_Operator, value *pb.Value) bool {
+	c, ok := compare(v, value)
+	if !ok {
+		return false
+	}
+
+	switch op {
+	case pb.StructuredQuery_FieldFilter_EQUAL:
+		return c == 0
+	case pb.StructuredQuery_FieldFilter_LESS_THAN:
+		return c < 0
+	case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+		return c <= 0
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+		return c > 0
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+		return c >= 0
+	}
+	return false
+}
+
+// compare compares values of the same type; ok is false
+// for missing values and values of different types, which never match
+// a filter.
+func compare(a, b *pb.Value) (c int, ok bool) {
+	number := func(v *pb.Value) (float64, bool) {
+		switch x := v.GetValueType().(type) {
+		case *pb.Value_IntegerValue:
+			return float64(x.IntegerValue), true
+		case *pb.Value_DoubleValue:
+			return x.DoubleValue, true
+		}
+		return 0, false
+	}
+
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			return sign(x < y, x > y), true
+		}
+		return 0, false
+	}
+
+	switch x := a.GetValueType().(type) {
+	case *pb.Value_TimestampValue:
+		if y := b.GetTimestampValue(); y != nil {
+			s, _ := ptypes.Timestamp(x.TimestampValue)
+			t, _ := ptypes.Timestamp(y)
+			return sign(s.Before(t), s.After(t)), true
+		}
+	case *pb.Value_StringValue:
+		if y, ok := b.GetValueType().(*pb.Value_StringValue); ok {
+			return strings.Compare(x.StringValue, y.StringValue), true
+		}
+	case *pb.Value_BooleanValue:
+		if y, ok := b.GetValueType().(*pb.Value_BooleanValue); ok {
+			return sign(!x.BooleanValue && y.BooleanValue, x.BooleanValue && !y.BooleanValue), true
+		}
+	}
+	return 0, false
+}
+
+func sign(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
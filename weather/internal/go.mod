@@ -0,0 +1,22 @@
+module github.com/kelseyhightower/weather-internal
+
+require (
+	cloud.google.com/go v0.26.0
+	contrib.go.opencensus.io/exporter/stackdriver v0.6.0
+	github.com/aws/aws-sdk-go v1.15.22 // indirect
+	github.com/golang/protobuf v1.2.0
+	github.com/google/go-cmp v0.5.8 // indirect
+	github.com/googleapis/gax-go v2.0.0+incompatible // indirect
+	github.com/lib/pq v1.0.0
+	github.com/mattn/go-sqlite3 v1.14.16
+	go.opencensus.io v0.15.0
+	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d // indirect
+	golang.org/x/oauth2 v0.0.0-20180821212333-d2e6202438be
+	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f // indirect
+	golang.org/x/sys v0.0.0-20180824143301-4910a1d54f87 // indirect
+	golang.org/x/text v0.3.0 // indirect
+	google.golang.org/api v0.0.0-20180826000528-7954115fcf34
+	google.golang.org/appengine v1.1.0 // indirect
+	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8
+	google.golang.org/grpc v1.14.0
+)
@@ -0,0 +1,135 @@
+// Package health retries the initialization of a function instance and
+// reports its state to health checks.
+package health
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Initializer runs an initialization function until it succeeds. A
+// failed attempt is recorded and returned to callers, and retried with
+// exponential backoff on a later call, instead of panicking and leaving
+// the function instance unusable.
+type Initializer struct {
+	init       func() error
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	now        func() time.Time
+
+	mu       sync.Mutex
+	done     bool
+	err      error
+	attempts int
+	next     time.Time
+}
+
+// InitState describes the initialization of a function instance for
+// health checks.
+type InitState struct {
+	Ready       bool      `json:"ready"`
+	Attempts    int       `json:"attempts"`
+	Error       string    `json:"error,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt,omitempty"`
+}
+
+// NewInitializer returns an Initializer for init that backs off from
+// one second up to a minute between attempts.
+func NewInitializer(init func() error) *Initializer {
+	return &Initializer{
+		init:       init,
+		minBackoff: time.Second,
+		maxBackoff: time.Minute,
+		now:        time.Now,
+	}
+}
+
+// Do runs the initialization function unless it already succeeded. The
+// last error is returned without another attempt while backing off.
+func (i *Initializer) Do() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.done {
+		return nil
+	}
+
+	if i.err != nil && i.now().Before(i.next) {
+		return i.err
+	}
+
+	i.attempts++
+	if err := i.init(); err != nil {
+		i.err = err
+
+		backoff := i.minBackoff
+		for n := 1; n < i.attempts && backoff < i.maxBackoff; n++ {
+			backoff *= 2
+		}
+		if backoff > i.maxBackoff {
+			backoff = i.maxBackoff
+		}
+		i.next = i.now().Add(backoff)
+
+		return err
+	}
+
+	i.done = true
+	i.err = nil
+	return nil
+}
+
+// State returns the current initialization state.
+func (i *Initializer) State() InitState {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	s := InitState{Ready: i.done, Attempts: i.attempts}
+	if i.err != nil {
+		s.Error = i.err.Error()
+		s.NextAttempt = i.next
+	}
+	return s
+}
+
+// retryAfter returns the number of seconds until the next attempt,
+// rounded up, for the Retry-After header.
+func (i *Initializer) retryAfter() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	d := i.next.Sub(i.now())
+	if d <= 0 {
+		return 1
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// ServeHealth attempts initialization and responds with the
+// initialization state; the status is 503 Service Unavailable until it
+// succeeds.
+func (i *Initializer) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	if err := i.Do(); err != nil {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(i.State())
+}
+
+// ServeUnavailable logs the initialization error and responds with 503
+// Service Unavailable. The structured logger may be the dependency that
+// failed, so the error is written to the standard logger, which Cloud
+// Functions forwards to Stackdriver Logging.
+func (i *Initializer) ServeUnavailable(w http.ResponseWriter, err error) {
+	log.Printf("initialization failed: %v", err)
+
+	w.Header().Set("Retry-After", strconv.Itoa(i.retryAfter()))
+	http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+}
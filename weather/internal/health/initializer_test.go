@@ -0,0 +1,115 @@
+package health
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestInitializer(t *testing.T) {
+	now := time.Date(2018, 8, 28, 9, 0, 0, 0, time.UTC)
+
+	calls := 0
+	i := NewInitializer(func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("storage: object doesn't exist")
+		}
+		return nil
+	})
+	i.now = func() time.Time { return now }
+
+	if err := i.Do(); err == nil {
+		t.Fatalf("expected the first attempt to fail")
+	}
+
+	// The error is returned without another attempt while backing off.
+	if err := i.Do(); err == nil || calls != 1 {
+		t.Errorf("wrong number of attempts while backing off: got %v want %v", calls, 1)
+	}
+
+	state := i.State()
+	if state.Ready || state.Error == "" || !state.NextAttempt.Equal(now.Add(time.Second)) {
+		t.Errorf("wrong state after a failed attempt: got %+v", state)
+	}
+
+	now = now.Add(time.Second)
+	if err := i.Do(); err == nil {
+		t.Fatalf("expected the second attempt to fail")
+	}
+	if got := i.State().NextAttempt; !got.Equal(now.Add(2 * time.Second)) {
+		t.Errorf("wrong backoff: got next attempt %v want %v", got, now.Add(2*time.Second))
+	}
+	if got := i.retryAfter(); got != 2 {
+		t.Errorf("wrong retry after: got %v want %v", got, 2)
+	}
+
+	now = now.Add(2 * time.Second)
+	if err := i.Do(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := i.Do(); err != nil || calls != 3 {
+		t.Errorf("wrong number of attempts after success: got %v want %v", calls, 3)
+	}
+
+	state = i.State()
+	if !state.Ready || state.Attempts != 3 || state.Error != "" {
+		t.Errorf("wrong state after success: got %+v", state)
+	}
+}
+
+func TestInitializerMaxBackoff(t *testing.T) {
+	now := time.Now()
+
+	i := NewInitializer(func() error { return errors.New("failed") })
+	i.now = func() time.Time { return now }
+
+	for n := 0; n < 10; n++ {
+		i.Do()
+		now = i.State().NextAttempt
+	}
+
+	i.Do()
+	if got := i.State().NextAttempt.Sub(now); got != i.maxBackoff {
+		t.Errorf("wrong backoff: got %v want %v", got, i.maxBackoff)
+	}
+}
+
+func TestInitializerServeHealth(t *testing.T) {
+	ready := false
+	i := NewInitializer(func() error {
+		if !ready {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	i.minBackoff = 0
+
+	w := httptest.NewRecorder()
+	i.ServeHealth(w, httptest.NewRequest("GET", "/healthz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code: got %v want %v", w.Code, http.StatusServiceUnavailable)
+	}
+
+	ready = true
+
+	w = httptest.NewRecorder()
+	i.ServeHealth(w, httptest.NewRequest("GET", "/healthz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+
+	var state InitState
+	if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Ready {
+		t.Errorf("wrong state: got %+v", state)
+	}
+}
@@ -0,0 +1,109 @@
+// Package publisher publishes messages to Cloud Pub/Sub topics.
+package publisher
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"go.opencensus.io/trace"
+)
+
+// Publish sets these attributes on every message unless they're set
+// already. Background functions built against the vendored
+// cloud.google.com/go release can't read the Pub/Sub message ID and
+// publish time from the event metadata, so they identify messages, and
+// redeliveries of them, by these attributes instead.
+const (
+	PublishIDAttribute   = "publishId"
+	PublishTimeAttribute = "publishTime"
+)
+
+// Publisher publishes messages to a Pub/Sub topic.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error)
+}
+
+// PubSub publishes messages to Cloud Pub/Sub using the Pub/Sub client
+// library.
+type PubSub struct {
+	Client *pubsub.Client
+
+	mu     sync.Mutex
+	topics map[string]*pubsub.Topic
+}
+
+// NewPubSub returns a PubSub for the GCP_PROJECT project using the
+// application default credentials. The client library connects to the
+// Pub/Sub emulator instead when PUBSUB_EMULATOR_HOST is set.
+func NewPubSub(ctx context.Context) (*PubSub, error) {
+	client, err := pubsub.NewClient(ctx, os.Getenv("GCP_PROJECT"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PubSub{Client: client}, nil
+}
+
+// Publish publishes a single message to topic and returns its message
+// ID. topic is either a topic name in the client's project or a full
+// projects/PROJECT/topics/TOPIC resource name.
+func (p *PubSub) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "pubsub-publish")
+	defer span.End()
+
+	id, err := newPublishID()
+	if err != nil {
+		return "", err
+	}
+
+	stamped := map[string]string{
+		PublishIDAttribute:   id,
+		PublishTimeAttribute: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	for k, v := range attributes {
+		stamped[k] = v
+	}
+
+	result := p.topic(topic).Publish(ctx, &pubsub.Message{Data: data, Attributes: stamped})
+	return result.Get(ctx)
+}
+
+// topic returns the pubsub.Topic for name. Topics are reused across
+// calls since each one runs its own goroutines to batch messages.
+func (p *PubSub) topic(name string) *pubsub.Topic {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if t, ok := p.topics[name]; ok {
+		return t
+	}
+
+	var t *pubsub.Topic
+	if parts := strings.Split(name, "/"); len(parts) == 4 && parts[0] == "projects" && parts[2] == "topics" {
+		t = p.Client.TopicInProject(parts[3], parts[1])
+	} else {
+		t = p.Client.Topic(name)
+	}
+
+	if p.topics == nil {
+		p.topics = make(map[string]*pubsub.Topic)
+	}
+	p.topics[name] = t
+
+	return t
+}
+
+// newPublishID returns a random ID for the publishId attribute.
+func newPublishID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
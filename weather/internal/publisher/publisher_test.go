@@ -0,0 +1,100 @@
+package publisher
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// newTestPublisher returns a PubSub for the hightowerlabs
+// project connected to a fake Pub/Sub server with the given topics.
+func newTestPublisher(t *testing.T, topics ...string) (*PubSub, *pstest.Server, func()) {
+	srv := pstest.NewServer()
+
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, "hightowerlabs", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range topics {
+		if _, err := client.CreateTopic(ctx, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &PubSub{Client: client}, srv, func() {
+		client.Close()
+	}
+}
+
+func TestPublisherPublish(t *testing.T) {
+	p, srv, cleanup := newTestPublisher(t, "weather-events-dead-letter")
+	defer cleanup()
+
+	payload := []byte(`{"event": "GopherCon"`)
+	id, err := p.Publish(context.Background(), "weather-events-dead-letter", payload,
+		map[string]string{"reason": "invalid weather event"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("wrong number of messages: got %v want %v", len(messages), 1)
+	}
+
+	m := messages[0]
+	if id != m.ID {
+		t.Errorf("wrong message id: got %v want %v", id, m.ID)
+	}
+	if string(m.Data) != string(payload) {
+		t.Errorf("wrong message data: got %s want %s", m.Data, payload)
+	}
+	if m.Attributes["reason"] != "invalid weather event" {
+		t.Errorf("wrong reason attribute: got %v", m.Attributes["reason"])
+	}
+
+	if m.Attributes[PublishIDAttribute] == "" {
+		t.Errorf("missing %s attribute", PublishIDAttribute)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, m.Attributes[PublishTimeAttribute]); err != nil {
+		t.Errorf("invalid %s attribute: %v", PublishTimeAttribute, err)
+	}
+}
+
+func TestPublisherPublishTopicName(t *testing.T) {
+	p, srv, cleanup := newTestPublisher(t)
+	defer cleanup()
+
+	// The fake server creates the topic in the other project.
+	srv.Publish("projects/hightowerlabs-events/topics/weather-events", nil, nil)
+
+	_, err := p.Publish(context.Background(), "projects/hightowerlabs-events/topics/weather-events",
+		[]byte("GopherCon"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Publish(context.Background(), "weather-events", []byte("GopherCon"), nil); err == nil {
+		t.Error("expected an error publishing to a topic missing from the hightowerlabs project")
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 2 {
+		t.Fatalf("wrong number of messages: got %v want %v", len(messages), 2)
+	}
+	if string(messages[1].Data) != "GopherCon" {
+		t.Errorf("wrong message data: got %s want %s", messages[1].Data, "GopherCon")
+	}
+}
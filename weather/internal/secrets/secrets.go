@@ -0,0 +1,203 @@
+// Package secrets reads the secrets of the functions, such as the
+// database password and TLS certificates, from the configured source.
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+)
+
+// Source retrieves secrets, such as the database password and
+// TLS certificates, by name.
+type Source interface {
+	Secret(ctx context.Context, name string) ([]byte, error)
+}
+
+// NewSource returns the Source selected by the SECRET_SOURCE
+// environment variable:
+//
+//	gcs            objects in the CONFIGURATION_BUCKET_NAME bucket (default)
+//	dir            files in the SECRETS_DIR directory
+//	env            SECRET_<NAME> environment variables
+//	secretmanager  the latest version of Secret Manager secrets in the
+//	               GCP_PROJECT project
+func NewSource(ctx context.Context) (Source, error) {
+	switch source := os.Getenv("SECRET_SOURCE"); source {
+	case "", "gcs":
+		bucketName := os.Getenv("CONFIGURATION_BUCKET_NAME")
+		if bucketName == "" {
+			return nil, fmt.Errorf("CONFIGURATION_BUCKET_NAME environment variable unset or missing")
+		}
+
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &GCSSource{Client: client, Bucket: bucketName}, nil
+	case "dir":
+		dir := os.Getenv("SECRETS_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("SECRETS_DIR environment variable unset or missing")
+		}
+
+		return &DirSource{Dir: dir}, nil
+	case "env":
+		return &EnvSource{Prefix: "SECRET_"}, nil
+	case "secretmanager":
+		return NewSecretManagerSource(ctx)
+	default:
+		return nil, fmt.Errorf("unknown SECRET_SOURCE %q", source)
+	}
+}
+
+// GCSSource reads secrets from objects in a Cloud Storage bucket.
+type GCSSource struct {
+	Client *storage.Client
+	Bucket string
+}
+
+func (s *GCSSource) Secret(ctx context.Context, name string) ([]byte, error) {
+	o, err := s.Client.Bucket(s.Bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer o.Close()
+
+	return ioutil.ReadAll(o)
+}
+
+// DirSource reads secrets from files in a local directory, such
+// as a copy of the configuration bucket.
+type DirSource struct {
+	Dir string
+}
+
+func (s *DirSource) Secret(ctx context.Context, name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(s.Dir, filepath.Base(name)))
+}
+
+// EnvSource reads secrets from environment variables. The secret
+// name is upper cased and its punctuation replaced with underscores, so
+// with the SECRET_ prefix client.pem is read from SECRET_CLIENT_PEM.
+type EnvSource struct {
+	Prefix string
+}
+
+func (s *EnvSource) Secret(ctx context.Context, name string) ([]byte, error) {
+	key := s.Prefix + envSecretName(name)
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil, fmt.Errorf("%s environment variable unset or missing", key)
+	}
+	return []byte(v), nil
+}
+
+func envSecretName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// SecretManagerSource reads the latest version of secrets from the
+// Secret Manager REST API. Secret names must not contain dots, so
+// client.pem is read from the client-pem secret.
+//
+// See the Secret Manager docs for more details:
+//
+//	https://cloud.google.com/secret-manager/docs/reference/rest/v1/projects.secrets.versions/access
+type SecretManagerSource struct {
+	BaseURL string
+	Project string
+	Client  *http.Client
+}
+
+// NewSecretManagerSource returns a SecretManagerSource for the
+// GCP_PROJECT project using the application default credentials. When
+// SECRET_MANAGER_EMULATOR_HOST is set requests are sent to that host
+// without credentials, which allows a fake to be used locally.
+func NewSecretManagerSource(ctx context.Context) (*SecretManagerSource, error) {
+	project := os.Getenv("GCP_PROJECT")
+	if project == "" {
+		return nil, fmt.Errorf("GCP_PROJECT environment variable unset or missing")
+	}
+
+	if host := os.Getenv("SECRET_MANAGER_EMULATOR_HOST"); host != "" {
+		return &SecretManagerSource{BaseURL: "http://" + host, Project: project, Client: http.DefaultClient}, nil
+	}
+
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretManagerSource{BaseURL: "https://secretmanager.googleapis.com", Project: project, Client: client}, nil
+}
+
+type secretVersion struct {
+	Payload struct {
+		Data []byte `json:"data"`
+	} `json:"payload"`
+}
+
+func (s *SecretManagerSource) Secret(ctx context.Context, name string) ([]byte, error) {
+	u := fmt.Sprintf("%s/v1/projects/%s/secrets/%s/versions/latest:access",
+		s.BaseURL, s.Project, strings.Replace(name, ".", "-", -1))
+
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request = request.WithContext(ctx)
+
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("non 200 response code from secret manager for %s: %s", name, string(data))
+	}
+
+	var v secretVersion
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+
+	return v.Payload.Data, nil
+}
+
+// String returns the named secret with surrounding whitespace
+// removed.
+func String(ctx context.Context, s Source, name string) (string, error) {
+	data, err := s.Secret(ctx, name)
+	if err != nil {
+		return "", err
+	}
+
+	return string(bytes.TrimSpace(data)), nil
+}
@@ -0,0 +1,76 @@
+package secrets
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "password"), []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := String(context.Background(), &DirSource{Dir: dir}, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "s3cr3t" {
+		t.Errorf("wrong secret: got %q want %q", got, "s3cr3t")
+	}
+}
+
+func TestEnvSource(t *testing.T) {
+	defer os.Unsetenv("SECRET_CLIENT_PEM")
+	os.Setenv("SECRET_CLIENT_PEM", "-----BEGIN CERTIFICATE-----")
+
+	s := &EnvSource{Prefix: "SECRET_"}
+
+	data, err := s.Secret(context.Background(), "client.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "-----BEGIN CERTIFICATE-----" {
+		t.Errorf("wrong secret: got %q", data)
+	}
+
+	if _, err := s.Secret(context.Background(), "client.key"); err == nil {
+		t.Errorf("expected an error for a missing secret")
+	}
+}
+
+func TestSecretManagerSource(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/hightowerlabs/secrets/server-pem/versions/latest:access" {
+			t.Errorf("wrong request path: got %v", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		// "server certificate" base64 encoded.
+		w.Write([]byte(`{"payload": {"data": "c2VydmVyIGNlcnRpZmljYXRl"}}`))
+	}))
+	defer ts.Close()
+
+	s := &SecretManagerSource{BaseURL: ts.URL, Project: "hightowerlabs", Client: ts.Client()}
+
+	got, err := String(context.Background(), s, "server.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != "server certificate" {
+		t.Errorf("wrong secret: got %q want %q", got, "server certificate")
+	}
+}
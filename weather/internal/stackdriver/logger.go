@@ -0,0 +1,78 @@
+// Package stackdriver sets up Stackdriver logging and tracing for the
+// functions, or their local equivalents.
+package stackdriver
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// Logger logs structured log entries; *logging.Logger satisfies it.
+type Logger interface {
+	Log(e logging.Entry)
+	Flush() error
+}
+
+// NewLogger returns the logger selected by the LOGGER environment
+// variable: a Stackdriver logger by default, or a StdoutLogger when
+// it's set to stdout, which is how the functions are run locally.
+func NewLogger() (Logger, error) {
+	if os.Getenv("LOGGER") == "stdout" {
+		return &StdoutLogger{Writer: os.Stdout}, nil
+	}
+
+	logger, err := NewLoggingLogger()
+	if err != nil {
+		return nil, err
+	}
+
+	return logger, nil
+}
+
+// StdoutLogger writes each entry to Writer as a line of JSON in the
+// structured logging format understood by the Stackdriver logging agent.
+type StdoutLogger struct {
+	Writer io.Writer
+
+	mu sync.Mutex
+}
+
+type stdoutEntry struct {
+	Severity string      `json:"severity"`
+	Time     time.Time   `json:"time"`
+	Message  interface{} `json:"message"`
+}
+
+func (l *StdoutLogger) Log(e logging.Entry) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	data, err := json.Marshal(stdoutEntry{
+		Severity: strings.ToUpper(e.Severity.String()),
+		Time:     e.Timestamp.UTC(),
+		Message:  e.Payload,
+	})
+	if err != nil {
+		data, _ = json.Marshal(stdoutEntry{
+			Severity: "ERROR",
+			Time:     e.Timestamp.UTC(),
+			Message:  "error encoding log entry: " + err.Error(),
+		})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Writer.Write(append(data, '\n'))
+}
+
+// Flush does nothing; entries are written as they're logged.
+func (l *StdoutLogger) Flush() error {
+	return nil
+}
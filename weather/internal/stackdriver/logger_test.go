@@ -0,0 +1,46 @@
+package stackdriver
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+func TestStdoutLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := &StdoutLogger{Writer: &buf}
+
+	l.Log(logging.Entry{
+		Payload:   "weather data collected",
+		Severity:  logging.Info,
+		Timestamp: time.Date(2018, 8, 28, 15, 30, 0, 0, time.UTC),
+	})
+	l.Log(logging.Entry{
+		Payload:   map[string]string{"event": "GopherCon"},
+		Severity:  logging.Error,
+		Timestamp: time.Date(2018, 8, 28, 15, 30, 0, 0, time.UTC),
+	})
+
+	want := `{"severity":"INFO","time":"2018-08-28T15:30:00Z","message":"weather data collected"}
+{"severity":"ERROR","time":"2018-08-28T15:30:00Z","message":{"event":"GopherCon"}}
+`
+	if buf.String() != want {
+		t.Errorf("wrong log output: got %s want %s", buf.String(), want)
+	}
+}
+
+func TestNewLoggerStdout(t *testing.T) {
+	defer os.Setenv("LOGGER", os.Getenv("LOGGER"))
+	os.Setenv("LOGGER", "stdout")
+
+	logger, err := NewLogger()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := logger.(*StdoutLogger); !ok {
+		t.Errorf("wrong logger: got %T want *StdoutLogger", logger)
+	}
+}
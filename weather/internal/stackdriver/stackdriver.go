@@ -1,4 +1,4 @@
-package function
+package stackdriver
 
 import (
 	"context"
@@ -6,29 +6,40 @@ import (
 	"os"
 
 	"cloud.google.com/go/logging"
-	"contrib.go.opencensus.io/exporter/stackdriver"
+	exporter "contrib.go.opencensus.io/exporter/stackdriver"
+	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
 	"google.golang.org/genproto/googleapis/api/monitoredres"
 )
 
-func EnableStackdriverTrace() error {
+// EnableTrace exports traces, and the metrics of registered
+// views, to Stackdriver unless the TRACE_EXPORTER environment variable
+// is set to none, which is how the functions are run locally.
+func EnableTrace() error {
+	if os.Getenv("TRACE_EXPORTER") == "none" {
+		return nil
+	}
+
 	projectId := os.Getenv("GCP_PROJECT")
 	if projectId == "" {
 		return fmt.Errorf("GCP_PROJECT environment variable unset or missing")
 	}
 
-	stackdriverExporter, err := stackdriver.NewExporter(stackdriver.Options{ProjectID: projectId})
+	stackdriverExporter, err := exporter.NewExporter(exporter.Options{ProjectID: projectId})
 	if err != nil {
 		return err
 	}
 
 	trace.RegisterExporter(stackdriverExporter)
+	view.RegisterExporter(stackdriverExporter)
 	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 
 	return nil
 }
 
-func NewStackdriverLogger() (*logging.Logger, error) {
+// NewLoggingLogger returns a Stackdriver Logging logger for the
+// function named by FUNCTION_NAME in the GCP_PROJECT project.
+func NewLoggingLogger() (*logging.Logger, error) {
 	projectId := os.Getenv("GCP_PROJECT")
 	if projectId == "" {
 		return nil, fmt.Errorf("GCP_PROJECT environment variable unset or missing")
@@ -0,0 +1,450 @@
+package function
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// Event is an event in the events registry. Name is the event query
+// parameter accepted by the other endpoints. Lat and Lng are nil for
+// events that are geocoded from their Location; Start and End are
+// optional YYYY-MM-DD dates in the event Timezone.
+type Event struct {
+	Name     string
+	Slug     string
+	Location string
+	Lat      *float64
+	Lng      *float64
+	Timezone string
+	Provider string
+	Start    string
+	End      string
+	Active   bool
+}
+
+// EventUpdate is the body of a PUT request. Fields that aren't set
+// are left unchanged, except that changing the Location without new
+// coordinates clears Lat and Lng so the new location is geocoded.
+type EventUpdate struct {
+	Name     *string
+	Location *string
+	Lat      *float64
+	Lng      *float64
+	Timezone *string
+	Provider *string
+	Start    *string
+	End      *string
+	Active   *bool
+}
+
+// WeatherEvent is the weather-data-collector Pub/Sub message for an
+// event.
+type WeatherEvent struct {
+	Event    string  `json:"event"`
+	Location string  `json:"location"`
+	Lat      float64 `json:"lat,omitempty"`
+	Lng      float64 `json:"lng,omitempty"`
+	Provider string  `json:"provider,omitempty"`
+	Start    string  `json:"start,omitempty"`
+	End      string  `json:"end,omitempty"`
+	Timezone string  `json:"timezone,omitempty"`
+}
+
+// errEventExists is returned by the Store when an event slug or name is
+// already taken.
+var errEventExists = errors.New("an event with that slug or name already exists")
+
+// maxEventBody is the largest request body accepted by the admin
+// endpoints.
+const maxEventBody = 64 << 10
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// providers are the weather providers the weather-data-collector
+// supports. Events without a provider use nws.
+var providers = map[string]bool{
+	"nws":        true,
+	"open-meteo": true,
+}
+
+// eventsPath reports whether p is the events collection, ending in
+// /events, or a single event, ending in /events/SLUG.
+func eventsPath(p string) (slug string, ok bool) {
+	if path.Base(p) == "events" {
+		return "", true
+	}
+	if path.Base(path.Dir(p)) == "events" {
+		return path.Base(p), true
+	}
+	return "", false
+}
+
+// eventsHandler serves the events registry. Listing events is public;
+// creating, updating and deactivating them requires the admin token.
+//
+//	GET    /events        list the active events
+//	GET    /events/SLUG   get an event, including inactive ones
+//	POST   /events        create an event
+//	PUT    /events/SLUG   update an event
+//	DELETE /events/SLUG   deactivate an event
+func (s *Service) eventsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, slug string) {
+	if r.Method != "GET" && !s.authorized(r) {
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("unauthorized %s request for %s", r.Method, r.URL.Path),
+			Severity: logging.Warning,
+		})
+		w.Header().Set("WWW-Authenticate", `Bearer realm="weather-api"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && slug == "":
+		s.listEvents(ctx, w)
+	case r.Method == "GET":
+		s.getEvent(ctx, w, slug)
+	case r.Method == "POST" && slug == "":
+		s.createEvent(ctx, w, r)
+	case r.Method == "PUT" && slug != "":
+		s.updateEvent(ctx, w, r, slug)
+	case r.Method == "DELETE" && slug != "":
+		s.deactivateEvent(ctx, w, slug)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// authorized reports whether r carries the admin bearer token in an
+// Authorization header of the form "Bearer TOKEN".
+func (s *Service) authorized(r *http.Request) bool {
+	if s.AdminToken == "" {
+		return false
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) == 1
+}
+
+// listEvents returns the active events, which weather-frontend lists
+// in its event menu.
+func (s *Service) listEvents(ctx context.Context, w http.ResponseWriter) {
+	events, err := s.Store.Events(ctx)
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, events)
+}
+
+func (s *Service) getEvent(ctx context.Context, w http.ResponseWriter, slug string) {
+	e, err := s.Store.Event(ctx, slug)
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	if e == nil {
+		http.Error(w, "event not found", http.StatusNotFound)
+		return
+	}
+
+	s.writeJSON(w, http.StatusOK, e)
+}
+
+func (s *Service) createEvent(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	e := Event{Active: true}
+	if !s.decodeEvent(w, r, &e) {
+		return
+	}
+
+	if err := e.validate(); err != nil {
+		s.badRequest(w, err)
+		return
+	}
+
+	if err := s.Store.CreateEvent(ctx, &e); err != nil {
+		if err == errEventExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		s.serverError(w, err)
+		return
+	}
+
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("created event %s (%s) in %s", e.Slug, e.Name, e.Location),
+		Severity: logging.Info,
+	})
+
+	if e.Active {
+		s.publishEvent(ctx, &e)
+	}
+
+	s.writeJSON(w, http.StatusCreated, e)
+}
+
+// updateEvent renames, relocates, reactivates or deactivates an event.
+// A relocated event is published so it's geocoded and collected
+// immediately instead of on the next scheduled collection.
+func (s *Service) updateEvent(ctx context.Context, w http.ResponseWriter, r *http.Request, slug string) {
+	current, err := s.Store.Event(ctx, slug)
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	if current == nil {
+		http.Error(w, "event not found", http.StatusNotFound)
+		return
+	}
+
+	var u EventUpdate
+	if !s.decodeEvent(w, r, &u) {
+		return
+	}
+
+	e := current.apply(u)
+	if err := e.validate(); err != nil {
+		s.badRequest(w, err)
+		return
+	}
+
+	if err := s.Store.UpdateEvent(ctx, current.Name, &e); err != nil {
+		if err == errEventExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		s.serverError(w, err)
+		return
+	}
+
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("updated event %s (%s) in %s", e.Slug, e.Name, e.Location),
+		Severity: logging.Info,
+	})
+
+	if e.Active && (!current.Active || e.relocated(current)) {
+		s.publishEvent(ctx, &e)
+	}
+
+	s.writeJSON(w, http.StatusOK, e)
+}
+
+// deactivateEvent stops collection for an event. The event and its
+// weather data are kept so it can be reactivated with a PUT request.
+func (s *Service) deactivateEvent(ctx context.Context, w http.ResponseWriter, slug string) {
+	ok, err := s.Store.DeactivateEvent(ctx, slug)
+	if err != nil {
+		s.serverError(w, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "event not found", http.StatusNotFound)
+		return
+	}
+
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("deactivated event %s", slug),
+		Severity: logging.Info,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// publishEvent asks the weather-data-collector to collect e now. The
+// event has already been saved, so failures are only logged; it will
+// be collected on the next scheduled collection.
+func (s *Service) publishEvent(ctx context.Context, e *Event) {
+	if s.Publisher == nil || s.EventsTopic == "" {
+		return
+	}
+
+	we := WeatherEvent{
+		Event:    e.Name,
+		Location: e.Location,
+		Provider: e.Provider,
+		Start:    e.Start,
+		End:      e.End,
+		Timezone: e.Timezone,
+	}
+	if e.Lat != nil && e.Lng != nil {
+		we.Lat, we.Lng = *e.Lat, *e.Lng
+	}
+
+	data, err := json.Marshal(we)
+	if err != nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+		return
+	}
+
+	id, err := s.Publisher.Publish(ctx, s.EventsTopic, data, nil)
+	if err != nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("error publishing event %s to %s: %v", e.Slug, s.EventsTopic, err),
+			Severity: logging.Error,
+		})
+		return
+	}
+
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("published event %s to %s as message %s", e.Slug, s.EventsTopic, id),
+		Severity: logging.Info,
+	})
+}
+
+// decodeEvent decodes the JSON request body into v. Unknown fields are
+// rejected so typos aren't silently ignored.
+func (s *Service) decodeEvent(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEventBody))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		s.badRequest(w, fmt.Errorf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+func (s *Service) badRequest(w http.ResponseWriter, err error) {
+	s.Logger.Log(logging.Entry{
+		Payload:  err.Error(),
+		Severity: logging.Error,
+	})
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func (s *Service) serverError(w http.ResponseWriter, err error) {
+	s.Logger.Log(logging.Entry{
+		Payload:  err.Error(),
+		Severity: logging.Error,
+	})
+	http.Error(w, "", http.StatusInternalServerError)
+}
+
+func (s *Service) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+	}
+}
+
+// apply returns a copy of e with the fields set in u. The coordinates
+// of the previous location are dropped when only the location changes.
+func (e Event) apply(u EventUpdate) Event {
+	if u.Name != nil {
+		e.Name = *u.Name
+	}
+	if u.Location != nil && *u.Location != e.Location {
+		e.Location = *u.Location
+		e.Lat, e.Lng = nil, nil
+	}
+	if u.Lat != nil || u.Lng != nil {
+		e.Lat, e.Lng = u.Lat, u.Lng
+	}
+	if u.Timezone != nil {
+		e.Timezone = *u.Timezone
+	}
+	if u.Provider != nil {
+		e.Provider = *u.Provider
+	}
+	if u.Start != nil {
+		e.Start = *u.Start
+	}
+	if u.End != nil {
+		e.End = *u.End
+	}
+	if u.Active != nil {
+		e.Active = *u.Active
+	}
+	return e
+}
+
+// relocated reports whether the location or coordinates of e differ
+// from those of previous.
+func (e Event) relocated(previous *Event) bool {
+	return e.Location != previous.Location ||
+		!equalCoordinate(e.Lat, previous.Lat) || !equalCoordinate(e.Lng, previous.Lng)
+}
+
+func equalCoordinate(a, b *float64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// validate checks e against the events table constraints and the
+// formats the weather-data-collector expects.
+func (e *Event) validate() error {
+	switch {
+	case len(e.Slug) > 100 || !slugPattern.MatchString(e.Slug):
+		return fmt.Errorf("invalid slug %q: must be lowercase letters, digits and dashes", e.Slug)
+	case strings.TrimSpace(e.Name) == "" || len(e.Name) > 200:
+		return fmt.Errorf("invalid name: must be between 1 and 200 characters")
+	case strings.TrimSpace(e.Location) == "" || len(e.Location) > 200:
+		return fmt.Errorf("invalid location: must be between 1 and 200 characters")
+	case (e.Lat == nil) != (e.Lng == nil):
+		return fmt.Errorf("invalid coordinates: lat and lng must be set together")
+	case e.Lat != nil && (*e.Lat < -90 || *e.Lat > 90):
+		return fmt.Errorf("invalid lat: must be between -90 and 90")
+	case e.Lng != nil && (*e.Lng < -180 || *e.Lng > 180):
+		return fmt.Errorf("invalid lng: must be between -180 and 180")
+	case e.Provider != "" && !providers[e.Provider]:
+		return fmt.Errorf("invalid provider %q: must be nws or open-meteo", e.Provider)
+	}
+
+	if e.Timezone != "" {
+		if _, err := time.LoadLocation(e.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q", e.Timezone)
+		}
+	}
+
+	if e.Start == "" && e.End != "" {
+		return fmt.Errorf("invalid dates: end requires a start date")
+	}
+
+	var start time.Time
+	if e.Start != "" {
+		var err error
+		start, err = time.Parse("2006-01-02", e.Start)
+		if err != nil {
+			return fmt.Errorf("invalid start date %q: must be YYYY-MM-DD", e.Start)
+		}
+	}
+
+	if e.End != "" {
+		end, err := time.Parse("2006-01-02", e.End)
+		if err != nil {
+			return fmt.Errorf("invalid end date %q: must be YYYY-MM-DD", e.End)
+		}
+		if end.Before(start) {
+			return fmt.Errorf("invalid dates: end %s is before start %s", e.End, e.Start)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,212 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testPublisher struct {
+	messages []WeatherEvent
+}
+
+func (p *testPublisher) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	var e WeatherEvent
+	if err := json.Unmarshal(data, &e); err != nil {
+		return "", err
+	}
+	p.messages = append(p.messages, e)
+	return "1", nil
+}
+
+func newTestAdminService() (*Service, *testStore, *testPublisher) {
+	s, store := newTestService()
+	publisher := &testPublisher{}
+	s.AdminToken = "s3cr3t"
+	s.Publisher = publisher
+	s.EventsTopic = "weather-events"
+	return s, store, publisher
+}
+
+func adminRequest(method, url, body string) *http.Request {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer s3cr3t")
+	return r
+}
+
+func TestEventsUnauthorized(t *testing.T) {
+	tests := []struct {
+		token      string
+		adminToken string
+	}{
+		{"", "s3cr3t"},
+		{"Bearer wrong", "s3cr3t"},
+		{"Bearer ", ""},
+		{"Bearer ", "s3cr3t"},
+		{"Bearer", "s3cr3t"},
+		{"s3cr3t", "s3cr3t"},
+		{"Basic s3cr3t", "s3cr3t"},
+	}
+
+	for _, tt := range tests {
+		s, store, _ := newTestAdminService()
+		s.AdminToken = tt.adminToken
+
+		r := httptest.NewRequest("DELETE", "/events/gophercon", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", tt.token)
+		}
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("wrong status code for %q: got %v want %v", tt.token, w.Code, http.StatusUnauthorized)
+		}
+		if !store.events[0].Active {
+			t.Errorf("unauthorized request deactivated the event")
+		}
+	}
+}
+
+func TestEventsCreate(t *testing.T) {
+	s, store, publisher := newTestAdminService()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, adminRequest("POST", "/events",
+		`{"Slug": "golab", "Name": "GoLab", "Location": "Florence, Italy", "Timezone": "Europe/Rome", "Provider": "open-meteo"}`))
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("wrong status code: got %v want %v: %s", w.Code, http.StatusCreated, w.Body)
+	}
+
+	e, _ := store.Event(context.Background(), "golab")
+	if e == nil || !e.Active || e.Location != "Florence, Italy" {
+		t.Errorf("wrong event: got %+v", e)
+	}
+
+	if len(publisher.messages) != 1 || publisher.messages[0].Event != "GoLab" || publisher.messages[0].Provider != "open-meteo" {
+		t.Errorf("wrong published events: got %+v", publisher.messages)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, adminRequest("POST", "/events", `{"Slug": "golab-2", "Name": "GoLab", "Location": "Florence, Italy"}`))
+	if w.Code != http.StatusConflict {
+		t.Errorf("wrong status code for a duplicate name: got %v want %v", w.Code, http.StatusConflict)
+	}
+}
+
+func TestEventsCreateInvalid(t *testing.T) {
+	tests := []string{
+		`{"Slug": "GoLab", "Name": "GoLab", "Location": "Florence, Italy"}`,
+		`{"Slug": "golab", "Name": " ", "Location": "Florence, Italy"}`,
+		`{"Slug": "golab", "Name": "GoLab", "Location": ""}`,
+		`{"Slug": "golab", "Name": "GoLab", "Location": "Florence, Italy", "Lat": 43.77}`,
+		`{"Slug": "golab", "Name": "GoLab", "Location": "Florence, Italy", "Lat": 91, "Lng": 11.26}`,
+		`{"Slug": "golab", "Name": "GoLab", "Location": "Florence, Italy", "Timezone": "Europe/Florence"}`,
+		`{"Slug": "golab", "Name": "GoLab", "Location": "Florence, Italy", "Start": "2018-10-22", "End": "2018-10-21"}`,
+		`{"Slug": "golab", "Name": "GoLab", "Location": "Florence, Italy", "Start": "22/10/2018"}`,
+		`{"Slug": "golab", "Name": "GoLab", "Location": "Florence, Italy", "Venue": "Grand Hotel Mediterraneo"}`,
+		`{"Slug": "golab", "Name": "GoLab", "Location": "Florence, Italy", "Provider": "met-office"}`,
+		`{"Slug": "golab"`,
+	}
+
+	for _, body := range tests {
+		s, store, publisher := newTestAdminService()
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, adminRequest("POST", "/events", body))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("wrong status code for %s: got %v want %v", body, w.Code, http.StatusBadRequest)
+		}
+		if len(store.events) != 1 || len(publisher.messages) != 0 {
+			t.Errorf("invalid event was saved or published: %s", body)
+		}
+	}
+}
+
+func TestEventsUpdate(t *testing.T) {
+	s, store, publisher := newTestAdminService()
+
+	// Renaming an event doesn't need a new collection.
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, adminRequest("PUT", "/events/gophercon", `{"Name": "GopherCon 2018"}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if store.events[0].Name != "GopherCon 2018" || store.weather.Event != "GopherCon 2018" {
+		t.Errorf("event wasn't renamed: got %+v", store.events[0])
+	}
+	if len(publisher.messages) != 0 {
+		t.Errorf("renamed event was published: got %+v", publisher.messages)
+	}
+
+	// Relocating an event collects it immediately.
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, adminRequest("PUT", "/events/gophercon", `{"Location": "San Diego, California, USA", "Lat": 32.7157, "Lng": -117.1611}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if len(publisher.messages) != 1 {
+		t.Fatalf("wrong number of published events: got %v want %v", len(publisher.messages), 1)
+	}
+	if m := publisher.messages[0]; m.Event != "GopherCon 2018" || m.Location != "San Diego, California, USA" || m.Lat != 32.7157 {
+		t.Errorf("wrong published event: got %+v", m)
+	}
+
+	// Relocating an event without coordinates drops the coordinates of
+	// the previous location so the new one is geocoded.
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, adminRequest("PUT", "/events/gophercon", `{"Location": "Denver, Colorado, USA"}`))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if e := store.events[0]; e.Lat != nil || e.Lng != nil {
+		t.Errorf("relocated event kept its coordinates: got %+v", e)
+	}
+	if len(publisher.messages) != 2 {
+		t.Fatalf("wrong number of published events: got %v want %v", len(publisher.messages), 2)
+	}
+	if m := publisher.messages[1]; m.Location != "Denver, Colorado, USA" || m.Lat != 0 || m.Lng != 0 {
+		t.Errorf("wrong published event: got %+v", m)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, adminRequest("PUT", "/events/gotham-go", `{"Name": "GothamGo"}`))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("wrong status code for an unknown event: got %v want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestEventsDeactivate(t *testing.T) {
+	s, store, _ := newTestAdminService()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, adminRequest("DELETE", "/events/gophercon", ""))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("wrong status code: got %v want %v", w.Code, http.StatusNoContent)
+	}
+	if store.events[0].Active {
+		t.Errorf("event wasn't deactivated")
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/events", nil))
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("deactivated event is listed: got %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, adminRequest("DELETE", "/events/gotham-go", ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("wrong status code for an unknown event: got %v want %v", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,104 @@
+package function
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+)
+
+// testDB is a database/sql connector that records the statements a
+// PostgresStore executes and answers queries with canned rows.
+type testDB struct {
+	mu    sync.Mutex
+	execs []recordedStatement
+
+	// rows holds the rows returned for each query.
+	rows map[string][][]driver.Value
+}
+
+type recordedStatement struct {
+	query string
+	args  []driver.Value
+}
+
+// statements returns the executed statements for query.
+func (d *testDB) statements(query string) []recordedStatement {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var statements []recordedStatement
+	for _, s := range d.execs {
+		if s.query == query {
+			statements = append(statements, s)
+		}
+	}
+	return statements
+}
+
+func (d *testDB) Connect(ctx context.Context) (driver.Conn, error) { return &testConn{d}, nil }
+func (d *testDB) Driver() driver.Driver                            { return d }
+func (d *testDB) Open(name string) (driver.Conn, error)            { return &testConn{d}, nil }
+
+type testConn struct {
+	db *testDB
+}
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) { return &testStmt{c.db, query}, nil }
+func (c *testConn) Close() error                              { return nil }
+func (c *testConn) Begin() (driver.Tx, error)                 { return c, nil }
+func (c *testConn) Commit() error                             { return nil }
+func (c *testConn) Rollback() error                           { return nil }
+
+type testStmt struct {
+	db    *testDB
+	query string
+}
+
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return -1 }
+
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.execs = append(s.db.execs, recordedStatement{s.query, args})
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.execs = append(s.db.execs, recordedStatement{s.query, args})
+	return &cannedRows{rows: s.db.rows[s.query]}, nil
+}
+
+type cannedRows struct {
+	rows [][]driver.Value
+}
+
+func (r *cannedRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *cannedRows) Close() error { return nil }
+
+func (r *cannedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newTestPostgresStore returns a PostgresStore backed by a testDB.
+func newTestPostgresStore() (*PostgresStore, *testDB) {
+	tdb := &testDB{rows: make(map[string][][]driver.Value)}
+	return &PostgresStore{DB: sql.OpenDB(tdb)}, tdb
+}
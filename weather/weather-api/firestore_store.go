@@ -0,0 +1,487 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/kelseyhightower/weather-internal/firestoredb"
+	"google.golang.org/grpc/codes"
+)
+
+// maxMoveReadings limits the readings moved in one commit when an event
+// is renamed; each reading is a write and a delete, and a commit
+// accepts at most 500 writes.
+const maxMoveReadings = 200
+
+// FirestoreStore is a Store backed by Cloud Firestore in native mode,
+// reading the documents written by the weather-data-collector:
+//
+//	events/SLUG                     the events registry
+//	eventNames/NAME                 the slug of the event named NAME
+//	weather/NAME                    the current weather, forecasts,
+//	                                alerts and geocoded place
+//	weather/NAME/readings/UNIXNANO-PROVIDER-SOURCE
+//	                                the readings history
+//
+// Names are escaped with firestoreID.
+type FirestoreStore struct {
+	Client *firestore.Client
+}
+
+// weatherDocument is the part of a weather/NAME document read by
+// weather-api.
+type weatherDocument struct {
+	Event                    string           `firestore:"event"`
+	Location                 string           `firestore:"location"`
+	Temperature              float64          `firestore:"temperature"`
+	Source                   string           `firestore:"source"`
+	ObservedAt               time.Time        `firestore:"observedAt"`
+	Humidity                 int              `firestore:"humidity"`
+	WindSpeed                float64          `firestore:"windSpeed"`
+	WindDirection            string           `firestore:"windDirection"`
+	PrecipitationProbability int              `firestore:"precipitationProbability"`
+	ShortForecast            string           `firestore:"shortForecast"`
+	Icon                     string           `firestore:"icon"`
+	IsDaytime                bool             `firestore:"isDaytime"`
+	Alerts                   []alertDocument  `firestore:"alerts"`
+	Forecast                 []periodDocument `firestore:"forecast"`
+	DailyForecast            []periodDocument `firestore:"dailyForecast"`
+}
+
+// alertDocument is an alert in the alerts array. Alerts without an
+// expiry time are stored without expires.
+type alertDocument struct {
+	Type     string     `firestore:"type"`
+	Severity string     `firestore:"severity"`
+	Headline string     `firestore:"headline"`
+	Expires  *time.Time `firestore:"expires,omitempty"`
+}
+
+// periodDocument is a forecast period in the forecast and dailyForecast
+// arrays.
+type periodDocument struct {
+	Name                     string    `firestore:"name"`
+	StartTime                time.Time `firestore:"startTime"`
+	EndTime                  time.Time `firestore:"endTime"`
+	IsDaytime                bool      `firestore:"isDaytime"`
+	Temperature              float64   `firestore:"temperature"`
+	Humidity                 int       `firestore:"humidity"`
+	WindSpeed                float64   `firestore:"windSpeed"`
+	WindDirection            string    `firestore:"windDirection"`
+	PrecipitationProbability int       `firestore:"precipitationProbability"`
+	ShortForecast            string    `firestore:"shortForecast"`
+	DetailedForecast         string    `firestore:"detailedForecast"`
+	Icon                     string    `firestore:"icon"`
+}
+
+// readingDocument is a document in the readings history.
+type readingDocument struct {
+	Temperature float64   `firestore:"temperature"`
+	Source      string    `firestore:"source"`
+	Provider    string    `firestore:"provider"`
+	ObservedAt  time.Time `firestore:"observedAt"`
+}
+
+// eventDocument is an events/SLUG document. Coordinates and dates are
+// optional.
+type eventDocument struct {
+	Name     string   `firestore:"name"`
+	Slug     string   `firestore:"slug"`
+	Location string   `firestore:"location"`
+	Lat      *float64 `firestore:"lat,omitempty"`
+	Lng      *float64 `firestore:"lng,omitempty"`
+	Timezone string   `firestore:"timezone"`
+	Provider string   `firestore:"provider"`
+	Start    string   `firestore:"start,omitempty"`
+	End      string   `firestore:"end,omitempty"`
+	Active   bool     `firestore:"active"`
+}
+
+// eventNameDocument is an eventNames/NAME document.
+type eventNameDocument struct {
+	Slug string `firestore:"slug"`
+}
+
+func (s *FirestoreStore) weather(event string) *firestore.DocumentRef {
+	return s.Client.Collection("weather").Doc(firestoredb.ID(event))
+}
+
+func (s *FirestoreStore) event(slug string) *firestore.DocumentRef {
+	return s.Client.Collection("events").Doc(firestoredb.ID(slug))
+}
+
+func (s *FirestoreStore) eventName(name string) *firestore.DocumentRef {
+	return s.Client.Collection("eventNames").Doc(firestoredb.ID(name))
+}
+
+// weatherDocument returns the weather document of event, or nil if
+// there's no such document.
+func (s *FirestoreStore) weatherDocument(ctx context.Context, event string) (*weatherDocument, error) {
+	d, err := firestoredb.Get(ctx, nil, s.weather(event))
+	if err != nil || d == nil {
+		return nil, err
+	}
+
+	var w weatherDocument
+	if err := d.DataTo(&w); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+func (s *FirestoreStore) Weather(ctx context.Context, event string) (*Weather, error) {
+	d, err := s.weatherDocument(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+
+	if d == nil || d.ObservedAt.IsZero() {
+		return nil, fmt.Errorf("no weather data for event %s", event)
+	}
+
+	w := Weather{
+		Event:                    d.Event,
+		Location:                 d.Location,
+		Temperature:              d.Temperature,
+		Source:                   d.Source,
+		ObservedAt:               d.ObservedAt,
+		Humidity:                 d.Humidity,
+		WindSpeed:                d.WindSpeed,
+		WindDirection:            d.WindDirection,
+		PrecipitationProbability: d.PrecipitationProbability,
+		ShortForecast:            d.ShortForecast,
+		Icon:                     d.Icon,
+		IsDaytime:                d.IsDaytime,
+		Alerts:                   make([]Alert, 0),
+	}
+
+	now := time.Now()
+	for _, a := range d.Alerts {
+		if a.Expires != nil && !a.Expires.After(now) {
+			continue
+		}
+		w.Alerts = append(w.Alerts, Alert{
+			Type:     a.Type,
+			Severity: a.Severity,
+			Headline: a.Headline,
+			Expires:  a.Expires,
+		})
+	}
+	// Alerts without an expiry time are sorted last.
+	sort.SliceStable(w.Alerts, func(i, j int) bool {
+		a, b := w.Alerts[i].Expires, w.Alerts[j].Expires
+		return a != nil && (b == nil || a.Before(*b))
+	})
+
+	return &w, nil
+}
+
+func (s *FirestoreStore) Forecast(ctx context.Context, event string, hours int) ([]Period, error) {
+	periods, err := s.periods(ctx, event, func(d *weatherDocument) []periodDocument { return d.Forecast })
+	if err != nil {
+		return nil, err
+	}
+
+	if len(periods) > hours {
+		periods = periods[:hours]
+	}
+
+	return periods, nil
+}
+
+func (s *FirestoreStore) DailyForecast(ctx context.Context, event string) ([]Period, error) {
+	return s.periods(ctx, event, func(d *weatherDocument) []periodDocument { return d.DailyForecast })
+}
+
+// periods returns the forecast periods returned by field that haven't
+// ended, in order.
+func (s *FirestoreStore) periods(ctx context.Context, event string, field func(d *weatherDocument) []periodDocument) ([]Period, error) {
+	d, err := s.weatherDocument(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+
+	periods := make([]Period, 0)
+	if d == nil {
+		return periods, nil
+	}
+
+	now := time.Now()
+	for _, f := range field(d) {
+		p := Period{
+			Name:                     f.Name,
+			StartTime:                f.StartTime,
+			EndTime:                  f.EndTime,
+			IsDaytime:                f.IsDaytime,
+			Temperature:              f.Temperature,
+			Humidity:                 f.Humidity,
+			WindSpeed:                f.WindSpeed,
+			WindDirection:            f.WindDirection,
+			PrecipitationProbability: f.PrecipitationProbability,
+			ShortForecast:            f.ShortForecast,
+			DetailedForecast:         f.DetailedForecast,
+			Icon:                     f.Icon,
+		}
+		if p.EndTime.After(now) {
+			periods = append(periods, p)
+		}
+	}
+
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].StartTime.Before(periods[j].StartTime)
+	})
+
+	return periods, nil
+}
+
+func (s *FirestoreStore) History(ctx context.Context, event string, from, to time.Time) ([]Reading, error) {
+	documents, err := s.weather(event).Collection("readings").
+		Where("observedAt", ">=", from).
+		Where("observedAt", "<=", to).
+		OrderBy("observedAt", firestore.Asc).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	readings := make([]Reading, len(documents))
+	for i, d := range documents {
+		var r readingDocument
+		if err := d.DataTo(&r); err != nil {
+			return nil, err
+		}
+		readings[i] = Reading{
+			Temperature: r.Temperature,
+			Source:      r.Source,
+			Provider:    r.Provider,
+			ObservedAt:  r.ObservedAt,
+		}
+	}
+
+	return readings, nil
+}
+
+func (s *FirestoreStore) Events(ctx context.Context) ([]Event, error) {
+	documents, err := s.Client.Collection("events").Where("active", "==", true).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]Event, len(documents))
+	for i, d := range documents {
+		if events[i], err = eventFromDocument(d); err != nil {
+			return nil, err
+		}
+	}
+
+	// Ordering by name in the query would need a composite index.
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Name < events[j].Name
+	})
+
+	return events, nil
+}
+
+func (s *FirestoreStore) Event(ctx context.Context, slug string) (*Event, error) {
+	d, err := firestoredb.Get(ctx, nil, s.event(slug))
+	if err != nil || d == nil {
+		return nil, err
+	}
+
+	e, err := eventFromDocument(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+func (s *FirestoreStore) CreateEvent(ctx context.Context, e *Event) error {
+	// The eventNames document makes event names unique.
+	_, err := s.Client.Batch().
+		Create(s.event(e.Slug), eventDocumentFor(e)).
+		Create(s.eventName(e.Name), eventNameDocument{Slug: e.Slug}).
+		Commit(ctx)
+	if firestoredb.IsCode(err, codes.AlreadyExists) {
+		return errEventExists
+	}
+	return err
+}
+
+func (s *FirestoreStore) UpdateEvent(ctx context.Context, previousName string, e *Event) error {
+	renamed := e.Name != previousName
+
+	// The readings are moved to the new name first, in batches, as
+	// there can be more of them than fit in a transaction. A rename
+	// that fails part way moves the rest when it's retried.
+	if renamed {
+		n, err := firestoredb.Get(ctx, nil, s.eventName(e.Name))
+		if err != nil {
+			return err
+		}
+		if n != nil {
+			var name eventNameDocument
+			if err := n.DataTo(&name); err != nil {
+				return err
+			}
+			if name.Slug != e.Slug {
+				return errEventExists
+			}
+		}
+
+		if err := s.moveReadings(ctx, previousName, e.Name); err != nil {
+			return err
+		}
+	}
+
+	updates := []firestore.Update{
+		{Path: "name", Value: e.Name},
+		{Path: "slug", Value: e.Slug},
+		{Path: "location", Value: e.Location},
+		{Path: "timezone", Value: e.Timezone},
+		{Path: "provider", Value: e.Provider},
+		{Path: "active", Value: e.Active},
+	}
+	if e.Lat != nil && e.Lng != nil {
+		updates = append(updates, firestore.Update{Path: "lat", Value: *e.Lat}, firestore.Update{Path: "lng", Value: *e.Lng})
+	} else {
+		updates = append(updates, firestore.Update{Path: "lat", Value: firestore.Delete}, firestore.Update{Path: "lng", Value: firestore.Delete})
+	}
+	updates = append(updates, optionalUpdate("start", e.Start), optionalUpdate("end", e.End))
+
+	err := s.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// The weather data is keyed by event name; move it to the new
+		// name so the event keeps its forecasts and geocoded place.
+		// Transactions read before they write.
+		var weather *firestore.DocumentSnapshot
+		if renamed {
+			var err error
+			weather, err = firestoredb.Get(ctx, tx, s.weather(previousName))
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Update(s.event(e.Slug), updates); err != nil {
+			return err
+		}
+		if !renamed {
+			return nil
+		}
+
+		if err := tx.Delete(s.eventName(previousName)); err != nil {
+			return err
+		}
+		if err := tx.Create(s.eventName(e.Name), eventNameDocument{Slug: e.Slug}); err != nil {
+			return err
+		}
+
+		if weather != nil {
+			data := weather.Data()
+			data["event"] = e.Name
+			if err := tx.Set(s.weather(e.Name), data); err != nil {
+				return err
+			}
+			return tx.Delete(s.weather(previousName))
+		}
+
+		return nil
+	})
+	if firestoredb.IsCode(err, codes.AlreadyExists) {
+		return errEventExists
+	}
+	return err
+}
+
+// optionalUpdate sets the string field path to value, or deletes it
+// when value is empty.
+func optionalUpdate(path, value string) firestore.Update {
+	if value == "" {
+		return firestore.Update{Path: path, Value: firestore.Delete}
+	}
+	return firestore.Update{Path: path, Value: value}
+}
+
+// moveReadings moves the readings of the event named from to the event
+// named to.
+func (s *FirestoreStore) moveReadings(ctx context.Context, from, to string) error {
+	for {
+		documents, err := s.weather(from).Collection("readings").Limit(maxMoveReadings).Documents(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+
+		if len(documents) == 0 {
+			return nil
+		}
+
+		batch := s.Client.Batch()
+		for _, d := range documents {
+			batch.Set(s.weather(to).Collection("readings").Doc(d.Ref.ID), d.Data())
+			batch.Delete(d.Ref)
+		}
+
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *FirestoreStore) DeactivateEvent(ctx context.Context, slug string) (bool, error) {
+	_, err := s.event(slug).Update(ctx, []firestore.Update{{Path: "active", Value: false}})
+	switch {
+	case firestoredb.IsCode(err, codes.NotFound):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+func eventDocumentFor(e *Event) eventDocument {
+	d := eventDocument{
+		Name:     e.Name,
+		Slug:     e.Slug,
+		Location: e.Location,
+		Timezone: e.Timezone,
+		Provider: e.Provider,
+		Start:    e.Start,
+		End:      e.End,
+		Active:   e.Active,
+	}
+
+	if e.Lat != nil && e.Lng != nil {
+		d.Lat, d.Lng = e.Lat, e.Lng
+	}
+
+	return d
+}
+
+func eventFromDocument(d *firestore.DocumentSnapshot) (Event, error) {
+	var f eventDocument
+	if err := d.DataTo(&f); err != nil {
+		return Event{}, err
+	}
+
+	e := Event{
+		Name:     f.Name,
+		Slug:     f.Slug,
+		Location: f.Location,
+		Timezone: f.Timezone,
+		Provider: f.Provider,
+		Start:    f.Start,
+		End:      f.End,
+		Active:   f.Active,
+	}
+
+	if f.Lat != nil && f.Lng != nil {
+		e.Lat, e.Lng = f.Lat, f.Lng
+	}
+
+	return e, nil
+}
@@ -0,0 +1,229 @@
+package function
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/kelseyhightower/weather-internal/firestoredb"
+	"github.com/kelseyhightower/weather-internal/firestoretest"
+)
+
+// newTestFirestoreClient returns a client for the Firestore emulator
+// when FIRESTORE_EMULATOR_HOST is set, and for a fake otherwise.
+func newTestFirestoreClient(t *testing.T) (*firestore.Client, func()) {
+	client, done, err := firestoretest.NewClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, done
+}
+
+// writeTestWeather writes the weather documents for an event the way
+// the weather-data-collector does.
+func writeTestWeather(t *testing.T, client *firestore.Client, event string, now time.Time) {
+	period := func(offset int, temperature float64) periodDocument {
+		return periodDocument{
+			StartTime:   now.Add(time.Duration(offset) * time.Hour),
+			EndTime:     now.Add(time.Duration(offset+1) * time.Hour),
+			Temperature: temperature,
+		}
+	}
+	expires := func(offset time.Duration) *time.Time {
+		t := now.Add(offset)
+		return &t
+	}
+
+	weather := client.Collection("weather").Doc(firestoredb.ID(event))
+	batch := client.Batch().Set(weather, map[string]interface{}{
+		"event":       event,
+		"location":    "Denver, Colorado, USA",
+		"temperature": 31.0,
+		"source":      "observed",
+		"observedAt":  now,
+		"humidity":    20,
+		"forecast":    []periodDocument{period(2, 24), period(-2, 20), period(0, 22)},
+		"alerts": []alertDocument{
+			{Type: "Air Quality Alert"},
+			{Type: "Heat Advisory", Expires: expires(time.Hour)},
+			{Type: "Red Flag Warning", Expires: expires(-time.Hour)},
+		},
+	})
+
+	for i := 0; i < 3; i++ {
+		observedAt := now.Add(time.Duration(-i) * time.Hour)
+		batch.Set(weather.Collection("readings").Doc(strconv.FormatInt(observedAt.UnixNano(), 10)+"-nws-observed"), readingDocument{
+			Temperature: float64(30 - i),
+			Source:      "observed",
+			Provider:    "nws",
+			ObservedAt:  observedAt,
+		})
+	}
+
+	if _, err := batch.Commit(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFirestoreStoreWeather(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	writeTestWeather(t, client, "GopherCon", now)
+
+	w, err := s.Weather(ctx, "GopherCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Temperature != 31 || w.Humidity != 20 || !w.ObservedAt.Equal(now) {
+		t.Errorf("wrong weather: got %+v", w)
+	}
+	// Expired alerts are dropped and alerts without an expiry are last.
+	if len(w.Alerts) != 2 || w.Alerts[0].Type != "Heat Advisory" || w.Alerts[1].Type != "Air Quality Alert" {
+		t.Fatalf("wrong alerts: got %+v", w.Alerts)
+	}
+	if w.Alerts[0].Expires == nil || w.Alerts[1].Expires != nil {
+		t.Errorf("wrong alert expiry: got %v and %v", w.Alerts[0].Expires, w.Alerts[1].Expires)
+	}
+
+	if _, err := s.Weather(ctx, "GothamGo"); err == nil {
+		t.Errorf("expected an error for an event without weather data")
+	}
+
+	periods, err := s.Forecast(ctx, "GopherCon", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(periods) != 1 || periods[0].Temperature != 22 {
+		t.Errorf("wrong forecast: got %+v", periods)
+	}
+
+	readings, err := s.History(ctx, "GopherCon", now.Add(-90*time.Minute), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 2 || readings[0].Temperature != 29 || readings[1].Temperature != 30 {
+		t.Errorf("wrong history: got %+v", readings)
+	}
+}
+
+func TestFirestoreStoreEvents(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	lat, lng := 39.7392, -104.9903
+	gophercon := &Event{Slug: "gophercon", Name: "GopherCon", Location: "Denver, Colorado, USA", Lat: &lat, Lng: &lng, Start: "2018-08-27", Active: true}
+	golab := &Event{Slug: "golab", Name: "GoLab", Location: "Florence, Italy", Active: true}
+
+	for _, e := range []*Event{gophercon, golab} {
+		if err := s.CreateEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	duplicates := []*Event{
+		{Slug: "gophercon", Name: "GopherCon 2018", Location: "Denver, Colorado, USA"},
+		{Slug: "gophercon-2018", Name: "GopherCon", Location: "Denver, Colorado, USA"},
+	}
+	for _, e := range duplicates {
+		if err := s.CreateEvent(ctx, e); err != errEventExists {
+			t.Errorf("wrong error for a duplicate event %s: got %v want %v", e.Slug, err, errEventExists)
+		}
+	}
+
+	e, err := s.Event(ctx, "gophercon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.Name != "GopherCon" || e.Lat == nil || *e.Lat != lat || e.Start != "2018-08-27" {
+		t.Errorf("wrong event: got %+v", e)
+	}
+
+	if ok, err := s.DeactivateEvent(ctx, "golab"); err != nil || !ok {
+		t.Errorf("wrong deactivate result: got %v, %v", ok, err)
+	}
+	if ok, err := s.DeactivateEvent(ctx, "gotham-go"); err != nil || ok {
+		t.Errorf("wrong deactivate result for an unknown event: got %v, %v", ok, err)
+	}
+
+	events, err := s.Events(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Slug != "gophercon" {
+		t.Errorf("wrong active events: got %+v", events)
+	}
+}
+
+func TestFirestoreStoreRenameEvent(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	writeTestWeather(t, client, "GopherCon", now)
+
+	lat, lng := 39.7392, -104.9903
+	e := &Event{Slug: "gophercon", Name: "GopherCon", Location: "Denver, Colorado, USA", Lat: &lat, Lng: &lng, Active: true}
+	if err := s.CreateEvent(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateEvent(ctx, &Event{Slug: "golab", Name: "GoLab", Location: "Florence, Italy", Active: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.UpdateEvent(ctx, "GopherCon", &Event{Slug: "gophercon", Name: "GoLab", Location: "Denver, Colorado, USA", Active: true}); err != errEventExists {
+		t.Errorf("wrong error renaming to a taken name: got %v want %v", err, errEventExists)
+	}
+
+	// The renamed event keeps its weather data and history; clearing
+	// the coordinates removes them.
+	renamed := &Event{Slug: "gophercon", Name: "GopherCon 2018", Location: "Denver, Colorado, USA", Active: true}
+	if err := s.UpdateEvent(ctx, "GopherCon", renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Event(ctx, "gophercon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "GopherCon 2018" || got.Lat != nil {
+		t.Errorf("wrong renamed event: got %+v", got)
+	}
+
+	w, err := s.Weather(ctx, "GopherCon 2018")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Event != "GopherCon 2018" || w.Temperature != 31 {
+		t.Errorf("wrong weather after rename: got %+v", w)
+	}
+
+	readings, err := s.History(ctx, "GopherCon 2018", now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 3 {
+		t.Errorf("wrong number of readings after rename: got %v want %v", len(readings), 3)
+	}
+
+	if _, err := s.Weather(ctx, "GopherCon"); err == nil {
+		t.Errorf("weather data left under the previous name")
+	}
+
+	// The previous name can be used by a new event.
+	if err := s.CreateEvent(ctx, &Event{Slug: "gophercon-2019", Name: "GopherCon", Location: "San Diego, California, USA", Active: true}); err != nil {
+		t.Errorf("error reusing the previous name: %v", err)
+	}
+}
@@ -1,49 +1,146 @@
 package function
 
 import (
-	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
-	"sync"
+	"path"
+	"strconv"
+	"time"
 
 	"cloud.google.com/go/logging"
-	"cloud.google.com/go/storage"
 	"contrib.go.opencensus.io/exporter/stackdriver/propagation"
+	"github.com/kelseyhightower/weather-internal/health"
+	"github.com/kelseyhightower/weather-internal/publisher"
+	"github.com/kelseyhightower/weather-internal/secrets"
+	"github.com/kelseyhightower/weather-internal/stackdriver"
 	"go.opencensus.io/trace"
-
-	_ "github.com/lib/pq"
 )
 
 var (
-	db     *sql.DB
-	logger *logging.Logger
-	once   sync.Once
+	service *Service
+
+	// initService runs configFunc until it succeeds.
+	initService = health.NewInitializer(func() error { return configFunc() })
 )
 
-// configFunc sets the global configuration; it's overridden in tests.
+// configFunc sets the global service; it's overridden in tests.
 var configFunc = defaultConfigFunc
 
+// Logger logs structured log entries; *logging.Logger satisfies it.
+type Logger interface {
+	Log(e logging.Entry)
+	Flush() error
+}
+
+// Service serves the weather API. F uses the service created by
+// configFunc; tests create their own.
+type Service struct {
+	Store  Store
+	Logger Logger
+
+	// AdminToken is the bearer token required to create, update and
+	// deactivate events. The admin endpoints are disabled when it's
+	// empty.
+	AdminToken string
+
+	// Publisher publishes new and relocated events to EventsTopic so
+	// they're collected immediately; it may be nil.
+	Publisher   publisher.Publisher
+	EventsTopic string
+}
+
+// Weather is the latest reading for an event. Source is "observed"
+// when the temperature was reported by the nearest observation station
+// and "forecast" when it's the forecast for the current hour. The
+// remaining conditions come from the current forecast period.
+//
+// Temperature and WindSpeed are in the requested Units: degrees Celsius
+// and kilometres per hour for metric, degrees Fahrenheit and miles per
+// hour for imperial. Humidity and PrecipitationProbability are
+// percentages.
 type Weather struct {
-	Event       string
-	Location    string
-	Temperature int
+	Event                    string
+	Location                 string
+	Units                    string
+	Temperature              float64
+	Source                   string
+	ObservedAt               time.Time
+	Humidity                 int
+	WindSpeed                float64
+	WindDirection            string
+	PrecipitationProbability int
+	ShortForecast            string
+	Icon                     string
+	IsDaytime                bool
+	Alerts                   []Alert
+}
+
+// Alert is an active weather alert, such as a heat advisory or storm
+// warning, for the location of an event. Expires is nil for alerts
+// without an expiry time, which stay active until the feed drops them.
+type Alert struct {
+	Type     string
+	Severity string
+	Headline string
+	Expires  *time.Time
 }
 
+type Period struct {
+	Name                     string
+	StartTime                time.Time
+	EndTime                  time.Time
+	IsDaytime                bool
+	Units                    string
+	Temperature              float64
+	Humidity                 int
+	WindSpeed                float64
+	WindDirection            string
+	PrecipitationProbability int
+	ShortForecast            string
+	DetailedForecast         string
+	Icon                     string
+}
+
+type Reading struct {
+	Units       string
+	Temperature float64
+	Source      string
+	Provider    string
+	ObservedAt  time.Time
+}
+
+// defaultHistoryRange is the range of readings returned when the from
+// query parameter is not set.
+const defaultHistoryRange = 24 * time.Hour
+
+// defaultForecastHours is the number of upcoming hourly forecast
+// periods returned when the hours query parameter is not set.
+const defaultForecastHours = 12
+
+// maxForecastHours matches the length of the api.weather.gov hourly
+// forecast, which covers the next 6.5 days.
+const maxForecastHours = 156
+
 func F(w http.ResponseWriter, r *http.Request) {
-	once.Do(func() {
-		if err := configFunc(); err != nil {
-			panic(err)
-		}
-	})
+	if path.Base(r.URL.Path) == "healthz" {
+		initService.ServeHealth(w, r)
+		return
+	}
+
+	if err := initService.Do(); err != nil {
+		initService.ServeUnavailable(w, err)
+		return
+	}
+
+	defer service.Logger.Flush()
 
-	defer logger.Flush()
+	service.ServeHTTP(w, r)
+}
 
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var span *trace.Span
 
@@ -57,9 +154,15 @@ func F(w http.ResponseWriter, r *http.Request) {
 		defer span.End()
 	}
 
+	// The events endpoints aren't for a single event.
+	if slug, ok := eventsPath(r.URL.Path); ok {
+		s.eventsHandler(ctx, w, r, slug)
+		return
+	}
+
 	event := r.FormValue("event")
 	if event == "" {
-		logger.Log(logging.Entry{
+		s.Logger.Log(logging.Entry{
 			Payload:  "missing event query parameter",
 			Severity: logging.Error,
 		})
@@ -67,9 +170,32 @@ func F(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	weather, err := getWeatherForEvent(ctx, event)
+	units, err := parseUnits(r)
 	if err != nil {
-		logger.Log(logging.Entry{
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch path.Base(r.URL.Path) {
+	case "forecast":
+		s.forecastHandler(ctx, w, r, event, units)
+	case "history":
+		s.historyHandler(ctx, w, r, event, units)
+	case "daily":
+		s.dailyHandler(ctx, w, r, event, units)
+	default:
+		s.weatherHandler(ctx, w, r, event, units)
+	}
+}
+
+func (s *Service) weatherHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, event, units string) {
+	weather, err := s.Store.Weather(ctx, event)
+	if err != nil {
+		s.Logger.Log(logging.Entry{
 			Payload:  err.Error(),
 			Severity: logging.Error,
 		})
@@ -77,8 +203,10 @@ func F(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	weather.convert(units)
+
 	if err := json.NewEncoder(w).Encode(weather); err != nil {
-		logger.Log(logging.Entry{
+		s.Logger.Log(logging.Entry{
 			Payload:  err.Error(),
 			Severity: logging.Error,
 		})
@@ -87,164 +215,189 @@ func F(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getWeatherForEvent(ctx context.Context, event string) (*Weather, error) {
-	_, span := trace.StartSpan(ctx, "cloud-sql")
-	span.AddAttributes(
-		trace.StringAttribute("cloudsql", "postgres"),
-		trace.StringAttribute("schema", "weather"),
-	)
-	span.Annotate([]trace.Attribute{
-		trace.StringAttribute("Query", "SELECT event,location,temperature FROM weather WHERE event = $1"),
-	}, "query")
-
-	defer span.End()
-
-	var w Weather
-
-	err := db.QueryRow("SELECT event,location,temperature FROM weather WHERE event = $1", event).Scan(
-		&w.Event, &w.Location, &w.Temperature)
-	switch {
-	case err == sql.ErrNoRows:
-		return nil, err
-	case err != nil:
-		return nil, err
+func (s *Service) forecastHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, event, units string) {
+	hours := defaultForecastHours
+	if v := r.FormValue("hours"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxForecastHours {
+			message := fmt.Sprintf("invalid hours query parameter: must be between 1 and %d", maxForecastHours)
+			s.Logger.Log(logging.Entry{
+				Payload:  message,
+				Severity: logging.Error,
+			})
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+		hours = n
 	}
 
-	return &w, nil
-}
+	periods, err := s.Store.Forecast(ctx, event, hours)
+	if err != nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
 
-func defaultConfigFunc() error {
-	var err error
+	for i := range periods {
+		periods[i].convert(units)
+	}
 
-	if err := EnableStackdriverTrace(); err != nil {
-		return err
+	if err := json.NewEncoder(w).Encode(periods); err != nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+		http.Error(w, "", http.StatusInternalServerError)
+		return
 	}
+}
 
-	logger, err = NewStackdriverLogger()
+// dailyHandler returns the day and night forecast periods for the days
+// of a dated event. The list is empty until the event is within range
+// of the daily forecast.
+func (s *Service) dailyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, event, units string) {
+	periods, err := s.Store.DailyForecast(ctx, event)
 	if err != nil {
-		return err
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+		http.Error(w, "", http.StatusInternalServerError)
+		return
 	}
 
-	ctx := context.Background()
-
-	bucketName := os.Getenv("CONFIGURATION_BUCKET_NAME")
-	if bucketName == "" {
-		return fmt.Errorf("CONFIGURATION_BUCKET_NAME environment variable unset or missing")
+	for i := range periods {
+		periods[i].convert(units)
 	}
 
-	storageClient, err := storage.NewClient(ctx)
-	if err != nil {
-		return err
+	if err := json.NewEncoder(w).Encode(periods); err != nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+		http.Error(w, "", http.StatusInternalServerError)
+		return
 	}
+}
 
-	// Fetch the Cloud SQL credentials and make them
-	// available to the lib/pq database driver.
-	password, err := objectToString(storageClient, bucketName, "password")
-	if err != nil {
-		return err
+func (s *Service) historyHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, event, units string) {
+	to := time.Now()
+	if v := r.FormValue("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			message := "invalid to query parameter: must be an RFC 3339 timestamp"
+			s.Logger.Log(logging.Entry{
+				Payload:  message,
+				Severity: logging.Error,
+			})
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+		to = t
 	}
 
-	clientCert, err := objectToTempFile(storageClient, bucketName, "client.pem")
-	if err != nil {
-		return err
+	from := to.Add(-defaultHistoryRange)
+	if v := r.FormValue("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			message := "invalid from query parameter: must be an RFC 3339 timestamp"
+			s.Logger.Log(logging.Entry{
+				Payload:  message,
+				Severity: logging.Error,
+			})
+			http.Error(w, message, http.StatusBadRequest)
+			return
+		}
+		from = t
 	}
 
-	clientKey, err := objectToTempFile(storageClient, bucketName, "client.key")
-	if err != nil {
-		return err
+	if from.After(to) {
+		message := "invalid query parameters: from must be before to"
+		s.Logger.Log(logging.Entry{
+			Payload:  message,
+			Severity: logging.Error,
+		})
+		http.Error(w, message, http.StatusBadRequest)
+		return
 	}
 
-	serverCert, err := objectToTempFile(storageClient, bucketName, "server.pem")
+	readings, err := s.Store.History(ctx, event, from, to)
 	if err != nil {
-		return err
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+		http.Error(w, "", http.StatusInternalServerError)
+		return
 	}
 
-	// Use environment variables to configure the database connection
-	// parameters because it allows us to leverage both run-time and
-	// deploy time configuration.
-	err = os.Setenv("PGSSLCERT", clientCert)
-	if err != nil {
-		return err
+	for i := range readings {
+		readings[i].convert(units)
 	}
 
-	err = os.Setenv("PGSSLKEY", clientKey)
-	if err != nil {
-		return err
+	if err := json.NewEncoder(w).Encode(readings); err != nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+		http.Error(w, "", http.StatusInternalServerError)
+		return
 	}
+}
 
-	err = os.Setenv("PGSSLROOTCERT", serverCert)
-	if err != nil {
+func defaultConfigFunc() error {
+	var err error
+
+	if err := stackdriver.EnableTrace(); err != nil {
 		return err
 	}
 
-	// Don't store the decrypted database password in an environment
-	// variable to avoid security concerns. Instead store the password
-	// in a connection string that will be used to configure the
-	// database connection parameters.
-	//
-	// The `lib/pq` database driver supports configuring database
-	// connection parameters using both environment variables and
-	// a connection string. Environment variables take lower
-	// precedence.
-	//
-	// See the `lib/pq` docs for more details:
-	//
-	//     https://godoc.org/github.com/lib/pq
-	//
-	dsn := fmt.Sprintf("password='%s'", password)
-
-	db, err = sql.Open("postgres", dsn)
+	logger, err := stackdriver.NewLogger()
 	if err != nil {
 		return err
 	}
 
-	// Google Cloud Functions ensures a single request per function
-	// invocation. Avoid exhausting database connections by limiting
-	// this function to a single database connection.
-	//
-	// See the cloud functions docs for more details:
-	//
-	//    https://cloud.google.com/functions/docs/sql
-	//
-	db.SetMaxIdleConns(1)
-	db.SetMaxOpenConns(1)
-
-	return nil
-}
-
-func objectToString(client *storage.Client, bucketName, objectName string) (string, error) {
 	ctx := context.Background()
-	o, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+
+	source, err := secrets.NewSource(ctx)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer o.Close()
 
-	data, err := ioutil.ReadAll(o)
+	store, err := openStore(ctx, source)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return string(bytes.TrimSpace(data)), nil
-}
-
-func objectToTempFile(client *storage.Client, bucketName, objectName string) (string, error) {
-	ctx := context.Background()
-	o, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	// The admin endpoints are optional; run without them rather than
+	// failing every request when the admin-token secret is missing.
+	adminToken, err := secrets.String(ctx, source, "admin-token")
 	if err != nil {
-		return "", err
+		logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("error reading admin-token secret, event admin endpoints are disabled: %v", err),
+			Severity: logging.Warning,
+		})
 	}
-	defer o.Close()
 
-	t, err := ioutil.TempFile("", "")
-	if err != nil {
-		return "", err
+	var events publisher.Publisher
+	eventsTopic := os.Getenv("EVENTS_TOPIC")
+	if eventsTopic != "" {
+		events, err = publisher.NewPubSub(ctx)
+		if err != nil {
+			return err
+		}
 	}
-	defer t.Close()
 
-	if _, err := io.Copy(t, o); err != nil {
-		return "", err
+	service = &Service{
+		Store:       store,
+		Logger:      logger,
+		AdminToken:  adminToken,
+		Publisher:   events,
+		EventsTopic: eventsTopic,
 	}
 
-	return t.Name(), nil
+	return nil
 }
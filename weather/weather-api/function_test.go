@@ -0,0 +1,384 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+type testLogger struct {
+	entries []logging.Entry
+}
+
+func (l *testLogger) Log(e logging.Entry) {
+	l.entries = append(l.entries, e)
+}
+
+func (l *testLogger) Flush() error {
+	return nil
+}
+
+// testStore is a Store holding the data for a single event.
+type testStore struct {
+	weather  Weather
+	forecast []Period
+	daily    []Period
+	readings []Reading
+	events   []Event
+	err      error
+
+	hours    int
+	from, to time.Time
+}
+
+func (s *testStore) Weather(ctx context.Context, event string) (*Weather, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	w := s.weather
+	return &w, nil
+}
+
+func (s *testStore) Forecast(ctx context.Context, event string, hours int) ([]Period, error) {
+	s.hours = hours
+	if s.err != nil {
+		return nil, s.err
+	}
+	return append([]Period(nil), s.forecast...), nil
+}
+
+func (s *testStore) DailyForecast(ctx context.Context, event string) ([]Period, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return append([]Period(nil), s.daily...), nil
+}
+
+func (s *testStore) History(ctx context.Context, event string, from, to time.Time) ([]Reading, error) {
+	s.from, s.to = from, to
+	if s.err != nil {
+		return nil, s.err
+	}
+	return append([]Reading(nil), s.readings...), nil
+}
+
+func (s *testStore) Events(ctx context.Context) ([]Event, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	events := make([]Event, 0)
+	for _, e := range s.events {
+		if e.Active {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+func (s *testStore) Event(ctx context.Context, slug string) (*Event, error) {
+	for _, e := range s.events {
+		if e.Slug == slug {
+			return &e, nil
+		}
+	}
+	return nil, s.err
+}
+
+func (s *testStore) CreateEvent(ctx context.Context, e *Event) error {
+	for _, existing := range s.events {
+		if existing.Slug == e.Slug || existing.Name == e.Name {
+			return errEventExists
+		}
+	}
+	s.events = append(s.events, *e)
+	return nil
+}
+
+func (s *testStore) UpdateEvent(ctx context.Context, previousName string, e *Event) error {
+	for i := range s.events {
+		if s.events[i].Slug == e.Slug {
+			s.events[i] = *e
+		}
+	}
+	if e.Name != previousName && s.weather.Event == previousName {
+		s.weather.Event = e.Name
+	}
+	return nil
+}
+
+func (s *testStore) DeactivateEvent(ctx context.Context, slug string) (bool, error) {
+	for i := range s.events {
+		if s.events[i].Slug == slug {
+			s.events[i].Active = false
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func newTestService() (*Service, *testStore) {
+	store := &testStore{
+		weather: Weather{
+			Event:       "GopherCon",
+			Location:    "Denver, Colorado, USA",
+			Temperature: 20,
+			WindSpeed:   16.09344,
+			Source:      "observed",
+		},
+		forecast: []Period{{Temperature: 30, WindSpeed: 10}},
+		daily:    []Period{{Name: "Tuesday", Temperature: 25}},
+		readings: []Reading{{Temperature: -40, Source: "forecast"}},
+		events:   []Event{{Name: "GopherCon", Slug: "gophercon", Location: "Denver, Colorado, USA", Active: true}},
+	}
+	return &Service{Store: store, Logger: &testLogger{}}, store
+}
+
+func TestServiceWeather(t *testing.T) {
+	s, _ := newTestService()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?event=GopherCon", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+
+	var weather Weather
+	if err := json.NewDecoder(w.Body).Decode(&weather); err != nil {
+		t.Fatal(err)
+	}
+
+	if weather.Units != imperial {
+		t.Errorf("wrong units: got %v want %v", weather.Units, imperial)
+	}
+	if weather.Temperature != 68 {
+		t.Errorf("wrong temperature: got %v want %v", weather.Temperature, 68)
+	}
+	if weather.WindSpeed != 10 {
+		t.Errorf("wrong wind speed: got %v want %v", weather.WindSpeed, 10)
+	}
+}
+
+func TestServiceWeatherAlerts(t *testing.T) {
+	s, store := newTestService()
+
+	expires := time.Date(2018, 8, 28, 20, 0, 0, 0, time.UTC)
+	store.weather.Alerts = []Alert{
+		{Type: "Heat Advisory", Severity: "Moderate", Headline: "Heat Advisory until 8 PM", Expires: &expires},
+		{Type: "Air Quality Alert", Severity: "Unknown"},
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?event=GopherCon", nil))
+
+	var weather Weather
+	if err := json.NewDecoder(w.Body).Decode(&weather); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(weather.Alerts) != 2 {
+		t.Fatalf("wrong number of alerts: got %v want %v", len(weather.Alerts), 2)
+	}
+	heat := weather.Alerts[0]
+	if heat.Type != "Heat Advisory" || heat.Severity != "Moderate" || heat.Headline != "Heat Advisory until 8 PM" {
+		t.Errorf("wrong alert: got %+v", heat)
+	}
+	if heat.Expires == nil || !heat.Expires.Equal(expires) {
+		t.Errorf("wrong alert expiry: got %v want %v", heat.Expires, expires)
+	}
+	if weather.Alerts[1].Expires != nil {
+		t.Errorf("wrong alert expiry: got %v want nil", weather.Alerts[1].Expires)
+	}
+}
+
+func TestServiceBadRequest(t *testing.T) {
+	tests := []string{
+		"/",
+		"/?event=GopherCon&units=kelvin",
+		"/forecast?event=GopherCon&hours=0",
+		"/forecast?event=GopherCon&hours=157",
+		"/history?event=GopherCon&from=yesterday",
+		"/history?event=GopherCon&from=2018-08-29T00:00:00Z&to=2018-08-28T00:00:00Z",
+	}
+
+	for _, url := range tests {
+		s, _ := newTestService()
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("wrong status code for %v: got %v want %v", url, w.Code, http.StatusBadRequest)
+		}
+		if len(s.Logger.(*testLogger).entries) == 0 {
+			t.Errorf("expected a log entry for %v", url)
+		}
+	}
+}
+
+func TestServiceStoreError(t *testing.T) {
+	for _, url := range []string{"/", "/forecast", "/daily", "/history", "/events"} {
+		s, store := newTestService()
+		store.err = errors.New("connection refused")
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", url+"?event=GopherCon", nil))
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("wrong status code for %v: got %v want %v", url, w.Code, http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestServiceForecast(t *testing.T) {
+	s, store := newTestService()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/forecast?event=GopherCon&units=metric", nil))
+
+	if store.hours != defaultForecastHours {
+		t.Errorf("wrong hours: got %v want %v", store.hours, defaultForecastHours)
+	}
+
+	var periods []Period
+	if err := json.NewDecoder(w.Body).Decode(&periods); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(periods) != 1 || periods[0].Temperature != 30 || periods[0].Units != metric {
+		t.Errorf("wrong forecast: got %+v", periods)
+	}
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/forecast?event=GopherCon&hours=24", nil))
+	if store.hours != 24 {
+		t.Errorf("wrong hours: got %v want %v", store.hours, 24)
+	}
+}
+
+func TestServiceForecastPeriods(t *testing.T) {
+	s, store := newTestService()
+
+	start := time.Date(2018, 8, 28, 9, 0, 0, 0, time.UTC)
+	store.forecast = []Period{
+		{StartTime: start, EndTime: start.Add(time.Hour), Temperature: 20, WindSpeed: 16.09344, WindDirection: "NW", ShortForecast: "Sunny"},
+		{StartTime: start.Add(time.Hour), EndTime: start.Add(2 * time.Hour), Temperature: 25, WindSpeed: 0, ShortForecast: "Mostly Sunny"},
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/forecast?event=GopherCon", nil))
+
+	var periods []Period
+	if err := json.NewDecoder(w.Body).Decode(&periods); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(periods) != 2 {
+		t.Fatalf("wrong number of periods: got %v want %v", len(periods), 2)
+	}
+	first := periods[0]
+	if !first.StartTime.Equal(start) || !first.EndTime.Equal(start.Add(time.Hour)) {
+		t.Errorf("wrong period times: got %v to %v", first.StartTime, first.EndTime)
+	}
+	if first.Units != imperial || first.Temperature != 68 || first.WindSpeed != 10 || first.WindDirection != "NW" || first.ShortForecast != "Sunny" {
+		t.Errorf("wrong period: got %+v", first)
+	}
+	if periods[1].Temperature != 77 || periods[1].ShortForecast != "Mostly Sunny" {
+		t.Errorf("wrong period: got %+v", periods[1])
+	}
+}
+
+func TestServiceDailyForecast(t *testing.T) {
+	s, _ := newTestService()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/daily?event=GopherCon", nil))
+
+	var periods []Period
+	if err := json.NewDecoder(w.Body).Decode(&periods); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(periods) != 1 || periods[0].Name != "Tuesday" || periods[0].Temperature != 77 {
+		t.Errorf("wrong daily forecast: got %+v", periods)
+	}
+}
+
+func TestServiceHistory(t *testing.T) {
+	s, store := newTestService()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/history?event=GopherCon&to=2018-08-29T00:00:00Z", nil))
+
+	want := time.Date(2018, 8, 29, 0, 0, 0, 0, time.UTC)
+	if !store.to.Equal(want) || !store.from.Equal(want.Add(-defaultHistoryRange)) {
+		t.Errorf("wrong history range: got %v to %v", store.from, store.to)
+	}
+
+	var readings []Reading
+	if err := json.NewDecoder(w.Body).Decode(&readings); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(readings) != 1 || readings[0].Temperature != -40 {
+		t.Errorf("wrong history: got %+v", readings)
+	}
+}
+
+func TestServiceHistoryRange(t *testing.T) {
+	s, store := newTestService()
+
+	observedAt := time.Date(2018, 8, 28, 12, 0, 0, 0, time.UTC)
+	store.readings = []Reading{
+		{Temperature: 20, Source: "observed", Provider: "nws", ObservedAt: observedAt},
+		{Temperature: 25, Source: "forecast", Provider: "nws", ObservedAt: observedAt.Add(time.Hour)},
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/history?event=GopherCon&from=2018-08-28T00:00:00Z&to=2018-08-29T00:00:00Z&units=metric", nil))
+
+	from, to := time.Date(2018, 8, 28, 0, 0, 0, 0, time.UTC), time.Date(2018, 8, 29, 0, 0, 0, 0, time.UTC)
+	if !store.from.Equal(from) || !store.to.Equal(to) {
+		t.Errorf("wrong history range: got %v to %v want %v to %v", store.from, store.to, from, to)
+	}
+
+	var readings []Reading
+	if err := json.NewDecoder(w.Body).Decode(&readings); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(readings) != 2 {
+		t.Fatalf("wrong number of readings: got %v want %v", len(readings), 2)
+	}
+	for i, r := range readings {
+		want := store.readings[i]
+		if r.Units != metric || r.Temperature != want.Temperature || r.Source != want.Source || !r.ObservedAt.Equal(want.ObservedAt) {
+			t.Errorf("wrong reading: got %+v want %+v", r, want)
+		}
+	}
+}
+
+func TestServiceEvents(t *testing.T) {
+	s, _ := newTestService()
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/events", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+
+	var events []Event
+	if err := json.NewDecoder(w.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 1 || events[0].Name != "GopherCon" || events[0].Slug != "gophercon" {
+		t.Errorf("wrong events: got %+v", events)
+	}
+}
@@ -0,0 +1,279 @@
+package function
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// SQLiteStore is a Store backed by a SQLite database file, for local
+// use and tests without Cloud SQL. It's selected with STORE=sqlite; see
+// openStore.
+type SQLiteStore struct {
+	DB *sql.DB
+}
+
+func (s *SQLiteStore) Weather(ctx context.Context, event string) (*Weather, error) {
+	var w Weather
+
+	err := s.DB.QueryRow(sqliteWeatherQuery, event).Scan(
+		&w.Event, &w.Location, &w.Temperature, &w.Source, &w.ObservedAt,
+		&w.Humidity, &w.WindSpeed, &w.WindDirection, &w.PrecipitationProbability,
+		&w.ShortForecast, &w.Icon, &w.IsDaytime)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.Query(sqliteAlertsQuery, event, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	w.Alerts = make([]Alert, 0)
+	for rows.Next() {
+		var a Alert
+		if err := rows.Scan(&a.Type, &a.Severity, &a.Headline, &a.Expires); err != nil {
+			return nil, err
+		}
+		w.Alerts = append(w.Alerts, a)
+	}
+
+	return &w, rows.Err()
+}
+
+func (s *SQLiteStore) Forecast(ctx context.Context, event string, hours int) ([]Period, error) {
+	rows, err := s.DB.Query(sqliteForecastQuery, event, time.Now().UTC(), hours)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := make([]Period, 0)
+	for rows.Next() {
+		var p Period
+		err := rows.Scan(&p.StartTime, &p.EndTime, &p.IsDaytime, &p.Temperature,
+			&p.Humidity, &p.WindSpeed, &p.WindDirection, &p.PrecipitationProbability,
+			&p.ShortForecast, &p.Icon)
+		if err != nil {
+			return nil, err
+		}
+		periods = append(periods, p)
+	}
+
+	return periods, rows.Err()
+}
+
+func (s *SQLiteStore) DailyForecast(ctx context.Context, event string) ([]Period, error) {
+	rows, err := s.DB.Query(sqliteDailyForecastQuery, event, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := make([]Period, 0)
+	for rows.Next() {
+		var p Period
+		err := rows.Scan(&p.Name, &p.StartTime, &p.EndTime, &p.IsDaytime, &p.Temperature,
+			&p.WindSpeed, &p.WindDirection, &p.PrecipitationProbability,
+			&p.ShortForecast, &p.DetailedForecast, &p.Icon)
+		if err != nil {
+			return nil, err
+		}
+		periods = append(periods, p)
+	}
+
+	return periods, rows.Err()
+}
+
+func (s *SQLiteStore) History(ctx context.Context, event string, from, to time.Time) ([]Reading, error) {
+	rows, err := s.DB.Query(sqliteHistoryQuery, event, from.UTC(), to.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := make([]Reading, 0)
+	for rows.Next() {
+		var r Reading
+		if err := rows.Scan(&r.Temperature, &r.Source, &r.Provider, &r.ObservedAt); err != nil {
+			return nil, err
+		}
+		readings = append(readings, r)
+	}
+
+	return readings, rows.Err()
+}
+
+func (s *SQLiteStore) Events(ctx context.Context) ([]Event, error) {
+	rows, err := s.DB.Query(sqliteEventsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *e)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *SQLiteStore) Event(ctx context.Context, slug string) (*Event, error) {
+	e, err := scanEvent(s.DB.QueryRow(sqliteEventQuery, slug))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (s *SQLiteStore) CreateEvent(ctx context.Context, e *Event) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Check the unique slug and name in the transaction rather than
+	// decoding the driver's constraint errors, which aren't available
+	// in builds without cgo.
+	var exists bool
+	if err := tx.QueryRow(sqliteEventExistsQuery, e.Slug, e.Name).Scan(&exists); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if exists {
+		tx.Rollback()
+		return errEventExists
+	}
+
+	_, err = tx.Exec(sqliteCreateEventQuery, e.Slug, e.Name, e.Location, e.Lat, e.Lng,
+		e.Timezone, e.Provider, nullDate(e.Start), nullDate(e.End), e.Active)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateEvent(ctx context.Context, previousName string, e *Event) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := tx.QueryRow(sqliteEventNameTakenQuery, e.Slug, e.Name).Scan(&exists); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if exists {
+		tx.Rollback()
+		return errEventExists
+	}
+
+	_, err = tx.Exec(sqliteUpdateEventQuery, e.Slug, e.Name, e.Location, e.Lat, e.Lng,
+		e.Timezone, e.Provider, nullDate(e.Start), nullDate(e.End), e.Active)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if e.Name != previousName {
+		for _, q := range sqliteRenameEventQueries {
+			if _, err := tx.Exec(q, previousName, e.Name); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) DeactivateEvent(ctx context.Context, slug string) (bool, error) {
+	result, err := s.DB.Exec(sqliteDeactivateEventQuery, slug)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// The SQLite queries match the PostgresStore queries, with times
+// passed as parameters instead of now().
+
+var sqliteWeatherQuery = `SELECT event, location, temperature, source, observed_at,
+    humidity, wind_speed, wind_direction, precipitation_probability, short_forecast, icon, is_daytime
+  FROM weather
+  WHERE event = ?1;`
+
+var sqliteAlertsQuery = `SELECT alert_type, severity, headline, expires_at
+  FROM alerts
+  WHERE event = ?1 AND (expires_at IS NULL OR expires_at > ?2)
+  ORDER BY expires_at IS NULL, expires_at;`
+
+var sqliteForecastQuery = `SELECT start_time, end_time, is_daytime, temperature,
+    humidity, wind_speed, wind_direction, precipitation_probability, short_forecast, icon
+  FROM forecast
+  WHERE event = ?1 AND end_time > ?2
+  ORDER BY start_time
+  LIMIT ?3;`
+
+var sqliteDailyForecastQuery = `SELECT name, start_time, end_time, is_daytime, temperature,
+    wind_speed, wind_direction, precipitation_probability, short_forecast, detailed_forecast, icon
+  FROM daily_forecast
+  WHERE event = ?1 AND end_time > ?2
+  ORDER BY start_time;`
+
+var sqliteHistoryQuery = `SELECT temperature, source, provider, observed_at
+  FROM readings
+  WHERE event = ?1 AND observed_at >= ?2 AND observed_at <= ?3
+  ORDER BY observed_at;`
+
+var sqliteEventColumns = `name, slug, location, lat, lng, timezone, provider, start_date, end_date, active`
+
+var sqliteEventsQuery = `SELECT ` + sqliteEventColumns + `
+  FROM events
+  WHERE active
+  ORDER BY name;`
+
+var sqliteEventQuery = `SELECT ` + sqliteEventColumns + `
+  FROM events
+  WHERE slug = ?1;`
+
+var sqliteEventExistsQuery = `SELECT EXISTS (SELECT 1 FROM events WHERE slug = ?1 OR name = ?2);`
+
+var sqliteEventNameTakenQuery = `SELECT EXISTS (SELECT 1 FROM events WHERE slug <> ?1 AND name = ?2);`
+
+var sqliteCreateEventQuery = `INSERT INTO events (slug, name, location, lat, lng, timezone, provider,
+    start_date, end_date, active)
+  VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10);`
+
+var sqliteUpdateEventQuery = `UPDATE events
+  SET name = ?2, location = ?3, lat = ?4, lng = ?5, timezone = ?6, provider = ?7,
+    start_date = ?8, end_date = ?9, active = ?10
+  WHERE slug = ?1;`
+
+var sqliteDeactivateEventQuery = `UPDATE events SET active = false WHERE slug = ?1;`
+
+// sqliteRenameEventQueries move the weather data for an event from the
+// name ?1 to ?2.
+var sqliteRenameEventQueries = []string{
+	`UPDATE weather SET event = ?2 WHERE event = ?1;`,
+	`UPDATE forecast SET event = ?2 WHERE event = ?1;`,
+	`UPDATE daily_forecast SET event = ?2 WHERE event = ?1;`,
+	`UPDATE alerts SET event = ?2 WHERE event = ?1;`,
+	`UPDATE readings SET event = ?2 WHERE event = ?1;`,
+	`UPDATE geocodes SET event = ?2 WHERE event = ?1;`,
+}
@@ -0,0 +1,306 @@
+package function
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/weather-internal/database"
+)
+
+// newTestSQLiteStore returns a SQLiteStore for a new, migrated database
+// in a temporary directory. The events registry starts empty rather
+// than with the events seeded by the migrations.
+func newTestSQLiteStore(t *testing.T) (*SQLiteStore, func()) {
+	dir, err := ioutil.TempDir("", "weather")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.OpenSQLite(filepath.Join(dir, "weather.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	done := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	m := &database.Migrator{DB: db, Migrations: database.Migrations, SQLite: true}
+	if _, err := m.Up(context.Background()); err != nil {
+		done()
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM events`); err != nil {
+		done()
+		t.Fatal(err)
+	}
+
+	return &SQLiteStore{DB: db}, done
+}
+
+// writeTestSQLiteWeather writes the weather data the collector stores
+// for event: the latest weather, three hourly periods, two daily
+// periods, three readings and three alerts, one of them expired.
+func writeTestSQLiteWeather(t *testing.T, s *SQLiteStore, event string, now time.Time) {
+	now = now.UTC()
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`INSERT INTO weather VALUES (?1, 'Denver, Colorado, USA', 31, 'observed', ?2, 20, 16.0934, 'NW', 10, 'Sunny', 'https://api.weather.gov/icons/land/day/skc', true, ?2);`,
+			[]interface{}{event, now}},
+		{`INSERT INTO forecast VALUES (?1, ?2, ?3, true, 31, 20, 16.0934, 'NW', 10, 'Sunny', '');`,
+			[]interface{}{event, now.Add(-30 * time.Minute), now.Add(30 * time.Minute)}},
+		{`INSERT INTO forecast VALUES (?1, ?2, ?3, true, 32, 20, 16.0934, 'NW', 10, 'Sunny', '');`,
+			[]interface{}{event, now.Add(30 * time.Minute), now.Add(90 * time.Minute)}},
+		{`INSERT INTO forecast VALUES (?1, ?2, ?3, true, 30, 20, 16.0934, 'NW', 10, 'Sunny', '');`,
+			[]interface{}{event, now.Add(-2 * time.Hour), now.Add(-time.Hour)}},
+		{`INSERT INTO daily_forecast VALUES (?1, ?2, ?3, 'Today', true, 31, 16.0934, 'NW', 10, 'Sunny', 'Sunny, with a high near 88.', '');`,
+			[]interface{}{event, now.Add(-time.Hour), now.Add(11 * time.Hour)}},
+		{`INSERT INTO daily_forecast VALUES (?1, ?2, ?3, 'Tonight', false, 14, 8.0467, 'S', 0, 'Clear', 'Clear, with a low around 57.', '');`,
+			[]interface{}{event, now.Add(11 * time.Hour), now.Add(23 * time.Hour)}},
+		{`INSERT INTO readings (event, temperature, source, provider, observed_at, published_at) VALUES (?1, 29, 'observed', 'nws', ?2, ?2);`,
+			[]interface{}{event, now.Add(-2 * time.Hour)}},
+		{`INSERT INTO readings (event, temperature, source, provider, observed_at, published_at) VALUES (?1, 30, 'forecast', 'nws', ?2, ?2);`,
+			[]interface{}{event, now.Add(-time.Hour)}},
+		{`INSERT INTO readings (event, temperature, source, provider, observed_at, published_at) VALUES (?1, 31, 'observed', 'nws', ?2, ?2);`,
+			[]interface{}{event, now}},
+		{`INSERT INTO alerts VALUES (?1, 'heat', 'Heat Advisory', 'Moderate', 'Heat Advisory until 8 PM', ?2);`,
+			[]interface{}{event, now.Add(2 * time.Hour)}},
+		{`INSERT INTO alerts VALUES (?1, 'air', 'Air Quality Alert', 'Minor', 'Air Quality Alert', NULL);`,
+			[]interface{}{event}},
+		{`INSERT INTO alerts VALUES (?1, 'wind', 'Wind Advisory', 'Minor', 'Wind Advisory until noon', ?2);`,
+			[]interface{}{event, now.Add(-time.Hour)}},
+	}
+
+	for _, q := range queries {
+		if _, err := s.DB.Exec(q.query, q.args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSQLiteStoreWeather(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Second)
+	writeTestSQLiteWeather(t, s, "GopherCon", now)
+
+	w, err := s.Weather(ctx, "GopherCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Event != "GopherCon" || w.Temperature != 31 || !w.ObservedAt.Equal(now) || w.WindDirection != "NW" || !w.IsDaytime {
+		t.Errorf("wrong weather: got %+v", w)
+	}
+
+	// Expired alerts are dropped and alerts without an expiry come last.
+	if len(w.Alerts) != 2 {
+		t.Fatalf("wrong number of alerts: got %v want %v", len(w.Alerts), 2)
+	}
+	if w.Alerts[0].Type != "Heat Advisory" || w.Alerts[0].Expires == nil || !w.Alerts[0].Expires.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("wrong first alert: got %+v", w.Alerts[0])
+	}
+	if w.Alerts[1].Type != "Air Quality Alert" || w.Alerts[1].Expires != nil {
+		t.Errorf("wrong second alert: got %+v", w.Alerts[1])
+	}
+
+	if _, err := s.Weather(ctx, "GoLab"); err == nil {
+		t.Error("expected an error for an event without weather")
+	}
+}
+
+func TestSQLiteStoreForecast(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Second)
+	writeTestSQLiteWeather(t, s, "GopherCon", now)
+
+	periods, err := s.Forecast(ctx, "GopherCon", 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(periods) != 2 {
+		t.Fatalf("wrong number of periods: got %v want %v", len(periods), 2)
+	}
+	if periods[0].Temperature != 31 || !periods[0].StartTime.Equal(now.Add(-30*time.Minute)) || periods[1].Temperature != 32 {
+		t.Errorf("wrong periods: got %+v", periods)
+	}
+
+	periods, err = s.Forecast(ctx, "GopherCon", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(periods) != 1 {
+		t.Errorf("wrong number of periods: got %v want %v", len(periods), 1)
+	}
+
+	periods, err = s.DailyForecast(ctx, "GopherCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(periods) != 2 || periods[0].Name != "Today" || periods[1].Name != "Tonight" || periods[1].IsDaytime {
+		t.Errorf("wrong daily periods: got %+v", periods)
+	}
+	if periods[0].DetailedForecast != "Sunny, with a high near 88." {
+		t.Errorf("wrong detailed forecast: got %v", periods[0].DetailedForecast)
+	}
+}
+
+func TestSQLiteStoreHistory(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Second)
+	writeTestSQLiteWeather(t, s, "GopherCon", now)
+
+	readings, err := s.History(ctx, "GopherCon", now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 3 {
+		t.Fatalf("wrong number of readings: got %v want %v", len(readings), 3)
+	}
+	if readings[0].Temperature != 29 || readings[1].Source != "forecast" || readings[2].Provider != "nws" || !readings[2].ObservedAt.Equal(now) {
+		t.Errorf("wrong readings: got %+v", readings)
+	}
+
+	readings, err = s.History(ctx, "GopherCon", now.Add(-90*time.Minute), now.Add(-30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 1 || readings[0].Temperature != 30 {
+		t.Errorf("wrong readings in range: got %+v", readings)
+	}
+}
+
+func TestSQLiteStoreEvents(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	lat, lng := 39.7392, -104.9903
+	gophercon := &Event{Slug: "gophercon", Name: "GopherCon", Location: "Denver, Colorado, USA", Lat: &lat, Lng: &lng, Start: "2018-08-27", Active: true}
+	golab := &Event{Slug: "golab", Name: "GoLab", Location: "Florence, Italy", Active: true}
+
+	for _, e := range []*Event{gophercon, golab} {
+		if err := s.CreateEvent(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	duplicates := []*Event{
+		{Slug: "gophercon", Name: "GopherCon 2018", Location: "Denver, Colorado, USA"},
+		{Slug: "gophercon-2018", Name: "GopherCon", Location: "Denver, Colorado, USA"},
+	}
+	for _, e := range duplicates {
+		if err := s.CreateEvent(ctx, e); err != errEventExists {
+			t.Errorf("wrong error for a duplicate event %s: got %v want %v", e.Slug, err, errEventExists)
+		}
+	}
+
+	e, err := s.Event(ctx, "gophercon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.Name != "GopherCon" || e.Lat == nil || *e.Lat != lat || e.Start != "2018-08-27" || e.End != "" {
+		t.Errorf("wrong event: got %+v", e)
+	}
+
+	if e, err := s.Event(ctx, "gotham-go"); err != nil || e != nil {
+		t.Errorf("wrong result for an unknown event: got %+v, %v", e, err)
+	}
+
+	if ok, err := s.DeactivateEvent(ctx, "golab"); err != nil || !ok {
+		t.Errorf("wrong deactivate result: got %v, %v", ok, err)
+	}
+	if ok, err := s.DeactivateEvent(ctx, "gotham-go"); err != nil || ok {
+		t.Errorf("wrong deactivate result for an unknown event: got %v, %v", ok, err)
+	}
+
+	events, err := s.Events(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Slug != "gophercon" {
+		t.Errorf("wrong active events: got %+v", events)
+	}
+}
+
+func TestSQLiteStoreRenameEvent(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Second)
+	writeTestSQLiteWeather(t, s, "GopherCon", now)
+
+	lat, lng := 39.7392, -104.9903
+	e := &Event{Slug: "gophercon", Name: "GopherCon", Location: "Denver, Colorado, USA", Lat: &lat, Lng: &lng, Active: true}
+	if err := s.CreateEvent(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateEvent(ctx, &Event{Slug: "golab", Name: "GoLab", Location: "Florence, Italy", Active: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.UpdateEvent(ctx, "GopherCon", &Event{Slug: "gophercon", Name: "GoLab", Location: "Denver, Colorado, USA", Active: true}); err != errEventExists {
+		t.Errorf("wrong error renaming to a taken name: got %v want %v", err, errEventExists)
+	}
+
+	// The renamed event keeps its weather data and history; clearing
+	// the coordinates removes them.
+	renamed := &Event{Slug: "gophercon", Name: "GopherCon 2018", Location: "Denver, Colorado, USA", Active: true}
+	if err := s.UpdateEvent(ctx, "GopherCon", renamed); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Event(ctx, "gophercon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "GopherCon 2018" || got.Lat != nil {
+		t.Errorf("wrong renamed event: got %+v", got)
+	}
+
+	w, err := s.Weather(ctx, "GopherCon 2018")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Event != "GopherCon 2018" || w.Temperature != 31 || len(w.Alerts) != 2 {
+		t.Errorf("wrong weather after rename: got %+v", w)
+	}
+
+	readings, err := s.History(ctx, "GopherCon 2018", now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 3 {
+		t.Errorf("wrong number of readings after rename: got %v want %v", len(readings), 3)
+	}
+
+	periods, err := s.Forecast(ctx, "GopherCon 2018", 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(periods) != 2 {
+		t.Errorf("wrong number of periods after rename: got %v want %v", len(periods), 2)
+	}
+}
@@ -0,0 +1,504 @@
+package function
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kelseyhightower/weather-internal/database"
+	"github.com/kelseyhightower/weather-internal/firestoredb"
+	"github.com/kelseyhightower/weather-internal/secrets"
+	"github.com/lib/pq"
+	"go.opencensus.io/trace"
+)
+
+// Store reads the weather data stored by the weather-data-collector.
+type Store interface {
+	// Weather returns the latest weather and active alerts for an
+	// event.
+	Weather(ctx context.Context, event string) (*Weather, error)
+
+	// Forecast returns up to hours upcoming hourly forecast periods.
+	Forecast(ctx context.Context, event string, hours int) ([]Period, error)
+
+	// DailyForecast returns the forecast periods for the event days.
+	DailyForecast(ctx context.Context, event string) ([]Period, error)
+
+	// History returns the readings observed between from and to.
+	History(ctx context.Context, event string, from, to time.Time) ([]Reading, error)
+
+	// Events returns the active events in the events registry.
+	Events(ctx context.Context) ([]Event, error)
+
+	// Event returns the event with the given slug, or nil if there's
+	// no such event.
+	Event(ctx context.Context, slug string) (*Event, error)
+
+	// CreateEvent adds an event to the registry. It returns
+	// errEventExists when the slug or name is taken.
+	CreateEvent(ctx context.Context, e *Event) error
+
+	// UpdateEvent replaces the event with slug e.Slug. When the event
+	// is renamed from previousName its weather data is renamed too.
+	UpdateEvent(ctx context.Context, previousName string, e *Event) error
+
+	// DeactivateEvent stops collection for an event. ok is false when
+	// there's no such event.
+	DeactivateEvent(ctx context.Context, slug string) (ok bool, err error)
+}
+
+// openStore opens the Store selected by the STORE environment
+// variable: postgres, the default, for the Cloud SQL weather database,
+// firestore, which also works with the Firestore emulator, or sqlite
+// for the SQLite database file at SQLITE_PATH.
+func openStore(ctx context.Context, source secrets.Source) (Store, error) {
+	switch backend := os.Getenv("STORE"); backend {
+	case "", "postgres":
+		db, err := database.OpenPostgres(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+
+		// Google Cloud Functions ensures a single request per function
+		// invocation. Avoid exhausting database connections by limiting
+		// this function to a single database connection.
+		//
+		// See the cloud functions docs for more details:
+		//
+		//    https://cloud.google.com/functions/docs/sql
+		//
+		db.SetMaxIdleConns(1)
+		db.SetMaxOpenConns(1)
+
+		// Apply pending schema migrations on cold start when
+		// MIGRATE_ON_START is set, instead of running weather-migrate.
+		if os.Getenv("MIGRATE_ON_START") == "true" {
+			m := &database.Migrator{DB: db, Migrations: database.Migrations}
+			if _, err := m.Up(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		return &PostgresStore{DB: db}, nil
+	case "firestore":
+		client, err := firestoredb.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &FirestoreStore{Client: client}, nil
+	case "sqlite":
+		db, err := database.OpenSQLite(os.Getenv("SQLITE_PATH"))
+		if err != nil {
+			return nil, err
+		}
+
+		// SQLite databases are local, so they're always migrated.
+		m := &database.Migrator{DB: db, Migrations: database.Migrations, SQLite: true}
+		if _, err := m.Up(ctx); err != nil {
+			return nil, err
+		}
+
+		return &SQLiteStore{DB: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown STORE %q", backend)
+	}
+}
+
+// PostgresStore is a Store backed by the Cloud SQL weather database.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func (s *PostgresStore) Weather(ctx context.Context, event string) (*Weather, error) {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", weatherQuery),
+	}, "query")
+
+	defer span.End()
+
+	var w Weather
+
+	err := s.DB.QueryRow(weatherQuery, event).Scan(
+		&w.Event, &w.Location, &w.Temperature, &w.Source, &w.ObservedAt,
+		&w.Humidity, &w.WindSpeed, &w.WindDirection, &w.PrecipitationProbability,
+		&w.ShortForecast, &w.Icon, &w.IsDaytime)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, err
+	case err != nil:
+		return nil, err
+	}
+
+	w.Alerts, err = s.alerts(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+func (s *PostgresStore) alerts(ctx context.Context, event string) ([]Alert, error) {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", alertsQuery),
+	}, "query")
+
+	defer span.End()
+
+	rows, err := s.DB.Query(alertsQuery, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := make([]Alert, 0)
+	for rows.Next() {
+		var a Alert
+		if err := rows.Scan(&a.Type, &a.Severity, &a.Headline, &a.Expires); err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+
+	return alerts, rows.Err()
+}
+
+func (s *PostgresStore) Forecast(ctx context.Context, event string, hours int) ([]Period, error) {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", forecastQuery),
+	}, "query")
+
+	defer span.End()
+
+	rows, err := s.DB.Query(forecastQuery, event, hours)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := make([]Period, 0)
+	for rows.Next() {
+		var p Period
+		err := rows.Scan(&p.StartTime, &p.EndTime, &p.IsDaytime, &p.Temperature,
+			&p.Humidity, &p.WindSpeed, &p.WindDirection, &p.PrecipitationProbability,
+			&p.ShortForecast, &p.Icon)
+		if err != nil {
+			return nil, err
+		}
+		periods = append(periods, p)
+	}
+
+	return periods, rows.Err()
+}
+
+func (s *PostgresStore) DailyForecast(ctx context.Context, event string) ([]Period, error) {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", dailyForecastQuery),
+	}, "query")
+
+	defer span.End()
+
+	rows, err := s.DB.Query(dailyForecastQuery, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	periods := make([]Period, 0)
+	for rows.Next() {
+		var p Period
+		err := rows.Scan(&p.Name, &p.StartTime, &p.EndTime, &p.IsDaytime, &p.Temperature,
+			&p.WindSpeed, &p.WindDirection, &p.PrecipitationProbability,
+			&p.ShortForecast, &p.DetailedForecast, &p.Icon)
+		if err != nil {
+			return nil, err
+		}
+		periods = append(periods, p)
+	}
+
+	return periods, rows.Err()
+}
+
+func (s *PostgresStore) History(ctx context.Context, event string, from, to time.Time) ([]Reading, error) {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", historyQuery),
+	}, "query")
+
+	defer span.End()
+
+	rows, err := s.DB.Query(historyQuery, event, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	readings := make([]Reading, 0)
+	for rows.Next() {
+		var r Reading
+		if err := rows.Scan(&r.Temperature, &r.Source, &r.Provider, &r.ObservedAt); err != nil {
+			return nil, err
+		}
+		readings = append(readings, r)
+	}
+
+	return readings, rows.Err()
+}
+
+func (s *PostgresStore) Events(ctx context.Context) ([]Event, error) {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", eventsQuery),
+	}, "query")
+
+	defer span.End()
+
+	rows, err := s.DB.Query(eventsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]Event, 0)
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *e)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *PostgresStore) Event(ctx context.Context, slug string) (*Event, error) {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", eventQuery),
+	}, "query")
+
+	defer span.End()
+
+	e, err := scanEvent(s.DB.QueryRow(eventQuery, slug))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (s *PostgresStore) CreateEvent(ctx context.Context, e *Event) error {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", createEventQuery),
+	}, "query")
+
+	defer span.End()
+
+	_, err := s.DB.Exec(createEventQuery, e.Slug, e.Name, e.Location, e.Lat, e.Lng,
+		e.Timezone, e.Provider, nullDate(e.Start), nullDate(e.End), e.Active)
+	return eventError(err)
+}
+
+func (s *PostgresStore) UpdateEvent(ctx context.Context, previousName string, e *Event) error {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", updateEventQuery),
+	}, "query")
+
+	defer span.End()
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(updateEventQuery, e.Slug, e.Name, e.Location, e.Lat, e.Lng,
+		e.Timezone, e.Provider, nullDate(e.Start), nullDate(e.End), e.Active)
+	if err != nil {
+		tx.Rollback()
+		return eventError(err)
+	}
+
+	// The weather data is keyed by event name; move it to the new name
+	// so the event keeps its history.
+	if e.Name != previousName {
+		for _, q := range renameEventQueries {
+			if _, err := tx.Exec(q, previousName, e.Name); err != nil {
+				tx.Rollback()
+				return eventError(err)
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) DeactivateEvent(ctx context.Context, slug string) (bool, error) {
+	_, span := trace.StartSpan(ctx, "cloud-sql")
+	span.AddAttributes(
+		trace.StringAttribute("cloudsql", "postgres"),
+		trace.StringAttribute("schema", "weather"),
+	)
+	span.Annotate([]trace.Attribute{
+		trace.StringAttribute("Query", deactivateEventQuery),
+	}, "query")
+
+	defer span.End()
+
+	result, err := s.DB.Exec(deactivateEventQuery, slug)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// scanEvent scans a row selected by eventColumns. Coordinates and
+// dates are optional.
+func scanEvent(row interface {
+	Scan(dest ...interface{}) error
+}) (*Event, error) {
+	var (
+		e          Event
+		lat, lng   sql.NullFloat64
+		start, end sql.NullString
+	)
+
+	err := row.Scan(&e.Name, &e.Slug, &e.Location, &lat, &lng, &e.Timezone,
+		&e.Provider, &start, &end, &e.Active)
+	if err != nil {
+		return nil, err
+	}
+
+	if lat.Valid && lng.Valid {
+		e.Lat, e.Lng = &lat.Float64, &lng.Float64
+	}
+	e.Start, e.End = start.String, end.String
+
+	return &e, nil
+}
+
+// nullDate stores empty event dates as NULL.
+func nullDate(date string) interface{} {
+	if date == "" {
+		return nil
+	}
+	return date
+}
+
+// eventError returns errEventExists for unique constraint violations.
+func eventError(err error) error {
+	if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+		return errEventExists
+	}
+	return err
+}
+
+var weatherQuery = `SELECT event, location, temperature, source, observed_at,
+    humidity, wind_speed, wind_direction, precipitation_probability, short_forecast, icon, is_daytime
+  FROM weather
+  WHERE event = $1;`
+
+var forecastQuery = `SELECT start_time, end_time, is_daytime, temperature,
+    humidity, wind_speed, wind_direction, precipitation_probability, short_forecast, icon
+  FROM forecast
+  WHERE event = $1 AND end_time > now()
+  ORDER BY start_time
+  LIMIT $2;`
+
+var dailyForecastQuery = `SELECT name, start_time, end_time, is_daytime, temperature,
+    wind_speed, wind_direction, precipitation_probability, short_forecast, detailed_forecast, icon
+  FROM daily_forecast
+  WHERE event = $1 AND end_time > now()
+  ORDER BY start_time;`
+
+var historyQuery = `SELECT temperature, source, provider, observed_at
+  FROM readings
+  WHERE event = $1 AND observed_at >= $2 AND observed_at <= $3
+  ORDER BY observed_at;`
+
+var alertsQuery = `SELECT alert_type, severity, headline, expires_at
+  FROM alerts
+  WHERE event = $1 AND (expires_at IS NULL OR expires_at > now())
+  ORDER BY expires_at NULLS LAST;`
+
+var eventColumns = `name, slug, location, lat, lng, timezone, provider,
+    to_char(start_date, 'YYYY-MM-DD'), to_char(end_date, 'YYYY-MM-DD'), active`
+
+var eventsQuery = `SELECT ` + eventColumns + `
+  FROM events
+  WHERE active
+  ORDER BY name;`
+
+var eventQuery = `SELECT ` + eventColumns + `
+  FROM events
+  WHERE slug = $1;`
+
+var createEventQuery = `INSERT INTO events (slug, name, location, lat, lng, timezone, provider,
+    start_date, end_date, active)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`
+
+var updateEventQuery = `UPDATE events
+  SET name = $2, location = $3, lat = $4, lng = $5, timezone = $6, provider = $7,
+    start_date = $8, end_date = $9, active = $10
+  WHERE slug = $1;`
+
+var deactivateEventQuery = `UPDATE events SET active = false WHERE slug = $1;`
+
+// renameEventQueries move the weather data for an event from the name
+// $1 to $2.
+var renameEventQueries = []string{
+	`UPDATE weather SET event = $2 WHERE event = $1;`,
+	`UPDATE forecast SET event = $2 WHERE event = $1;`,
+	`UPDATE daily_forecast SET event = $2 WHERE event = $1;`,
+	`UPDATE alerts SET event = $2 WHERE event = $1;`,
+	`UPDATE readings SET event = $2 WHERE event = $1;`,
+	`UPDATE geocodes SET event = $2 WHERE event = $1;`,
+}
@@ -0,0 +1,109 @@
+package function
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestPostgresStoreWeather(t *testing.T) {
+	s, tdb := newTestPostgresStore()
+
+	observedAt := time.Date(2018, 8, 28, 16, 0, 0, 0, time.UTC)
+	expires := time.Date(2018, 8, 28, 20, 0, 0, 0, time.UTC)
+	tdb.rows[weatherQuery] = [][]driver.Value{
+		{"GopherCon", "Denver, Colorado, USA", 31.1, "observed", observedAt, int64(40), 8.0, "NW", int64(0), "Sunny", "", true},
+	}
+	tdb.rows[alertsQuery] = [][]driver.Value{
+		{"Heat Advisory", "Moderate", "Heat Advisory until 8 PM", expires},
+	}
+
+	w, err := s.Weather(context.Background(), "GopherCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Temperature != 31.1 || w.Source != "observed" || !w.ObservedAt.Equal(observedAt) || w.Humidity != 40 || w.WindSpeed != 8 {
+		t.Errorf("wrong weather: got %+v", w)
+	}
+
+	if len(w.Alerts) != 1 {
+		t.Fatalf("wrong number of alerts: got %v want %v", len(w.Alerts), 1)
+	}
+	a := w.Alerts[0]
+	if a.Type != "Heat Advisory" || a.Severity != "Moderate" || a.Headline != "Heat Advisory until 8 PM" || !a.Expires.Equal(expires) {
+		t.Errorf("wrong alert: got %+v", a)
+	}
+
+	// The alerts are always a list so clients don't need to handle null.
+	delete(tdb.rows, alertsQuery)
+	w, err = s.Weather(context.Background(), "GopherCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Alerts == nil || len(w.Alerts) != 0 {
+		t.Errorf("wrong alerts: got %#v want an empty list", w.Alerts)
+	}
+}
+
+func TestPostgresStoreForecast(t *testing.T) {
+	s, tdb := newTestPostgresStore()
+
+	start := time.Date(2018, 8, 28, 16, 0, 0, 0, time.UTC)
+	tdb.rows[forecastQuery] = [][]driver.Value{
+		{start, start.Add(time.Hour), true, 22.2, int64(40), 8.0, "NW", int64(0), "Sunny", ""},
+		{start.Add(time.Hour), start.Add(2 * time.Hour), true, 23.9, int64(35), 16.0, "W", int64(20), "Mostly Sunny", ""},
+	}
+
+	periods, err := s.Forecast(context.Background(), "GopherCon", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(periods) != 2 {
+		t.Fatalf("wrong number of periods: got %v want %v", len(periods), 2)
+	}
+	if !periods[0].StartTime.Equal(start) || !periods[1].EndTime.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("wrong period times: got %+v", periods)
+	}
+	p := periods[1]
+	if p.Temperature != 23.9 || p.Humidity != 35 || p.WindSpeed != 16 || p.PrecipitationProbability != 20 || p.ShortForecast != "Mostly Sunny" {
+		t.Errorf("wrong period: got %+v", p)
+	}
+
+	queries := tdb.statements(forecastQuery)
+	if len(queries) != 1 || queries[0].args[0] != "GopherCon" || queries[0].args[1] != int64(2) {
+		t.Errorf("wrong forecast query: got %+v", queries)
+	}
+}
+
+func TestPostgresStoreHistory(t *testing.T) {
+	s, tdb := newTestPostgresStore()
+
+	observedAt := time.Date(2018, 8, 28, 12, 0, 0, 0, time.UTC)
+	tdb.rows[historyQuery] = [][]driver.Value{
+		{20.0, "observed", "nws", observedAt},
+		{25.0, "forecast", "nws", observedAt.Add(time.Hour)},
+	}
+
+	from, to := time.Date(2018, 8, 28, 0, 0, 0, 0, time.UTC), time.Date(2018, 8, 29, 0, 0, 0, 0, time.UTC)
+	readings, err := s.History(context.Background(), "GopherCon", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(readings) != 2 {
+		t.Fatalf("wrong number of readings: got %v want %v", len(readings), 2)
+	}
+	if readings[0].Temperature != 20 || readings[0].Source != "observed" || !readings[0].ObservedAt.Equal(observedAt) {
+		t.Errorf("wrong reading: got %+v", readings[0])
+	}
+	if readings[1].Temperature != 25 || readings[1].Source != "forecast" {
+		t.Errorf("wrong reading: got %+v", readings[1])
+	}
+
+	queries := tdb.statements(historyQuery)
+	if len(queries) != 1 || queries[0].args[0] != "GopherCon" || queries[0].args[1] != from || queries[0].args[2] != to {
+		t.Errorf("wrong history query: got %+v", queries)
+	}
+}
@@ -0,0 +1,71 @@
+package function
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// Readings are stored in canonical metric units: temperatures in
+// degrees Celsius and wind speeds in kilometres per hour. They are
+// converted to the units requested with the units query parameter
+// before they are returned.
+const (
+	metric   = "metric"
+	imperial = "imperial"
+)
+
+// defaultUnits preserves the Fahrenheit readings returned before units
+// were configurable.
+const defaultUnits = imperial
+
+// parseUnits returns the units requested by the units query parameter.
+func parseUnits(r *http.Request) (string, error) {
+	switch units := r.FormValue("units"); units {
+	case "":
+		return defaultUnits, nil
+	case metric, imperial:
+		return units, nil
+	default:
+		return "", fmt.Errorf("invalid units query parameter %q: must be metric or imperial", units)
+	}
+}
+
+// convertTemperature converts a temperature in degrees Celsius to units,
+// rounded to one decimal place.
+func convertTemperature(celsius float64, units string) float64 {
+	if units == imperial {
+		return round(celsius*9/5 + 32)
+	}
+	return round(celsius)
+}
+
+// convertWindSpeed converts a wind speed in kilometres per hour to
+// units, rounded to one decimal place.
+func convertWindSpeed(kmh float64, units string) float64 {
+	if units == imperial {
+		return round(kmh / 1.609344)
+	}
+	return round(kmh)
+}
+
+func round(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+func (w *Weather) convert(units string) {
+	w.Units = units
+	w.Temperature = convertTemperature(w.Temperature, units)
+	w.WindSpeed = convertWindSpeed(w.WindSpeed, units)
+}
+
+func (p *Period) convert(units string) {
+	p.Units = units
+	p.Temperature = convertTemperature(p.Temperature, units)
+	p.WindSpeed = convertWindSpeed(p.WindSpeed, units)
+}
+
+func (r *Reading) convert(units string) {
+	r.Units = units
+	r.Temperature = convertTemperature(r.Temperature, units)
+}
@@ -0,0 +1,57 @@
+package function
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseUnits(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"/api?event=GopherCon", imperial},
+		{"/api?event=GopherCon&units=imperial", imperial},
+		{"/api?event=GopherCon&units=metric", metric},
+	}
+
+	for _, tt := range tests {
+		got, err := parseUnits(httptest.NewRequest("GET", tt.url, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("wrong units for %v: got %v want %v", tt.url, got, tt.want)
+		}
+	}
+
+	if _, err := parseUnits(httptest.NewRequest("GET", "/api?units=kelvin", nil)); err == nil {
+		t.Errorf("expected an error for unsupported units")
+	}
+}
+
+func TestWeatherConvert(t *testing.T) {
+	tests := []struct {
+		units       string
+		temperature float64
+		windSpeed   float64
+	}{
+		{metric, 22.2, 8},
+		{imperial, 72, 5},
+	}
+
+	for _, tt := range tests {
+		w := Weather{Temperature: 22.2222, WindSpeed: 8.04672}
+		w.convert(tt.units)
+
+		if w.Units != tt.units {
+			t.Errorf("wrong units: got %v want %v", w.Units, tt.units)
+		}
+		if w.Temperature != tt.temperature {
+			t.Errorf("wrong %v temperature: got %v want %v", tt.units, w.Temperature, tt.temperature)
+		}
+		if w.WindSpeed != tt.windSpeed {
+			t.Errorf("wrong %v wind speed: got %v want %v", tt.units, w.WindSpeed, tt.windSpeed)
+		}
+	}
+}
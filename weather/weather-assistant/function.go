@@ -8,31 +8,61 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"sync"
+	"path"
 
 	"cloud.google.com/go/logging"
 	"contrib.go.opencensus.io/exporter/stackdriver/propagation"
+	"github.com/kelseyhightower/weather-internal/conditions"
+	"github.com/kelseyhightower/weather-internal/health"
+	"github.com/kelseyhightower/weather-internal/stackdriver"
 	"go.opencensus.io/trace"
 )
 
 var (
-	logger        *logging.Logger
-	once          sync.Once
-	weatherApiUrl string
+	service *Service
+
+	// initService runs configFunc until it succeeds.
+	initService = health.NewInitializer(func() error { return configFunc() })
 )
 
-// configFunc sets the global configuration; it's overridden in tests.
+// configFunc sets the global service; it's overridden in tests.
 var configFunc = defaultConfigFunc
 
+// Logger logs structured log entries; *logging.Logger satisfies it.
+type Logger interface {
+	Log(e logging.Entry)
+	Flush() error
+}
+
+// WeatherAPI retrieves the weather for an event from the weather-api.
+type WeatherAPI interface {
+	Weather(ctx context.Context, event, units string) (*Weather, error)
+}
+
+// Service answers Dialogflow fulfillment webhook requests. F uses the
+// service created by configFunc; tests create their own.
+type Service struct {
+	API    WeatherAPI
+	Logger Logger
+}
+
 func F(w http.ResponseWriter, r *http.Request) {
-	once.Do(func() {
-		if err := configFunc(); err != nil {
-			panic(err)
-		}
-	})
+	if path.Base(r.URL.Path) == "healthz" {
+		initService.ServeHealth(w, r)
+		return
+	}
+
+	if err := initService.Do(); err != nil {
+		initService.ServeUnavailable(w, err)
+		return
+	}
 
-	defer logger.Flush()
+	defer service.Logger.Flush()
 
+	service.ServeHTTP(w, r)
+}
+
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var span *trace.Span
 
@@ -48,7 +78,7 @@ func F(w http.ResponseWriter, r *http.Request) {
 
 	data, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		logger.Log(logging.Entry{
+		s.Logger.Log(logging.Entry{
 			Payload:  err.Error(),
 			Severity: logging.Error,
 		})
@@ -60,7 +90,7 @@ func F(w http.ResponseWriter, r *http.Request) {
 	var webhookRequest WebhookRequest
 	err = json.Unmarshal(data, &webhookRequest)
 	if err != nil {
-		logger.Log(logging.Entry{
+		s.Logger.Log(logging.Entry{
 			Payload:  err.Error(),
 			Severity: logging.Error,
 		})
@@ -70,9 +100,11 @@ func F(w http.ResponseWriter, r *http.Request) {
 
 	parameters := webhookRequest.QueryResult.Parameters
 
-	weather, err := getWeather(ctx, parameters["event"])
+	units := unitsForQuery(webhookRequest.QueryResult)
+
+	weather, err := s.API.Weather(ctx, parameters["event"], units)
 	if err != nil {
-		logger.Log(logging.Entry{
+		s.Logger.Log(logging.Entry{
 			Payload:  err.Error(),
 			Severity: logging.Error,
 		})
@@ -80,14 +112,28 @@ func F(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Only call the temperature current when it was observed; otherwise
+	// it's the forecast for the current hour.
+	kind := "forecast"
+	if weather.Source == "observed" {
+		kind = "current"
+	}
+
+	text := fmt.Sprintf("The %s temperature in %s is %.0f degrees %s and %s.",
+		kind, weather.Location, weather.Temperature, temperatureUnitName(weather.Units),
+		conditions.Summary(weather.ShortForecast, weather.WindSpeed, weather.Units))
+
+	for _, a := range weather.Alerts {
+		text += fmt.Sprintf(" There is an active %s.", a.Type)
+	}
+
 	response := &WebhookResponse{
-		FulfillmentText: fmt.Sprintf("The current temperature in %s is %d degrees fahrenheit.",
-			weather.Location, weather.Temperature),
+		FulfillmentText: text,
 	}
 
 	data, err = json.MarshalIndent(response, "", " ")
 	if err != nil {
-		logger.Log(logging.Entry{
+		s.Logger.Log(logging.Entry{
 			Payload:  err.Error(),
 			Severity: logging.Error,
 		})
@@ -99,13 +145,26 @@ func F(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func getWeather(ctx context.Context, event string) (*Weather, error) {
+// APIClient is a WeatherAPI client for the weather-api function at URL.
+type APIClient struct {
+	URL    string
+	Client *http.Client
+}
+
+func (c *APIClient) Weather(ctx context.Context, event, units string) (*Weather, error) {
 	ctx, span := trace.StartSpan(ctx, "weather-api")
 	defer span.End()
 
-	u := fmt.Sprintf("%s?event=%s", weatherApiUrl, url.QueryEscape(event))
+	u := fmt.Sprintf("%s?event=%s&units=%s", c.URL, url.QueryEscape(event), units)
 
-	resp, err := http.Get(u)
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request = request.WithContext(ctx)
+
+	resp, err := c.Client.Do(request)
 	if err != nil {
 		return nil, err
 	}
@@ -129,21 +188,24 @@ func getWeather(ctx context.Context, event string) (*Weather, error) {
 }
 
 func defaultConfigFunc() error {
-	var err error
-
-	weatherApiUrl = os.Getenv("WEATHER_API_URL")
+	weatherApiUrl := os.Getenv("WEATHER_API_URL")
 	if weatherApiUrl == "" {
 		return fmt.Errorf("WEATHER_API_URL environment variable unset or missing")
 	}
 
-	if err := EnableStackdriverTrace(); err != nil {
+	if err := stackdriver.EnableTrace(); err != nil {
 		return err
 	}
 
-	logger, err = NewStackdriverLogger()
+	logger, err := stackdriver.NewLogger()
 	if err != nil {
 		return err
 	}
 
+	service = &Service{
+		API:    &APIClient{URL: weatherApiUrl, Client: http.DefaultClient},
+		Logger: logger,
+	}
+
 	return nil
 }
@@ -0,0 +1,140 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/logging"
+)
+
+type testLogger struct {
+	entries []logging.Entry
+}
+
+func (l *testLogger) Log(e logging.Entry) {
+	l.entries = append(l.entries, e)
+}
+
+func (l *testLogger) Flush() error {
+	return nil
+}
+
+type testAPI struct {
+	weather *Weather
+	err     error
+
+	event, units string
+}
+
+func (a *testAPI) Weather(ctx context.Context, event, units string) (*Weather, error) {
+	a.event, a.units = event, units
+	if a.err != nil {
+		return nil, a.err
+	}
+	w := *a.weather
+	w.Units = units
+	return &w, nil
+}
+
+func webhookRequest(languageCode, event string) *http.Request {
+	body := `{"queryResult": {"action": "weather", "languageCode": "` + languageCode +
+		`", "parameters": {"event": "` + event + `"}}}`
+	return httptest.NewRequest("POST", "/", strings.NewReader(body))
+}
+
+func TestServiceFulfillment(t *testing.T) {
+	api := &testAPI{weather: &Weather{
+		Event:         "GopherCon",
+		Location:      "Denver, Colorado, USA",
+		Temperature:   88,
+		Source:        "observed",
+		ShortForecast: "Sunny",
+		Alerts:        []Alert{{Type: "Heat Advisory"}},
+	}}
+	s := &Service{API: api, Logger: &testLogger{}}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, webhookRequest("en-US", "GopherCon"))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+
+	if api.event != "GopherCon" || api.units != imperial {
+		t.Errorf("wrong weather api request: got %v %v want %v %v", api.event, api.units, "GopherCon", imperial)
+	}
+
+	var response WebhookResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "The current temperature in Denver, Colorado, USA is 88 degrees fahrenheit and sunny, calm. There is an active Heat Advisory."
+	if response.FulfillmentText != want {
+		t.Errorf("wrong fulfillment text: got %q want %q", response.FulfillmentText, want)
+	}
+}
+
+func TestServiceForecastFulfillment(t *testing.T) {
+	api := &testAPI{weather: &Weather{Location: "Florence, Italy", Temperature: 31, Source: "forecast"}}
+	s := &Service{API: api, Logger: &testLogger{}}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, webhookRequest("it", "GoLab"))
+
+	var response WebhookResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "The forecast temperature in Florence, Italy is 31 degrees celsius and calm."
+	if response.FulfillmentText != want {
+		t.Errorf("wrong fulfillment text: got %q want %q", response.FulfillmentText, want)
+	}
+}
+
+func TestServiceErrors(t *testing.T) {
+	s := &Service{API: &testAPI{err: errors.New("connection refused")}, Logger: &testLogger{}}
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader("{")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code for an invalid request: got %v want %v", w.Code, http.StatusBadRequest)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, webhookRequest("en", "GopherCon"))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wrong status code for an api error: got %v want %v", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestAPIClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("event") != "CapitalGo" || r.FormValue("units") != metric {
+			http.Error(w, "unknown event", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"event": "CapitalGo", "units": "metric", "temperature": 18.5}`))
+	}))
+	defer ts.Close()
+
+	c := &APIClient{URL: ts.URL, Client: ts.Client()}
+
+	weather, err := c.Weather(context.Background(), "CapitalGo", metric)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weather.Temperature != 18.5 {
+		t.Errorf("wrong temperature: got %v want %v", weather.Temperature, 18.5)
+	}
+
+	if _, err := c.Weather(context.Background(), "CapitalGo", imperial); err == nil {
+		t.Errorf("expected an error for a non 200 response")
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/aws/aws-sdk-go v1.15.22 // indirect
 	github.com/golang/protobuf v1.2.0 // indirect
 	github.com/googleapis/gax-go v2.0.0+incompatible // indirect
+	github.com/kelseyhightower/weather-internal v0.0.0
 	go.opencensus.io v0.15.0
 	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d // indirect
 	golang.org/x/oauth2 v0.0.0-20180821212333-d2e6202438be // indirect
@@ -17,3 +18,5 @@ require (
 	google.golang.org/genproto v0.0.0-20180817151627-c66870c02cf8
 	google.golang.org/grpc v1.14.0 // indirect
 )
+
+replace github.com/kelseyhightower/weather-internal => ../internal
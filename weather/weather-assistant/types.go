@@ -1,9 +1,20 @@
 package function
 
 type Weather struct {
-	Event       string `json:"event"`
-	Location    string `json:"location"`
-	Temperature int    `json:"temperature"`
+	Event         string  `json:"event"`
+	Location      string  `json:"location"`
+	Units         string  `json:"units"`
+	Temperature   float64 `json:"temperature"`
+	Source        string  `json:"source"`
+	WindSpeed     float64 `json:"windSpeed"`
+	ShortForecast string  `json:"shortForecast"`
+	Alerts        []Alert `json:"alerts"`
+}
+
+type Alert struct {
+	Type     string `json:"type"`
+	Severity string `json:"severity"`
+	Headline string `json:"headline"`
 }
 
 type WebhookResponse struct {
@@ -15,6 +26,7 @@ type WebhookRequest struct {
 }
 
 type QueryResult struct {
-	Action     string            `json:"action"`
-	Parameters map[string]string `json:"parameters"`
+	Action       string            `json:"action"`
+	Parameters   map[string]string `json:"parameters"`
+	LanguageCode string            `json:"languageCode"`
 }
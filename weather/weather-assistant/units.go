@@ -0,0 +1,33 @@
+package function
+
+import (
+	"strings"
+)
+
+const (
+	metric   = "metric"
+	imperial = "imperial"
+)
+
+// unitsForQuery returns the units to answer a query in. An explicit
+// units parameter wins; otherwise US English speakers get imperial
+// units and everyone else gets metric.
+func unitsForQuery(q QueryResult) string {
+	switch units := q.Parameters["units"]; units {
+	case metric, imperial:
+		return units
+	}
+
+	switch strings.ToLower(q.LanguageCode) {
+	case "", "en", "en-us":
+		return imperial
+	}
+	return metric
+}
+
+func temperatureUnitName(units string) string {
+	if units == metric {
+		return "celsius"
+	}
+	return "fahrenheit"
+}
@@ -0,0 +1,27 @@
+package function
+
+import (
+	"testing"
+)
+
+func TestUnitsForQuery(t *testing.T) {
+	tests := []struct {
+		languageCode string
+		parameters   map[string]string
+		want         string
+	}{
+		{"en", nil, imperial},
+		{"en-US", nil, imperial},
+		{"en-GB", nil, metric},
+		{"de", nil, metric},
+		{"de", map[string]string{"units": "imperial"}, imperial},
+		{"en-US", map[string]string{"units": "metric"}, metric},
+	}
+
+	for _, tt := range tests {
+		q := QueryResult{LanguageCode: tt.languageCode, Parameters: tt.parameters}
+		if got := unitsForQuery(q); got != tt.want {
+			t.Errorf("wrong units for %v %v: got %v want %v", tt.languageCode, tt.parameters, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// messagePublishedType is the CloudEvents type of Pub/Sub messages
+// delivered by Eventarc.
+const messagePublishedType = "google.cloud.pubsub.topic.v1.messagePublished"
+
+// maxCloudEventSize is the largest request body accepted by
+// ServeCloudEvent; Pub/Sub messages are limited to 10MB.
+const maxCloudEventSize = 10 << 20
+
+// cloudEvent is a CloudEvents 1.0 event in the JSON event format.
+//
+// See the CloudEvents spec for more details:
+//
+//	https://github.com/cloudevents/spec/blob/v1.0/spec.md
+//	https://github.com/cloudevents/spec/blob/v1.0/http-protocol-binding.md
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+	DataBase64      []byte          `json:"data_base64"`
+}
+
+// messagePublishedData is the data of a messagePublished CloudEvent,
+// which is also the body of a Pub/Sub push subscription request.
+type messagePublishedData struct {
+	Message struct {
+		Data        []byte            `json:"data"`
+		Attributes  map[string]string `json:"attributes"`
+		MessageID   string            `json:"messageId"`
+		PublishTime time.Time         `json:"publishTime"`
+	} `json:"message"`
+	Subscription    string `json:"subscription"`
+	DeliveryAttempt int    `json:"deliveryAttempt"`
+}
+
+// CloudEvent is the entry point for HTTP deployments behind Eventarc,
+// Knative or a Pub/Sub push subscription. It collects the weather data
+// for the event in the request the same way F does.
+func CloudEvent(w http.ResponseWriter, r *http.Request) {
+	if err := initService.Do(); err != nil {
+		initService.ServeUnavailable(w, err)
+		return
+	}
+
+	defer service.Logger.Flush()
+
+	service.ServeCloudEvent(w, r)
+}
+
+// ServeCloudEvent collects the weather data for a CloudEvent in binary
+// or structured mode, or a Pub/Sub push subscription request. Requests
+// that fail with a transient error get a 500 response so they're
+// redelivered.
+func (s *Service) ServeCloudEvent(w http.ResponseWriter, r *http.Request) {
+	meta, m, err := decodeCloudEvent(r)
+	if err != nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  err.Error(),
+			Severity: logging.Error,
+		})
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := newMetadataContext(r.Context(), meta)
+
+	if err := s.Collect(ctx, m); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeCloudEvent returns the metadata and payload of the event in r.
+// The payload of a messagePublished event or push request is the Pub/Sub
+// message data; for any other event type it's the event data itself.
+func decodeCloudEvent(r *http.Request) (*Metadata, PubSubMessage, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxCloudEventSize))
+	if err != nil {
+		return nil, PubSubMessage{}, fmt.Errorf("error reading cloud event: %v", err)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var e cloudEvent
+	switch {
+	case r.Header.Get("ce-specversion") != "":
+		// Binary mode: the attributes are headers and the body is the
+		// event data.
+		e = cloudEvent{
+			SpecVersion:     r.Header.Get("ce-specversion"),
+			ID:              r.Header.Get("ce-id"),
+			Source:          r.Header.Get("ce-source"),
+			Type:            r.Header.Get("ce-type"),
+			Time:            r.Header.Get("ce-time"),
+			DataContentType: r.Header.Get("Content-Type"),
+			Data:            body,
+		}
+	case mediaType == "application/cloudevents+json":
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, PubSubMessage{}, fmt.Errorf("invalid structured cloud event: %v", err)
+		}
+		if e.DataBase64 != nil {
+			e.Data = e.DataBase64
+		}
+	default:
+		return decodeMessagePublished(body, "", "")
+	}
+
+	if e.SpecVersion != "1.0" {
+		return nil, PubSubMessage{}, fmt.Errorf("unsupported cloud event specversion %q", e.SpecVersion)
+	}
+	if e.ID == "" || e.Source == "" || e.Type == "" {
+		return nil, PubSubMessage{}, fmt.Errorf("invalid cloud event: id, source and type are required")
+	}
+
+	if e.Type == messagePublishedType {
+		return decodeMessagePublished(e.Data, e.Type, e.Source)
+	}
+
+	meta := &Metadata{EventID: e.ID, EventType: e.Type, Resource: e.Source}
+	if e.Time != "" {
+		meta.Timestamp, err = time.Parse(time.RFC3339Nano, e.Time)
+		if err != nil {
+			return nil, PubSubMessage{}, fmt.Errorf("invalid cloud event time %q: %v", e.Time, err)
+		}
+	}
+
+	return meta, PubSubMessage{Data: e.Data}, nil
+}
+
+// decodeMessagePublished decodes a messagePublished event or push
+// request. The Pub/Sub message ID is used as the event ID, as it is for
+// background functions, so redeliveries through any transport are
+// detected as duplicates.
+func decodeMessagePublished(data []byte, eventType, source string) (*Metadata, PubSubMessage, error) {
+	var d messagePublishedData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, PubSubMessage{}, fmt.Errorf("invalid pubsub message: %v", err)
+	}
+
+	if d.Message.MessageID == "" {
+		return nil, PubSubMessage{}, fmt.Errorf("invalid pubsub message: missing messageId")
+	}
+
+	if eventType == "" {
+		eventType, source = pubsubPublishType, d.Subscription
+	}
+
+	meta := &Metadata{
+		EventID:         d.Message.MessageID,
+		Timestamp:       d.Message.PublishTime,
+		EventType:       eventType,
+		Resource:        source,
+		DeliveryAttempt: d.DeliveryAttempt,
+	}
+	if meta.DeliveryAttempt == 0 {
+		meta.DeliveryAttempt = messageDeliveryAttempt(PubSubMessage{Attributes: d.Message.Attributes})
+	}
+
+	return meta, PubSubMessage{Data: d.Message.Data, Attributes: d.Message.Attributes}, nil
+}
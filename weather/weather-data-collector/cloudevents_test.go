@@ -0,0 +1,153 @@
+package function
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cloudEventRequest returns a request with the body read from a
+// recorded sample in testdata.
+func cloudEventRequest(t *testing.T, name string, header map[string]string) *http.Request {
+	body, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+var binaryHeader = map[string]string{
+	"Content-Type":   "application/json",
+	"ce-specversion": "1.0",
+	"ce-id":          "186226215410470",
+	"ce-source":      "//pubsub.googleapis.com/projects/hightowerlabs/topics/weather-events",
+	"ce-type":        "google.cloud.pubsub.topic.v1.messagePublished",
+	"ce-time":        "2018-08-28T15:30:00.123Z",
+}
+
+func TestDecodeCloudEvent(t *testing.T) {
+	published := time.Date(2018, 8, 28, 15, 30, 0, 123000000, time.UTC)
+
+	tests := []struct {
+		name      string
+		header    map[string]string
+		eventID   string
+		eventType string
+		timestamp time.Time
+		attempt   int
+	}{
+		{"pubsub-push.json", map[string]string{"Content-Type": "application/json"},
+			"186226215410470", "google.pubsub.topic.publish", published, 2},
+		{"cloudevent-binary.json", binaryHeader,
+			"186226215410470", messagePublishedType, published, 0},
+		{"cloudevent-structured.json", map[string]string{"Content-Type": "application/cloudevents+json; charset=UTF-8"},
+			"186226215410470", messagePublishedType, published, 0},
+		{"cloudevent-weather-event.json", map[string]string{"Content-Type": "application/cloudevents+json"},
+			"d1a6c5e4-51b2-4a43-9d2e-6c7e5f4b2a10", "dev.knative.sources.ping", published.Truncate(time.Second), 0},
+	}
+
+	for _, tt := range tests {
+		meta, m, err := decodeCloudEvent(cloudEventRequest(t, tt.name, tt.header))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if meta.EventID != tt.eventID || meta.EventType != tt.eventType || !meta.Timestamp.Equal(tt.timestamp) || meta.DeliveryAttempt != tt.attempt {
+			t.Errorf("%s: wrong metadata: got %+v", tt.name, meta)
+		}
+
+		want := `{"event": "GopherCon", "location": "Denver, Colorado, USA"}`
+		if string(m.Data) != want {
+			t.Errorf("%s: wrong data: got %s want %s", tt.name, m.Data, want)
+		}
+	}
+}
+
+func TestDecodeCloudEventInvalid(t *testing.T) {
+	tests := []struct {
+		body   string
+		header map[string]string
+	}{
+		{`{"message": {"data": "e30="}}`, nil},
+		{`{"specversion": "0.3", "id": "1", "source": "/", "type": "test"}`, map[string]string{"Content-Type": "application/cloudevents+json"}},
+		{`{"specversion": "1.0", "source": "/", "type": "test"}`, map[string]string{"Content-Type": "application/cloudevents+json"}},
+		{`{"specversion": "1.0", "id": "1", "source": "/", "type": "test", "time": "yesterday"}`, map[string]string{"Content-Type": "application/cloudevents+json"}},
+		{`{}`, map[string]string{"ce-specversion": "1.0", "ce-id": "1", "ce-source": "/", "ce-type": messagePublishedType}},
+		{`not json`, nil},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+		for k, v := range tt.header {
+			r.Header.Set(k, v)
+		}
+
+		if _, _, err := decodeCloudEvent(r); err == nil {
+			t.Errorf("expected an error for %s", tt.body)
+		}
+	}
+}
+
+func TestServeCloudEvent(t *testing.T) {
+	s, store, provider, _ := newTestService()
+
+	w := httptest.NewRecorder()
+	s.ServeCloudEvent(w, cloudEventRequest(t, "cloudevent-binary.json", binaryHeader))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("wrong status code: got %v want %v: %s", w.Code, http.StatusNoContent, w.Body)
+	}
+	if _, ok := store.weather["GopherCon"]; !ok {
+		t.Errorf("missing weather for GopherCon")
+	}
+
+	// The same message pushed by a subscription is a duplicate.
+	provider.temperature = 35
+	w = httptest.NewRecorder()
+	s.ServeCloudEvent(w, cloudEventRequest(t, "pubsub-push.json", nil))
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("wrong status code: got %v want %v", w.Code, http.StatusNoContent)
+	}
+	if len(store.readings) != 1 {
+		t.Errorf("wrong number of readings: got %v want %v", len(store.readings), 1)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeCloudEvent(w, httptest.NewRequest("POST", "/", strings.NewReader(`not json`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status code for an invalid event: got %v want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestServeCloudEventTransientError(t *testing.T) {
+	s, _, provider, _ := newTestService()
+	provider.err = errors.New("connection reset by peer")
+
+	body := `{"event": "GopherCon", "location": "Denver, Colorado, USA"}`
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("ce-specversion", "1.0")
+	r.Header.Set("ce-id", "1")
+	r.Header.Set("ce-source", "/apis/v1/namespaces/default/pingsources/weather-gophercon")
+	r.Header.Set("ce-type", "dev.knative.sources.ping")
+	r.Header.Set("ce-time", time.Now().Format(time.RFC3339))
+
+	w := httptest.NewRecorder()
+	s.ServeCloudEvent(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wrong status code: got %v want %v", w.Code, http.StatusInternalServerError)
+	}
+}
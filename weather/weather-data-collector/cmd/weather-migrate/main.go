@@ -0,0 +1,62 @@
+// Command weather-migrate applies the weather database schema
+// migrations. It connects to the database the same way the functions
+// do, so it reads the PG* and SECRET_SOURCE environment variables from
+// env.yaml. With STORE=sqlite it migrates the SQLite database at
+// SQLITE_PATH instead.
+//
+// Usage:
+//
+//	weather-migrate          apply pending migrations
+//	weather-migrate -status  print the applied version
+//	weather-migrate -down N  revert the migrations newer than version N
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/kelseyhightower/weather-internal/database"
+)
+
+func main() {
+	down := flag.Int("down", -1, "revert the migrations newer than this version")
+	status := flag.Bool("status", false, "print the applied version and exit")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	m, err := database.NewMigrator(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer m.DB.Close()
+
+	if *status {
+		version, err := m.Version(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("schema version %d of %d", version, len(m.Migrations))
+		return
+	}
+
+	if *down >= 0 {
+		reverted, err := m.Down(ctx, *down)
+		for _, migration := range reverted {
+			log.Printf("reverted %d: %s", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	applied, err := m.Up(ctx)
+	for _, migration := range applied {
+		log.Printf("applied %d: %s", migration.Version, migration.Name)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
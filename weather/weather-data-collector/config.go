@@ -0,0 +1,138 @@
+package function
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the collector settings. defaultConfig is overridden by
+// the environment variables named below.
+type Config struct {
+	// ReadingsRetention is how long readings are kept in the readings
+	// table (READINGS_RETENTION). Zero keeps readings forever.
+	ReadingsRetention time.Duration
+
+	// ObservationMaxAge is the age after which an observation is
+	// considered stale and the forecast is used instead
+	// (OBSERVATION_MAX_AGE).
+	ObservationMaxAge time.Duration
+
+	// GeocodeCacheTTL is how long a geocoded event location is reused
+	// before the Google Maps API is queried again (GEOCODE_CACHE_TTL).
+	GeocodeCacheTTL time.Duration
+
+	// MapsRateInterval is the interval at which the instance can make
+	// Google Maps API requests (MAPS_RATE_INTERVAL), after an initial
+	// burst of up to MapsBurst requests (MAPS_BURST). Zero doesn't
+	// limit requests.
+	MapsRateInterval time.Duration
+	MapsBurst        int
+
+	// MaxEventAge is how long an event that fails with a transient
+	// error is retried (MAX_EVENT_AGE).
+	MaxEventAge time.Duration
+
+	// MaxDeliveryAttempts is how many times an event that fails with a
+	// transient error is delivered before it's dead-lettered
+	// (MAX_DELIVERY_ATTEMPTS). It bounds the retries of events whose
+	// publish time is unknown.
+	MaxDeliveryAttempts int
+
+	// ProcessedEventTTL is how long processed event IDs are remembered
+	// to detect duplicate deliveries (PROCESSED_EVENT_TTL). It must be
+	// longer than MaxEventAge so retries are still deduplicated.
+	ProcessedEventTTL time.Duration
+
+	// ClaimTimeout is how long an event is claimed while it's being
+	// processed (CLAIM_TIMEOUT). It must be longer than the function
+	// timeout and shorter than MaxEventAge, so an event whose instance
+	// crashed or timed out is still retried.
+	ClaimTimeout time.Duration
+
+	// DeadLetterTopic is the Pub/Sub topic events that fail permanently
+	// are published to (DEAD_LETTER_TOPIC). Failed events are only
+	// logged when it's empty.
+	DeadLetterTopic string
+
+	// EventsTopic is the Pub/Sub topic the dispatcher publishes events
+	// to (EVENTS_TOPIC). It triggers this function.
+	EventsTopic string
+}
+
+// defaultConfig holds the default settings. Venues rarely move so
+// geocoded locations are kept for a month, and events are published
+// every 5 minutes so events older than 10 minutes are stale. Claims
+// outlast the default 60 second function timeout and expire in time
+// for the retry of an event that timed out. Geocoded locations are
+// cached, so Maps API requests are rare and an instance makes at most
+// one a second after a burst of 5. Failing events are delivered at most
+// 5 times, the Pub/Sub default for dead-letter policies.
+var defaultConfig = Config{
+	ReadingsRetention:   90 * 24 * time.Hour,
+	ObservationMaxAge:   90 * time.Minute,
+	GeocodeCacheTTL:     30 * 24 * time.Hour,
+	MapsRateInterval:    time.Second,
+	MapsBurst:           5,
+	MaxEventAge:         10 * time.Minute,
+	MaxDeliveryAttempts: 5,
+	ProcessedEventTTL:   time.Hour,
+	ClaimTimeout:        2 * time.Minute,
+	EventsTopic:         "weather-events",
+}
+
+// configFromEnv returns defaultConfig overridden by the environment.
+func configFromEnv() (Config, error) {
+	c := defaultConfig
+
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"READINGS_RETENTION", &c.ReadingsRetention},
+		{"OBSERVATION_MAX_AGE", &c.ObservationMaxAge},
+		{"GEOCODE_CACHE_TTL", &c.GeocodeCacheTTL},
+		{"MAPS_RATE_INTERVAL", &c.MapsRateInterval},
+		{"MAX_EVENT_AGE", &c.MaxEventAge},
+		{"PROCESSED_EVENT_TTL", &c.ProcessedEventTTL},
+		{"CLAIM_TIMEOUT", &c.ClaimTimeout},
+	}
+
+	for _, d := range durations {
+		v := os.Getenv(d.name)
+		if v == "" {
+			continue
+		}
+
+		var err error
+		*d.value, err = time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("invalid %s environment variable: %v", d.name, err)
+		}
+	}
+
+	if v := os.Getenv("MAPS_BURST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return c, fmt.Errorf("invalid MAPS_BURST environment variable: %q must be a positive integer", v)
+		}
+		c.MapsBurst = n
+	}
+
+	if v := os.Getenv("MAX_DELIVERY_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return c, fmt.Errorf("invalid MAX_DELIVERY_ATTEMPTS environment variable: %q must be a positive integer", v)
+		}
+		c.MaxDeliveryAttempts = n
+	}
+
+	c.DeadLetterTopic = os.Getenv("DEAD_LETTER_TOPIC")
+
+	if v := os.Getenv("EVENTS_TOPIC"); v != "" {
+		c.EventsTopic = v
+	}
+
+	return c, nil
+}
@@ -0,0 +1,115 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/logging"
+)
+
+// dispatchSlack allows for jitter in the scheduler ticks. Without it an
+// event published at 12:00:01 with a 5 minute interval would miss the
+// 12:05:00 tick and wait for the next one.
+const dispatchSlack = 30 * time.Second
+
+// RegisteredEvent is an active event in the events registry.
+type RegisteredEvent struct {
+	WeatherEvent
+
+	Slug string
+
+	// PollInterval is how often the dispatcher publishes the event.
+	PollInterval time.Duration
+
+	// DispatchedAt is when the dispatcher last published the event; it's
+	// zero when the event has never been published.
+	DispatchedAt time.Time
+}
+
+// due reports whether the event should be published at t.
+func (e RegisteredEvent) due(t time.Time) bool {
+	return e.DispatchedAt.IsZero() || !t.Add(dispatchSlack).Before(e.DispatchedAt.Add(e.PollInterval))
+}
+
+// Dispatch is the entry point of the weather-dispatcher function. It's
+// triggered every minute by Cloud Scheduler, through the
+// weather-dispatch topic, and publishes the active events that are due
+// to the events topic, which triggers F.
+func Dispatch(ctx context.Context, m PubSubMessage) error {
+	if err := initService.Do(); err != nil {
+		log.Printf("initialization failed: %v", err)
+		return fmt.Errorf("initialization failed: %v", err)
+	}
+
+	defer service.Logger.Flush()
+
+	return service.Dispatch(ctx)
+}
+
+// Dispatch publishes a WeatherEvent for each active event whose poll
+// interval has elapsed. Every event is attempted; events that fail to
+// publish are logged and reported in the returned error, and are
+// published again on the next tick.
+func (s *Service) Dispatch(ctx context.Context) error {
+	events, err := s.Store.ActiveEvents(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	var published int
+	var failed []string
+	for _, e := range events {
+		if !e.due(now) {
+			continue
+		}
+
+		if err := s.publishEvent(ctx, e); err != nil {
+			s.Logger.Log(logging.Entry{
+				Payload:  fmt.Sprintf("error dispatching event %s: %v", e.Slug, err),
+				Severity: logging.Error,
+			})
+			failed = append(failed, e.Slug)
+			continue
+		}
+		published++
+
+		// The event has been published and will be collected. If it
+		// can't be marked it's only published again on the next tick,
+		// which is better than reporting an event that was delivered
+		// as failed.
+		if err := s.Store.MarkDispatched(ctx, e.Slug, now); err != nil {
+			s.Logger.Log(logging.Entry{
+				Payload:  fmt.Sprintf("error marking event %s as dispatched: %v", e.Slug, err),
+				Severity: logging.Warning,
+			})
+		}
+	}
+
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("dispatched %d of %d active events to %s", published, len(events), s.Config.EventsTopic),
+		Severity: logging.Info,
+	})
+
+	if len(failed) > 0 {
+		return fmt.Errorf("error dispatching %d events: %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// publishEvent publishes e to the events topic.
+func (s *Service) publishEvent(ctx context.Context, e RegisteredEvent) error {
+	data, err := json.Marshal(e.WeatherEvent)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Publisher.Publish(ctx, s.Config.EventsTopic, data, map[string]string{"slug": e.Slug})
+	return err
+}
@@ -0,0 +1,153 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/kelseyhightower/weather-internal/publisher"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestRegisteredEventDue(t *testing.T) {
+	now := time.Date(2018, 8, 28, 12, 5, 0, 0, time.UTC)
+
+	tests := []struct {
+		dispatchedAt time.Time
+		want         bool
+	}{
+		{time.Time{}, true},
+		{now.Add(-5 * time.Minute), true},
+		{now.Add(-5*time.Minute + time.Second), true},
+		{now.Add(-4 * time.Minute), false},
+		{now, false},
+	}
+
+	for _, tt := range tests {
+		e := RegisteredEvent{PollInterval: 5 * time.Minute, DispatchedAt: tt.dispatchedAt}
+		if got := e.due(now); got != tt.want {
+			t.Errorf("wrong due for %v: got %v want %v", tt.dispatchedAt, got, tt.want)
+		}
+	}
+}
+
+// newTestPublisher returns a publisher.PubSub for the hightowerlabs
+// project connected to a fake Pub/Sub server with the given topics.
+func newTestPublisher(t *testing.T, topics ...string) (*publisher.PubSub, *pstest.Server, func()) {
+	srv := pstest.NewServer()
+
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, "hightowerlabs", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range topics {
+		if _, err := client.CreateTopic(ctx, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &publisher.PubSub{Client: client}, srv, func() {
+		client.Close()
+	}
+}
+
+// failingPublisher fails to publish messages containing fail and
+// publishes the rest with Publisher.
+type failingPublisher struct {
+	publisher.Publisher
+	fail string
+}
+
+func (p *failingPublisher) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	if strings.Contains(string(data), p.fail) {
+		return "", errors.New("topic unavailable")
+	}
+	return p.Publisher.Publish(ctx, topic, data, attributes)
+}
+
+func TestServiceDispatch(t *testing.T) {
+	p, srv, cleanup := newTestPublisher(t, "weather-events")
+	defer cleanup()
+
+	s, store, _, _ := newTestService()
+	s.Publisher = &failingPublisher{Publisher: p, fail: "GothamGo"}
+
+	recent := time.Now().Add(-time.Minute)
+	store.events = []RegisteredEvent{
+		{Slug: "gophercon", PollInterval: 5 * time.Minute, WeatherEvent: WeatherEvent{Event: "GopherCon", Location: "Denver, Colorado, USA"}},
+		{Slug: "go-northwest", PollInterval: 5 * time.Minute, DispatchedAt: recent, WeatherEvent: WeatherEvent{Event: "Go Northwest", Location: "Seattle, Washington, USA"}},
+		{Slug: "gotham-go", PollInterval: time.Minute, WeatherEvent: WeatherEvent{Event: "GothamGo", Location: "New York, New York, USA"}},
+	}
+
+	err := s.Dispatch(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "gotham-go") {
+		t.Errorf("expected the gotham-go publish failure to be reported: got %v", err)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("wrong number of published events: got %v want %v", len(messages), 1)
+	}
+
+	var e WeatherEvent
+	if err := json.Unmarshal(messages[0].Data, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Event != "GopherCon" || e.Location != "Denver, Colorado, USA" {
+		t.Errorf("wrong published event: got %+v", e)
+	}
+	if messages[0].Attributes["slug"] != "gophercon" {
+		t.Errorf("wrong slug attribute: got %v", messages[0].Attributes["slug"])
+	}
+
+	if store.events[0].DispatchedAt.IsZero() {
+		t.Errorf("published event wasn't marked as dispatched")
+	}
+	if !store.events[1].DispatchedAt.Equal(recent) {
+		t.Errorf("event that wasn't due was dispatched")
+	}
+	if !store.events[2].DispatchedAt.IsZero() {
+		t.Errorf("failed event was marked as dispatched")
+	}
+}
+
+func TestServiceDispatchMarkError(t *testing.T) {
+	s, store, _, publisher := newTestService()
+	store.markErr = errors.New("connection refused")
+	store.events = []RegisteredEvent{
+		{Slug: "gophercon", PollInterval: 5 * time.Minute, WeatherEvent: WeatherEvent{Event: "GopherCon", Location: "Denver, Colorado, USA"}},
+	}
+
+	// The event was published, so it's dispatched even though it can't
+	// be marked.
+	if err := s.Dispatch(context.Background()); err != nil {
+		t.Errorf("unexpected error for an event that was published: %v", err)
+	}
+	if publisher.attributes["slug"] != "gophercon" {
+		t.Errorf("event wasn't published: got %v", publisher.attributes)
+	}
+
+	var warned bool
+	for _, e := range s.Logger.(*testLogger).entries {
+		if e.Severity == logging.Warning && strings.Contains(e.Payload.(string), "gophercon") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("expected a warning for the event that couldn't be marked")
+	}
+}
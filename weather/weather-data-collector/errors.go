@@ -0,0 +1,142 @@
+package function
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PermanentError is a collection failure that retrying won't fix, such
+// as a malformed event or a location that can't be geocoded. The event
+// is published to the dead-letter topic instead of being retried.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// TransientError is a collection failure that may succeed when retried,
+// such as an api.weather.gov outage or a lost database connection.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// QuotaError is a Google Maps API request rejected because the project
+// is over its quota (OVER_QUERY_LIMIT). It's returned as a
+// TransientError; the quota is replenished over time.
+type QuotaError struct {
+	// Method is the Maps API method that was called, for example
+	// "PlaceDetails".
+	Method string
+	Err    error
+}
+
+func (e *QuotaError) Error() string {
+	return e.Err.Error()
+}
+
+// permanentMapsStatuses are the Google Maps API response statuses that
+// won't change when the same request is retried.
+//
+// See the Google Maps docs for more details:
+//
+//	https://developers.google.com/maps/documentation/places/web-service/search-find-place#PlacesSearchStatus
+var permanentMapsStatuses = []string{
+	"ZERO_RESULTS",
+	"NOT_FOUND",
+	"INVALID_REQUEST",
+	"REQUEST_DENIED",
+}
+
+// classify wraps err in a PermanentError or a TransientError. Errors
+// that are already classified are returned unchanged and unknown errors
+// are assumed to be transient.
+func classify(err error) error {
+	switch e := err.(type) {
+	case *PermanentError, *TransientError:
+		return err
+	case *NoDataError:
+		return &PermanentError{Err: err}
+	case *QuotaError:
+		return &TransientError{Err: err}
+	case *StatusError:
+		// The client has already retried 429 and 5xx responses; any
+		// other 4xx response is a bad request.
+		if e.StatusCode >= 400 && e.StatusCode < 500 && e.StatusCode != 408 && e.StatusCode != 429 {
+			return &PermanentError{Err: err}
+		}
+		return &TransientError{Err: err}
+	}
+
+	status := mapsStatus(err)
+	for _, s := range permanentMapsStatuses {
+		if status == s {
+			return &PermanentError{Err: err}
+		}
+	}
+
+	return &TransientError{Err: err}
+}
+
+// mapsStatus returns the Google Maps API response status reported by
+// err: OK when err is nil and ERROR when err isn't a Maps API error,
+// such as a network failure. The maps client reports API errors as
+// "maps: STATUS - message".
+func mapsStatus(err error) string {
+	if err == nil {
+		return "OK"
+	}
+
+	msg := err.Error()
+	if !strings.HasPrefix(msg, "maps: ") {
+		return "ERROR"
+	}
+
+	msg = strings.TrimPrefix(msg, "maps: ")
+	i := strings.Index(msg, " - ")
+	if i < 1 {
+		return "ERROR"
+	}
+
+	status := msg[:i]
+	for _, r := range status {
+		if (r < 'A' || r > 'Z') && r != '_' {
+			return "ERROR"
+		}
+	}
+
+	return status
+}
+
+// retryable reports whether a transient failure of the event described
+// by meta should be retried at now. Events are retried until they are
+// older than maxAge or have been delivered maxAttempts times. Events
+// without metadata, or whose age or attempts are unknown, are retried;
+// a lost database connection mustn't drop them, and the subscription
+// retry policy still bounds their retries.
+func retryable(meta *Metadata, now time.Time, maxAge time.Duration, maxAttempts int) (bool, error) {
+	if meta == nil {
+		return true, nil
+	}
+
+	if meta.DeliveryAttempt >= maxAttempts {
+		return false, fmt.Errorf("event %s was delivered %d times, giving up after %d", meta.EventID, meta.DeliveryAttempt, maxAttempts)
+	}
+
+	if meta.Timestamp.IsZero() {
+		return true, nil
+	}
+
+	age := now.Sub(meta.Timestamp)
+	if age > maxAge {
+		return false, fmt.Errorf("event %s is %s old, giving up after %s", meta.EventID, age.Round(time.Second), maxAge)
+	}
+
+	return true, nil
+}
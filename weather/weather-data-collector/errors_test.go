@@ -0,0 +1,83 @@
+package function
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err       error
+		permanent bool
+	}{
+		{&PermanentError{Err: errors.New("invalid weather event")}, true},
+		{&TransientError{Err: errors.New("connection reset")}, false},
+		{&NoDataError{URL: "https://api.weather.gov/points/0,0", Reason: "not found"}, true},
+		{&StatusError{URL: "https://api.weather.gov", StatusCode: 400}, true},
+		{&StatusError{URL: "https://api.weather.gov", StatusCode: 429}, false},
+		{&StatusError{URL: "https://api.weather.gov", StatusCode: 503}, false},
+		{errors.New("maps: ZERO_RESULTS - "), true},
+		{errors.New("maps: OVER_QUERY_LIMIT - "), false},
+		{&QuotaError{Method: "PlaceDetails", Err: errors.New("maps: OVER_QUERY_LIMIT - ")}, false},
+		{errors.New("dial tcp: i/o timeout"), false},
+	}
+
+	for _, tt := range tests {
+		err := classify(tt.err)
+		_, permanent := err.(*PermanentError)
+		if permanent != tt.permanent {
+			t.Errorf("wrong classification for %q: got permanent %v want %v", tt.err, permanent, tt.permanent)
+		}
+		if err.Error() != tt.err.Error() {
+			t.Errorf("wrong error message: got %q want %q", err.Error(), tt.err.Error())
+		}
+	}
+}
+
+func TestMapsStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{nil, "OK"},
+		{errors.New("maps: ZERO_RESULTS - "), "ZERO_RESULTS"},
+		{errors.New("maps: OVER_QUERY_LIMIT - You have exceeded your daily request quota for this API."), "OVER_QUERY_LIMIT"},
+		{errors.New("maps: API Key or Maps for Work credentials missing"), "ERROR"},
+		{errors.New("maps: - "), "ERROR"},
+		{errors.New("dial tcp: i/o timeout"), "ERROR"},
+	}
+
+	for _, tt := range tests {
+		if got := mapsStatus(tt.err); got != tt.want {
+			t.Errorf("wrong maps status for %v: got %v want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		meta *Metadata
+		want bool
+	}{
+		{nil, true},
+		{&Metadata{EventID: "1"}, true},
+		{&Metadata{EventID: "2", Timestamp: now.Add(-time.Minute)}, true},
+		{&Metadata{EventID: "3", Timestamp: now.Add(-11 * time.Minute)}, false},
+		{&Metadata{EventID: "4", DeliveryAttempt: 4}, true},
+		{&Metadata{EventID: "5", DeliveryAttempt: 5}, false},
+		{&Metadata{EventID: "6", Timestamp: now.Add(-time.Minute), DeliveryAttempt: 5}, false},
+	}
+
+	for _, tt := range tests {
+		got, err := retryable(tt.meta, now, 10*time.Minute, 5)
+		if got != tt.want {
+			t.Errorf("wrong retryable for %+v: got %v want %v", tt.meta, got, tt.want)
+		}
+		if !got && err == nil {
+			t.Errorf("expected a reason for not retrying %+v", tt.meta)
+		}
+	}
+}
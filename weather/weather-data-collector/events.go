@@ -0,0 +1,84 @@
+package function
+
+import (
+	"fmt"
+	"time"
+)
+
+// eventDateLayout is the layout of the start and end dates of a
+// WeatherEvent.
+const eventDateLayout = "2006-01-02"
+
+// forecastLead is how long before an event starts collection begins.
+// It matches the 7 day range of the api.weather.gov daily forecast so
+// the forecast for the first event day is collected as soon as it's
+// published.
+const forecastLead = 7 * 24 * time.Hour
+
+// location returns the event time zone, defaulting to UTC.
+func (e WeatherEvent) location() (*time.Location, error) {
+	if e.Timezone == "" {
+		return time.UTC, nil
+	}
+
+	loc, err := time.LoadLocation(e.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone for event %s: %v", e.Event, err)
+	}
+	return loc, nil
+}
+
+// dates returns the start of the first event day and the end of the
+// last event day. ok is false for events without dates.
+func (e WeatherEvent) dates() (start, end time.Time, ok bool, err error) {
+	if e.Start == "" && e.End == "" {
+		return start, end, false, nil
+	}
+
+	loc, err := e.location()
+	if err != nil {
+		return start, end, false, err
+	}
+
+	start, err = time.ParseInLocation(eventDateLayout, e.Start, loc)
+	if err != nil {
+		return start, end, false, fmt.Errorf("invalid start date for event %s: %v", e.Event, err)
+	}
+
+	// Single day events may omit the end date.
+	end = start
+	if e.End != "" {
+		end, err = time.ParseInLocation(eventDateLayout, e.End, loc)
+		if err != nil {
+			return start, end, false, fmt.Errorf("invalid end date for event %s: %v", e.Event, err)
+		}
+	}
+
+	if end.Before(start) {
+		return start, end, false, fmt.Errorf("invalid dates for event %s: end %s is before start %s", e.Event, e.End, e.Start)
+	}
+
+	return start, end.AddDate(0, 0, 1), true, nil
+}
+
+// active reports whether weather data should be collected for the
+// event at t. Events without dates are always active; events with
+// dates are active from forecastLead before they start until they end.
+func (e WeatherEvent) active(t time.Time) (bool, error) {
+	start, end, ok, err := e.dates()
+	if err != nil || !ok {
+		return !ok, err
+	}
+
+	return !t.Before(start.Add(-forecastLead)) && t.Before(end), nil
+}
+
+// onEventDay reports whether t falls on one of the event days.
+func (e WeatherEvent) onEventDay(t time.Time) (bool, error) {
+	start, end, ok, err := e.dates()
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return !t.Before(start) && t.Before(end), nil
+}
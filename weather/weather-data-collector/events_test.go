@@ -0,0 +1,93 @@
+package function
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWeatherEventActive(t *testing.T) {
+	denver, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gophercon := WeatherEvent{
+		Event:    "GopherCon",
+		Start:    "2018-08-26",
+		End:      "2018-08-29",
+		Timezone: "America/Denver",
+	}
+
+	tests := []struct {
+		event WeatherEvent
+		t     time.Time
+		want  bool
+	}{
+		{WeatherEvent{Event: "GothamGo"}, time.Now(), true},
+		{gophercon, time.Date(2018, 8, 18, 23, 59, 0, 0, denver), false},
+		{gophercon, time.Date(2018, 8, 19, 0, 0, 0, 0, denver), true},
+		{gophercon, time.Date(2018, 8, 29, 23, 59, 0, 0, denver), true},
+		{gophercon, time.Date(2018, 8, 30, 0, 0, 0, 0, denver), false},
+		{WeatherEvent{Event: "CapitalGo", Start: "2018-04-24"}, time.Date(2018, 4, 24, 12, 0, 0, 0, time.UTC), true},
+		{WeatherEvent{Event: "CapitalGo", Start: "2018-04-24"}, time.Date(2018, 4, 25, 0, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.event.active(tt.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("wrong active state for %s at %v: got %v want %v", tt.event.Event, tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestWeatherEventInvalidDates(t *testing.T) {
+	tests := []WeatherEvent{
+		{Event: "GopherCon", Start: "08/26/2018"},
+		{Event: "GopherCon", Start: "2018-08-29", End: "2018-08-26"},
+		{Event: "GopherCon", Start: "2018-08-26", Timezone: "Mountain/Denver"},
+	}
+
+	for _, e := range tests {
+		if _, err := e.active(time.Now()); err == nil {
+			t.Errorf("expected an error for start %q end %q timezone %q", e.Start, e.End, e.Timezone)
+		}
+	}
+}
+
+func TestWeatherEventOnEventDay(t *testing.T) {
+	e := WeatherEvent{
+		Event:    "GopherCon",
+		Start:    "2018-08-27",
+		End:      "2018-08-28",
+		Timezone: "America/Denver",
+	}
+
+	tests := []struct {
+		t    string
+		want bool
+	}{
+		{"2018-08-26T18:00:00-06:00", false},
+		{"2018-08-27T06:00:00-06:00", true},
+		{"2018-08-28T18:00:00-06:00", true},
+		{"2018-08-29T05:59:00+00:00", true},
+		{"2018-08-29T06:00:00-06:00", false},
+	}
+
+	for _, tt := range tests {
+		ts, err := time.Parse(time.RFC3339, tt.t)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := e.onEventDay(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("wrong event day for %v: got %v want %v", tt.t, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,517 @@
+package function
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/kelseyhightower/weather-internal/firestoredb"
+	"google.golang.org/grpc/codes"
+)
+
+// defaultPollInterval is the poll interval of events that don't set
+// one, matching the poll_interval column default.
+const defaultPollInterval = 5 * time.Minute
+
+// maxPruneWrites limits the documents deleted in one commit, which
+// accepts at most 500 writes.
+const maxPruneWrites = 400
+
+// FirestoreStore is a Store backed by Cloud Firestore in native mode.
+// The weather data is keyed by event:
+//
+//	events/SLUG                     the events registry
+//	eventNames/NAME                 the slug of the event named NAME
+//	weather/NAME                    the current weather, forecasts,
+//	                                alerts and geocoded place
+//	weather/NAME/readings/UNIXNANO-PROVIDER-SOURCE
+//	                                the readings history
+//	processedEvents/ID              claimed Pub/Sub event IDs
+//
+// Names and IDs are escaped with firestoreID. Readings are keyed by
+// their observation time, provider and source, so an observation and
+// a forecast for the same time are both kept while a redelivered
+// event rewrites its own reading. weather-api reads the same
+// documents.
+type FirestoreStore struct {
+	Client *firestore.Client
+}
+
+// weatherDocument is the part of a weather/NAME document read by the
+// store; the current weather fields are only written.
+type weatherDocument struct {
+	PublishedAt   time.Time        `firestore:"publishedAt"`
+	Forecast      []periodDocument `firestore:"forecast"`
+	DailyForecast []periodDocument `firestore:"dailyForecast"`
+	Geocode       *geocodeDocument `firestore:"geocode"`
+}
+
+// periodDocument is a forecast period in the forecast and dailyForecast
+// arrays.
+type periodDocument struct {
+	Name                     string    `firestore:"name"`
+	StartTime                time.Time `firestore:"startTime"`
+	EndTime                  time.Time `firestore:"endTime"`
+	IsDaytime                bool      `firestore:"isDaytime"`
+	Temperature              float64   `firestore:"temperature"`
+	Humidity                 int       `firestore:"humidity"`
+	WindSpeed                float64   `firestore:"windSpeed"`
+	WindDirection            string    `firestore:"windDirection"`
+	PrecipitationProbability int       `firestore:"precipitationProbability"`
+	ShortForecast            string    `firestore:"shortForecast"`
+	DetailedForecast         string    `firestore:"detailedForecast"`
+	Icon                     string    `firestore:"icon"`
+}
+
+// alertDocument is an alert in the alerts array. Alerts without an
+// expiry time are stored without expires.
+type alertDocument struct {
+	ID       string     `firestore:"id"`
+	Type     string     `firestore:"type"`
+	Severity string     `firestore:"severity"`
+	Headline string     `firestore:"headline"`
+	Expires  *time.Time `firestore:"expires,omitempty"`
+}
+
+// geocodeDocument is the geocoded place of the event location.
+type geocodeDocument struct {
+	Location         string    `firestore:"location"`
+	PlaceID          string    `firestore:"placeId"`
+	FormattedAddress string    `firestore:"formattedAddress"`
+	Lat              float64   `firestore:"lat"`
+	Lng              float64   `firestore:"lng"`
+	UpdatedAt        time.Time `firestore:"updatedAt"`
+}
+
+// readingDocument is a document in the readings history.
+type readingDocument struct {
+	Temperature float64   `firestore:"temperature"`
+	Source      string    `firestore:"source"`
+	Provider    string    `firestore:"provider"`
+	ObservedAt  time.Time `firestore:"observedAt"`
+	PublishedAt time.Time `firestore:"publishedAt"`
+}
+
+// eventDocument is an events/SLUG document written by weather-api.
+// PollInterval is in seconds.
+type eventDocument struct {
+	Name         string    `firestore:"name"`
+	Slug         string    `firestore:"slug"`
+	Location     string    `firestore:"location"`
+	Lat          float64   `firestore:"lat"`
+	Lng          float64   `firestore:"lng"`
+	Timezone     string    `firestore:"timezone"`
+	Provider     string    `firestore:"provider"`
+	Start        string    `firestore:"start"`
+	End          string    `firestore:"end"`
+	Active       bool      `firestore:"active"`
+	PollInterval int64     `firestore:"pollInterval"`
+	DispatchedAt time.Time `firestore:"dispatchedAt"`
+}
+
+// eventNameDocument is an eventNames/NAME document.
+type eventNameDocument struct {
+	Slug string `firestore:"slug"`
+}
+
+// processedEventDocument is a processedEvents/ID document.
+type processedEventDocument struct {
+	ProcessedAt time.Time `firestore:"processedAt"`
+	ExpiresAt   time.Time `firestore:"expiresAt"`
+}
+
+func (s *FirestoreStore) weather(event string) *firestore.DocumentRef {
+	return s.Client.Collection("weather").Doc(firestoredb.ID(event))
+}
+
+func (s *FirestoreStore) processedEvent(id string) *firestore.DocumentRef {
+	return s.Client.Collection("processedEvents").Doc(firestoredb.ID(id))
+}
+
+// readingID returns the ID of the readings history document for r.
+func readingID(r Reading) string {
+	return strconv.FormatInt(r.ObservedAt.UnixNano(), 10) + "-" + firestoredb.ID(r.Provider) + "-" + firestoredb.ID(r.Source)
+}
+
+// weatherDocument returns the weather document of event, read in tx
+// when it's not nil, or nil if there's no such document.
+func (s *FirestoreStore) weatherDocument(ctx context.Context, tx *firestore.Transaction, event string) (*weatherDocument, error) {
+	d, err := firestoredb.Get(ctx, tx, s.weather(event))
+	if err != nil || d == nil {
+		return nil, err
+	}
+
+	var w weatherDocument
+	if err := d.DataTo(&w); err != nil {
+		return nil, err
+	}
+
+	return &w, nil
+}
+
+func (s *FirestoreStore) UpdateWeather(ctx context.Context, event, location string, r Reading, p Period, retention time.Duration) (latest bool, err error) {
+	ref := s.weather(event)
+
+	err = s.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		d, err := s.weatherDocument(ctx, tx, event)
+		if err != nil {
+			return err
+		}
+
+		// Prune readings older than the retention window, like the
+		// Postgres store. Transactions read before they write.
+		var expired []*firestore.DocumentSnapshot
+		if retention > 0 {
+			expired, err = tx.Documents(ref.Collection("readings").
+				Where("observedAt", "<", r.ObservedAt.Add(-retention)).
+				Limit(maxPruneWrites)).GetAll()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = tx.Set(ref.Collection("readings").Doc(readingID(r)), readingDocument{
+			Temperature: r.Temperature,
+			Source:      r.Source,
+			Provider:    r.Provider,
+			ObservedAt:  r.ObservedAt,
+			PublishedAt: r.PublishedAt,
+		})
+		if err != nil {
+			return err
+		}
+
+		latest = d == nil || !d.PublishedAt.After(r.PublishedAt)
+		if latest {
+			err := tx.Set(ref, map[string]interface{}{
+				"event":                    event,
+				"location":                 location,
+				"temperature":              r.Temperature,
+				"source":                   r.Source,
+				"observedAt":               r.ObservedAt,
+				"humidity":                 p.Humidity,
+				"windSpeed":                p.WindSpeed,
+				"windDirection":            p.WindDirection,
+				"precipitationProbability": p.PrecipitationProbability,
+				"shortForecast":            p.ShortForecast,
+				"icon":                     p.Icon,
+				"isDaytime":                p.IsDaytime,
+				"publishedAt":              r.PublishedAt,
+			}, firestore.MergeAll)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, e := range expired {
+			if err := tx.Delete(e.Ref); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return latest, err
+}
+
+func (s *FirestoreStore) UpdateForecast(ctx context.Context, event string, periods []Period) error {
+	return s.updatePeriods(ctx, event, "forecast", periods)
+}
+
+func (s *FirestoreStore) UpdateDailyForecast(ctx context.Context, event string, periods []Period) error {
+	return s.updatePeriods(ctx, event, "dailyForecast", periods)
+}
+
+// updatePeriods merges periods into the forecast periods in field,
+// replacing periods with the same start time and dropping the periods
+// that have ended, like the Postgres upserts.
+func (s *FirestoreStore) updatePeriods(ctx context.Context, event, field string, periods []Period) error {
+	return s.Client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		d, err := s.weatherDocument(ctx, tx, event)
+		if err != nil {
+			return err
+		}
+
+		merged := make(map[int64]Period)
+		if d != nil {
+			stored := d.Forecast
+			if field == "dailyForecast" {
+				stored = d.DailyForecast
+			}
+			for _, f := range stored {
+				p := periodFromDocument(f)
+				merged[p.StartTime.UnixNano()] = p
+			}
+		}
+		for _, p := range periods {
+			merged[p.StartTime.UnixNano()] = p
+		}
+
+		now := time.Now()
+		values := make([]Period, 0, len(merged))
+		for _, p := range merged {
+			if p.EndTime.Before(now) {
+				continue
+			}
+			values = append(values, p)
+		}
+		sort.Slice(values, func(i, j int) bool {
+			return values[i].StartTime.Before(values[j].StartTime)
+		})
+
+		array := make([]periodDocument, len(values))
+		for i, p := range values {
+			array[i] = periodDocumentFor(p)
+		}
+
+		return tx.Set(s.weather(event), map[string]interface{}{
+			"event": event,
+			field:   array,
+		}, firestore.MergeAll)
+	})
+}
+
+func (s *FirestoreStore) UpdateAlerts(ctx context.Context, event string, alerts []Alert) error {
+	// Alerts that are no longer active are dropped from the feed, so
+	// replace the stored alerts for the event rather than merging.
+	values := make([]alertDocument, 0, len(alerts))
+	seen := make(map[string]bool)
+	for _, a := range alerts {
+		if seen[a.ID] {
+			continue
+		}
+		seen[a.ID] = true
+
+		d := alertDocument{
+			ID:       a.ID,
+			Type:     a.Type,
+			Severity: a.Severity,
+			Headline: a.Headline,
+		}
+		if !a.Expires.IsZero() {
+			expires := a.Expires
+			d.Expires = &expires
+		}
+		values = append(values, d)
+	}
+
+	_, err := s.weather(event).Set(ctx, map[string]interface{}{
+		"event":  event,
+		"alerts": values,
+	}, firestore.MergeAll)
+	return err
+}
+
+func (s *FirestoreStore) CachedPlace(ctx context.Context, event, location string, ttl time.Duration) (*Place, error) {
+	d, err := s.weatherDocument(ctx, nil, event)
+	if err != nil || d == nil {
+		return nil, err
+	}
+
+	g := d.Geocode
+	if g == nil || g.Location != location || time.Since(g.UpdatedAt) > ttl {
+		return nil, nil
+	}
+
+	return &Place{
+		PlaceID:          g.PlaceID,
+		FormattedAddress: g.FormattedAddress,
+		Lat:              g.Lat,
+		Lng:              g.Lng,
+	}, nil
+}
+
+func (s *FirestoreStore) CachePlace(ctx context.Context, event, location string, p *Place) error {
+	_, err := s.weather(event).Set(ctx, map[string]interface{}{
+		"event": event,
+		"geocode": geocodeDocument{
+			Location:         location,
+			PlaceID:          p.PlaceID,
+			FormattedAddress: p.FormattedAddress,
+			Lat:              p.Lat,
+			Lng:              p.Lng,
+			UpdatedAt:        time.Now(),
+		},
+	}, firestore.MergeAll)
+	return err
+}
+
+func (s *FirestoreStore) ClaimEvent(ctx context.Context, id string, lease time.Duration) (claimed bool, err error) {
+	// Prune expired claims first so an ID redelivered after its claim
+	// expired is processed again.
+	now := time.Now()
+	expired, err := s.Client.Collection("processedEvents").
+		Where("expiresAt", "<", now).
+		Limit(maxPruneWrites).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return false, err
+	}
+
+	if len(expired) > 0 {
+		batch := s.Client.Batch()
+		for _, e := range expired {
+			batch.Delete(e.Ref)
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return false, err
+		}
+	}
+
+	_, err = s.processedEvent(id).Create(ctx, processedEventDocument{
+		ProcessedAt: now,
+		ExpiresAt:   now.Add(lease),
+	})
+	switch {
+	case firestoredb.IsCode(err, codes.AlreadyExists):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *FirestoreStore) CompleteEvent(ctx context.Context, id string, ttl time.Duration) error {
+	_, err := s.processedEvent(id).Set(ctx, map[string]interface{}{
+		"expiresAt": time.Now().Add(ttl),
+	}, firestore.MergeAll)
+	return err
+}
+
+func (s *FirestoreStore) ReleaseEvent(ctx context.Context, id string) error {
+	_, err := s.processedEvent(id).Delete(ctx)
+	return err
+}
+
+func (s *FirestoreStore) Event(ctx context.Context, name string) (*WeatherEvent, error) {
+	e, err := s.activeEvent(ctx, name)
+	if err != nil || e != nil {
+		return e, err
+	}
+
+	// name isn't the slug of an active event; look it up by name.
+	n, err := firestoredb.Get(ctx, nil, s.Client.Collection("eventNames").Doc(firestoredb.ID(name)))
+	if err != nil || n == nil {
+		return nil, err
+	}
+
+	var slug eventNameDocument
+	if err := n.DataTo(&slug); err != nil {
+		return nil, err
+	}
+
+	return s.activeEvent(ctx, slug.Slug)
+}
+
+// activeEvent returns the event with the given slug, or nil if there's
+// no such active event.
+func (s *FirestoreStore) activeEvent(ctx context.Context, slug string) (*WeatherEvent, error) {
+	d, err := firestoredb.Get(ctx, nil, s.Client.Collection("events").Doc(firestoredb.ID(slug)))
+	if err != nil || d == nil {
+		return nil, err
+	}
+
+	var f eventDocument
+	if err := d.DataTo(&f); err != nil || !f.Active {
+		return nil, err
+	}
+
+	e := f.registeredEvent()
+	return &e.WeatherEvent, nil
+}
+
+func (s *FirestoreStore) ActiveEvents(ctx context.Context) ([]RegisteredEvent, error) {
+	documents, err := s.Client.Collection("events").Where("active", "==", true).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]RegisteredEvent, len(documents))
+	for i, d := range documents {
+		var f eventDocument
+		if err := d.DataTo(&f); err != nil {
+			return nil, err
+		}
+		events[i] = f.registeredEvent()
+	}
+
+	// Ordering by name in the query would need a composite index.
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Event < events[j].Event
+	})
+
+	return events, nil
+}
+
+func (s *FirestoreStore) MarkDispatched(ctx context.Context, slug string, t time.Time) error {
+	_, err := s.Client.Collection("events").Doc(firestoredb.ID(slug)).Update(ctx, []firestore.Update{
+		{Path: "dispatchedAt", Value: t},
+	})
+	if firestoredb.IsCode(err, codes.NotFound) {
+		return nil
+	}
+	return err
+}
+
+// registeredEvent returns the registered event stored in f.
+func (f eventDocument) registeredEvent() RegisteredEvent {
+	e := RegisteredEvent{
+		WeatherEvent: WeatherEvent{
+			Event:    f.Name,
+			Location: f.Location,
+			Lat:      f.Lat,
+			Lng:      f.Lng,
+			Timezone: f.Timezone,
+			Provider: f.Provider,
+			Start:    f.Start,
+			End:      f.End,
+		},
+		Slug:         f.Slug,
+		PollInterval: time.Duration(f.PollInterval) * time.Second,
+		DispatchedAt: f.DispatchedAt,
+	}
+
+	if e.PollInterval <= 0 {
+		e.PollInterval = defaultPollInterval
+	}
+
+	return e
+}
+
+func periodDocumentFor(p Period) periodDocument {
+	return periodDocument{
+		Name:                     p.Name,
+		StartTime:                p.StartTime,
+		EndTime:                  p.EndTime,
+		IsDaytime:                p.IsDaytime,
+		Temperature:              p.Temperature,
+		Humidity:                 p.Humidity,
+		WindSpeed:                p.WindSpeed,
+		WindDirection:            p.WindDirection,
+		PrecipitationProbability: p.PrecipitationProbability,
+		ShortForecast:            p.ShortForecast,
+		DetailedForecast:         p.DetailedForecast,
+		Icon:                     p.Icon,
+	}
+}
+
+func periodFromDocument(d periodDocument) Period {
+	return Period{
+		Name:                     d.Name,
+		StartTime:                d.StartTime,
+		EndTime:                  d.EndTime,
+		IsDaytime:                d.IsDaytime,
+		Temperature:              d.Temperature,
+		Humidity:                 d.Humidity,
+		WindSpeed:                d.WindSpeed,
+		WindDirection:            d.WindDirection,
+		PrecipitationProbability: d.PrecipitationProbability,
+		ShortForecast:            d.ShortForecast,
+		DetailedForecast:         d.DetailedForecast,
+		Icon:                     d.Icon,
+	}
+}
@@ -0,0 +1,380 @@
+package function
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/kelseyhightower/weather-internal/firestoredb"
+	"github.com/kelseyhightower/weather-internal/firestoretest"
+)
+
+// newTestFirestoreClient returns a client for the Firestore emulator
+// when FIRESTORE_EMULATOR_HOST is set, and for a fake otherwise.
+func newTestFirestoreClient(t *testing.T) (*firestore.Client, func()) {
+	client, done, err := firestoretest.NewClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, done
+}
+
+// getTestWeather returns the weather document of event.
+func getTestWeather(t *testing.T, client *firestore.Client, event string) *firestore.DocumentSnapshot {
+	d, err := client.Collection("weather").Doc(firestoredb.ID(event)).Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// getTestReadings returns the readings history of event.
+func getTestReadings(t *testing.T, client *firestore.Client, event string) []*firestore.DocumentSnapshot {
+	documents, err := client.Collection("weather").Doc(firestoredb.ID(event)).Collection("readings").Documents(context.Background()).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return documents
+}
+
+func TestFirestoreStoreUpdateWeather(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	reading := Reading{Temperature: 31, Source: "observed", Provider: "nws", ObservedAt: now, PublishedAt: now}
+	period := Period{Humidity: 20, ShortForecast: "Sunny", IsDaytime: true}
+
+	latest, err := s.UpdateWeather(ctx, "GopherCon", "Denver, Colorado, USA", reading, period, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !latest {
+		t.Errorf("first reading isn't the latest")
+	}
+
+	// A redelivered event published earlier is kept in the history but
+	// doesn't replace the current weather.
+	older := Reading{Temperature: 25, Source: "forecast", Provider: "nws", ObservedAt: now.Add(-time.Hour), PublishedAt: now.Add(-time.Hour)}
+	latest, err = s.UpdateWeather(ctx, "GopherCon", "Denver, Colorado, USA", older, period, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest {
+		t.Errorf("older reading replaced the current weather")
+	}
+
+	d := getTestWeather(t, client, "GopherCon").Data()
+	if d["temperature"] != 31.0 || d["shortForecast"] != "Sunny" {
+		t.Errorf("wrong current weather: got %+v", d)
+	}
+
+	readings := getTestReadings(t, client, "GopherCon")
+	if len(readings) != 2 {
+		t.Errorf("wrong number of readings: got %v want %v", len(readings), 2)
+	}
+
+	// Readings older than the retention window are pruned.
+	newer := Reading{Temperature: 32, Source: "observed", Provider: "nws", ObservedAt: now.Add(time.Hour), PublishedAt: now.Add(time.Hour)}
+	if _, err := s.UpdateWeather(ctx, "GopherCon", "Denver, Colorado, USA", newer, period, 90*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	readings = getTestReadings(t, client, "GopherCon")
+	if len(readings) != 2 {
+		t.Errorf("wrong number of readings after pruning: got %v want %v", len(readings), 2)
+	}
+}
+
+func TestFirestoreStoreReadingIDs(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	// An observation and a forecast for the same time are both kept,
+	// and a redelivered reading replaces its own document.
+	now := time.Now().UTC().Truncate(time.Second)
+	readings := []Reading{
+		{Temperature: 31, Source: "observed", Provider: "nws", ObservedAt: now, PublishedAt: now},
+		{Temperature: 30, Source: "forecast", Provider: "nws", ObservedAt: now, PublishedAt: now},
+		{Temperature: 30, Source: "forecast", Provider: "open-meteo", ObservedAt: now, PublishedAt: now},
+		{Temperature: 31, Source: "observed", Provider: "nws", ObservedAt: now, PublishedAt: now},
+	}
+	for _, r := range readings {
+		if _, err := s.UpdateWeather(ctx, "GopherCon", "Denver, Colorado, USA", r, Period{}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	documents := getTestReadings(t, client, "GopherCon")
+	if len(documents) != 3 {
+		t.Errorf("wrong number of readings: got %v want %v", len(documents), 3)
+	}
+	for _, d := range documents {
+		var f readingDocument
+		if err := d.DataTo(&f); err != nil {
+			t.Fatal(err)
+		}
+		r := Reading{Source: f.Source, Provider: f.Provider, ObservedAt: f.ObservedAt}
+		if d.Ref.ID != readingID(r) {
+			t.Errorf("wrong reading ID: got %v want %v", d.Ref.ID, readingID(r))
+		}
+	}
+}
+
+func TestFirestoreStoreUpdateForecast(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	start := time.Now().UTC().Truncate(time.Hour)
+	period := func(offset int, temperature float64) Period {
+		return Period{
+			StartTime:   start.Add(time.Duration(offset) * time.Hour),
+			EndTime:     start.Add(time.Duration(offset+1) * time.Hour),
+			Temperature: temperature,
+		}
+	}
+
+	if err := s.UpdateForecast(ctx, "GopherCon", []Period{period(-2, 20), period(0, 21), period(1, 22)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateForecast(ctx, "GopherCon", []Period{period(2, 24), period(1, 23)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var d weatherDocument
+	if err := getTestWeather(t, client, "GopherCon").DataTo(&d); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ended period is dropped and the updated period replaced.
+	var got []float64
+	for _, f := range d.Forecast {
+		got = append(got, f.Temperature)
+	}
+	want := []float64{21, 23, 24}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("wrong forecast temperatures: got %v want %v", got, want)
+	}
+}
+
+func TestFirestoreStoreClaimEvent(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	tests := []struct {
+		claim   bool
+		lease   time.Duration
+		claimed bool
+	}{
+		{true, time.Hour, true},
+		{true, time.Hour, false},
+		{false, -time.Minute, true},
+		// Expired claims are forgotten.
+		{true, time.Hour, true},
+		{true, time.Hour, false},
+	}
+
+	for i, tt := range tests {
+		if !tt.claim {
+			if err := s.ReleaseEvent(ctx, "186226215410470"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		claimed, err := s.ClaimEvent(ctx, "186226215410470", tt.lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != tt.claimed {
+			t.Errorf("%d: wrong claimed: got %v want %v", i, claimed, tt.claimed)
+		}
+	}
+
+	// Completing an event replaces the expiry of its claim.
+	if err := s.CompleteEvent(ctx, "186226215410470", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := s.ClaimEvent(ctx, "186226215410470", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Errorf("wrong claimed after the completed claim expired: got %v want %v", claimed, true)
+	}
+}
+
+func TestFirestoreStorePlace(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	place := &Place{PlaceID: "ChIJzxcfI6qAa4cR1jaKJ_j0jhE", FormattedAddress: "Denver, CO, USA", Lat: 39.7392, Lng: -104.9903}
+	if err := s.CachePlace(ctx, "GopherCon", "Denver, Colorado, USA", place); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := s.CachedPlace(ctx, "GopherCon", "Denver, Colorado, USA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || *p != *place {
+		t.Errorf("wrong cached place: got %+v want %+v", p, place)
+	}
+
+	p, err = s.CachedPlace(ctx, "GopherCon", "San Diego, California, USA", time.Hour)
+	if err != nil || p != nil {
+		t.Errorf("cached place returned for a new location: got %+v, %v", p, err)
+	}
+
+	// Places cached longer than the TTL are geocoded again.
+	_, err = client.Collection("weather").Doc(firestoredb.ID("GopherCon")).Set(ctx, map[string]interface{}{
+		"geocode": geocodeDocument{
+			Location:         "Denver, Colorado, USA",
+			PlaceID:          place.PlaceID,
+			FormattedAddress: place.FormattedAddress,
+			Lat:              place.Lat,
+			Lng:              place.Lng,
+			UpdatedAt:        time.Now().Add(-2 * time.Hour),
+		},
+	}, firestore.MergeAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = s.CachedPlace(ctx, "GopherCon", "Denver, Colorado, USA", time.Hour)
+	if err != nil || p != nil {
+		t.Errorf("expired cached place returned: got %+v, %v", p, err)
+	}
+}
+
+func TestFirestoreStoreEvents(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	// The registry is written by weather-api.
+	events := []map[string]interface{}{
+		{"slug": "gophercon", "name": "GopherCon", "location": "Denver, Colorado, USA",
+			"lat": 39.7392, "lng": -104.9903, "active": true},
+		{"slug": "go-northwest", "name": "Go Northwest", "location": "Seattle, Washington, USA",
+			"pollInterval": 600, "active": true},
+		{"slug": "gotham-go", "name": "GothamGo", "location": "New York, New York, USA",
+			"active": false},
+	}
+
+	batch := client.Batch()
+	for _, e := range events {
+		batch.Set(client.Collection("events").Doc(e["slug"].(string)), e)
+		batch.Set(client.Collection("eventNames").Doc(firestoredb.ID(e["name"].(string))), map[string]interface{}{"slug": e["slug"]})
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"gophercon", "GopherCon"} {
+		e, err := s.Event(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil || e.Event != "GopherCon" || e.Lat != 39.7392 {
+			t.Errorf("wrong event for %s: got %+v", name, e)
+		}
+	}
+
+	e, err := s.Event(ctx, "GothamGo")
+	if err != nil || e != nil {
+		t.Errorf("inactive event returned: got %+v, %v", e, err)
+	}
+
+	active, err := s.ActiveEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 2 || active[0].Slug != "go-northwest" || active[1].Slug != "gophercon" {
+		t.Fatalf("wrong active events: got %+v", active)
+	}
+	if active[0].PollInterval != 10*time.Minute || active[1].PollInterval != defaultPollInterval {
+		t.Errorf("wrong poll intervals: got %v, %v", active[0].PollInterval, active[1].PollInterval)
+	}
+
+	dispatchedAt := time.Now().UTC().Truncate(time.Second)
+	if err := s.MarkDispatched(ctx, "gophercon", dispatchedAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MarkDispatched(ctx, "golab", dispatchedAt); err != nil {
+		t.Errorf("error marking an unknown event as dispatched: %v", err)
+	}
+
+	active, err = s.ActiveEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !active[1].DispatchedAt.Equal(dispatchedAt) {
+		t.Errorf("wrong dispatched at: got %v want %v", active[1].DispatchedAt, dispatchedAt)
+	}
+}
+
+func TestServiceCollectFirestore(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s, _, _, _ := newTestService()
+	s.Store = &FirestoreStore{Client: client}
+
+	if err := s.Collect(context.Background(), gophercon); err != nil {
+		t.Fatal(err)
+	}
+
+	d := getTestWeather(t, client, "GopherCon").Data()
+	if d["temperature"] != 31.0 {
+		t.Fatalf("wrong weather document: got %+v", d)
+	}
+	if alerts, _ := d["alerts"].([]interface{}); len(alerts) != 1 {
+		t.Errorf("wrong number of alerts: got %v want %v", len(alerts), 1)
+	}
+}
+
+func TestFirestoreStoreAlerts(t *testing.T) {
+	client, done := newTestFirestoreClient(t)
+	defer done()
+
+	s := &FirestoreStore{Client: client}
+	ctx := context.Background()
+
+	expires := time.Now().UTC().Add(time.Hour).Truncate(time.Second)
+	alerts := []Alert{
+		{ID: "1", Type: "Heat Advisory", Expires: expires},
+		{ID: "2", Type: "Air Quality Alert"},
+	}
+	if err := s.UpdateAlerts(ctx, "GopherCon", alerts); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, _ := getTestWeather(t, client, "GopherCon").Data()["alerts"].([]interface{})
+	if len(stored) != 2 {
+		t.Fatalf("wrong number of alerts: got %v want %v", len(stored), 2)
+	}
+	if got, _ := stored[0].(map[string]interface{})["expires"].(time.Time); !got.Equal(expires) {
+		t.Errorf("wrong expiry: got %v want %v", got, expires)
+	}
+	if _, ok := stored[1].(map[string]interface{})["expires"]; ok {
+		t.Errorf("alerts without an expiry must be stored without expires")
+	}
+}
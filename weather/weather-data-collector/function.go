@@ -1,328 +1,527 @@
 package function
 
 import (
-	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
-	"os"
-	"sync"
+	"log"
+	"time"
 
 	"cloud.google.com/go/logging"
-	"cloud.google.com/go/storage"
+	"github.com/kelseyhightower/weather-internal/health"
+	"github.com/kelseyhightower/weather-internal/publisher"
+	"github.com/kelseyhightower/weather-internal/secrets"
+	"github.com/kelseyhightower/weather-internal/stackdriver"
 	"go.opencensus.io/trace"
+	"golang.org/x/time/rate"
 	"googlemaps.github.io/maps"
-
-	_ "github.com/lib/pq"
 )
 
 var (
-	db         *sql.DB
-	logger     *logging.Logger
-	mapsClient *maps.Client
-	once       sync.Once
+	service *Service
+
+	// initService runs configFunc until it succeeds.
+	initService = health.NewInitializer(func() error { return configFunc() })
 )
 
-// configFunc sets the global configuration; it's overridden in tests.
+// configFunc sets the global service; it's overridden in tests.
 var configFunc = defaultConfigFunc
 
-type HourlyForecast struct {
-	Type       string
-	Properties Properties
+// Logger logs structured log entries; *logging.Logger satisfies it.
+type Logger interface {
+	Log(e logging.Entry)
+	Flush() error
 }
 
-type Properties struct {
-	Periods []Period
+// Service collects weather data for events. F uses the service created
+// by configFunc; tests create their own.
+type Service struct {
+	Store     Store
+	Logger    Logger
+	Geocoder  Geocoder
+	Providers map[string]WeatherProvider
+
+	// Publisher publishes events to Config.EventsTopic from the
+	// dispatcher and failed events to Config.DeadLetterTopic. Failed
+	// events are only logged when it's nil.
+	Publisher publisher.Publisher
+
+	Config Config
 }
 
+// Period is a single forecast period. Temperature is in degrees
+// Celsius, WindSpeed is in kilometres per hour and Humidity and
+// PrecipitationProbability are percentages.
 type Period struct {
-	Temperature int
+	StartTime                time.Time
+	EndTime                  time.Time
+	IsDaytime                bool
+	Temperature              float64
+	Humidity                 int
+	WindSpeed                float64
+	WindDirection            string
+	PrecipitationProbability int
+	ShortForecast            string
+	Icon                     string
+
+	// Name and DetailedForecast are only set for daily forecast
+	// periods, for example "Tuesday Night".
+	Name             string
+	DetailedForecast string
 }
 
+// Reading is a single temperature reading for an event. Readings are
+// appended to the readings table to build a time series, while the
+// weather table only holds the latest reading.
+type Reading struct {
+	Temperature float64
+	Source      string
+	Provider    string
+	ObservedAt  time.Time
+
+	// PublishedAt is when the event that collected the reading was
+	// published. It orders readings from redelivered events.
+	PublishedAt time.Time
+}
+
+// PubSubMessage is the payload of a Pub/Sub event. Attributes are the
+// message attributes; see messageMetadata.
 type PubSubMessage struct {
-	Data []byte `json:"data"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
 }
 
+// WeatherEvent identifies an event to collect weather data for. Start
+// and End are optional dates in the YYYY-MM-DD format, interpreted in
+// the event's IANA Timezone; see events.go. Lat and Lng are optional;
+// events without them are geocoded from their Location.
 type WeatherEvent struct {
-	Event    string `json:"event"`
-	Location string `json:"location"`
+	Event    string  `json:"event"`
+	Location string  `json:"location"`
+	Lat      float64 `json:"lat"`
+	Lng      float64 `json:"lng"`
+	Provider string  `json:"provider"`
+	Start    string  `json:"start"`
+	End      string  `json:"end"`
+	Timezone string  `json:"timezone"`
 }
 
 func F(ctx context.Context, m PubSubMessage) error {
-	once.Do(func() {
-		if err := configFunc(); err != nil {
-			panic(err)
-		}
-	})
+	if err := initService.Do(); err != nil {
+		log.Printf("initialization failed: %v", err)
+		return &TransientError{Err: fmt.Errorf("initialization failed: %v", err)}
+	}
 
-	defer logger.Flush()
+	defer service.Logger.Flush()
 
-	var e WeatherEvent
-	if err := json.Unmarshal(m.Data, &e); err != nil {
-		return err
+	if _, err := metadataFromContext(ctx); err != nil {
+		if meta := messageMetadata(m); meta != nil {
+			ctx = newMetadataContext(ctx, meta)
+		}
 	}
 
-	ctx, span := trace.StartSpan(ctx, "weather-data-collector")
-	defer span.End()
+	return service.Collect(ctx, m)
+}
 
-	lat, lng, err := geoFromLocation(ctx, e.Location)
+// Collect collects the weather data for the event in m. Duplicate
+// deliveries are skipped when ctx carries the event metadata. Only
+// transient failures that should be retried are returned.
+func (s *Service) Collect(ctx context.Context, m PubSubMessage) error {
+	meta, err := metadataFromContext(ctx)
 	if err != nil {
-		return err
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("%v, duplicate events won't be detected", err),
+			Severity: logging.Warning,
+		})
 	}
 
-	temperature, err := getTemperature(ctx, lat, lng)
-	if err != nil {
-		return err
+	if meta != nil {
+		claimed, err := s.Store.ClaimEvent(ctx, meta.EventID, s.Config.ClaimTimeout)
+		if err != nil {
+			return s.handleError(ctx, m, err)
+		}
+
+		if !claimed {
+			s.Logger.Log(logging.Entry{
+				Payload:  fmt.Sprintf("skipping duplicate event %s", meta.EventID),
+				Severity: logging.Info,
+			})
+			return nil
+		}
+	}
+
+	if err := s.collect(ctx, m); err != nil {
+		err = s.handleError(ctx, m, err)
+		if err != nil {
+			// Release the event so the retry isn't dropped as a
+			// duplicate.
+			if meta != nil {
+				if rerr := s.Store.ReleaseEvent(ctx, meta.EventID); rerr != nil {
+					s.Logger.Log(logging.Entry{
+						Payload:  fmt.Sprintf("error releasing event %s: %v", meta.EventID, rerr),
+						Severity: logging.Error,
+					})
+				}
+			}
+			return err
+		}
+	}
+
+	// Keep the claim so duplicate deliveries, including redeliveries of
+	// a dead-lettered event, are skipped. A failure only risks
+	// processing the event twice.
+	if meta != nil {
+		if err := s.Store.CompleteEvent(ctx, meta.EventID, s.Config.ProcessedEventTTL); err != nil {
+			s.Logger.Log(logging.Entry{
+				Payload:  fmt.Sprintf("error completing event %s: %v", meta.EventID, err),
+				Severity: logging.Error,
+			})
+		}
 	}
 
-	return updateDatabase(ctx, e.Event, e.Location, temperature)
+	return nil
 }
 
-func updateDatabase(ctx context.Context, event string, location string, temperature int) error {
-	ctx, span := trace.StartSpan(ctx, "cloud-sql")
-	defer span.End()
+// collect retrieves and stores the weather data for the event in m.
+// Messages that only name an event, by slug or name, are collected
+// using the event in the events registry. Failures that retrying won't
+// fix are returned as a PermanentError.
+func (s *Service) collect(ctx context.Context, m PubSubMessage) error {
+	var e WeatherEvent
+	if err := json.Unmarshal(m.Data, &e); err != nil {
+		return &PermanentError{Err: fmt.Errorf("invalid weather event: %v", err)}
+	}
 
-	logger.Log(logging.Entry{
-		Payload:  fmt.Sprintf("setting temperature for %s in %s to %d", event, location, temperature),
-		Severity: logging.Info,
-	})
+	if e.Event == "" {
+		return &PermanentError{Err: fmt.Errorf("invalid weather event: missing event")}
+	}
+
+	if e.Location == "" {
+		registered, err := s.Store.Event(ctx, e.Event)
+		if err != nil {
+			return err
+		}
+		if registered == nil {
+			return &PermanentError{Err: fmt.Errorf("unknown event %q", e.Event)}
+		}
+		e = *registered
+	}
 
-	_, err := db.Exec(query, event, location, temperature)
-	return err
+	return s.collectEvent(ctx, e)
 }
 
-func getTemperature(ctx context.Context, lat, lng float64) (int, error) {
-	ctx, span := trace.StartSpan(ctx, "api.weather.gov/points/forecast/hourly")
+// collectEvent retrieves and stores the weather data for e.
+func (s *Service) collectEvent(ctx context.Context, e WeatherEvent) error {
+	active, err := e.active(time.Now())
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+
+	if !active {
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("skipping %s: outside of the event window %s to %s", e.Event, e.Start, e.End),
+			Severity: logging.Info,
+		})
+		return nil
+	}
+
+	provider, err := s.provider(e)
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+
+	ctx, span := trace.StartSpan(ctx, "weather-data-collector")
 	defer span.End()
 
-	u := fmt.Sprintf("https://api.weather.gov/points/%.4f,%.4f/forecast/hourly", lat, lng)
+	lat, lng := e.Lat, e.Lng
+	if lat == 0 && lng == 0 {
+		place, err := s.geocode(ctx, e.Event, e.Location)
+		if err != nil {
+			return err
+		}
+		lat, lng = place.Lat, place.Lng
+	}
 
-	logger.Log(logging.Entry{
-		Payload:  fmt.Sprintf("retrieving weather data for (%.4f,%.4f)", lat, lng),
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("retrieving weather data for (%.4f,%.4f) from %s", lat, lng, providerName(e)),
 		Severity: logging.Info,
 	})
 
-	request, err := http.NewRequest("GET", u, nil)
+	periods, err := provider.Forecast(ctx, lat, lng)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	request.Header.Add("User-Agent", "Weather Function 1.0")
-	request.Header.Add("Accept", "application/geo+json")
+	if len(periods) == 0 {
+		return fmt.Errorf("no forecast periods returned for (%.4f,%.4f)", lat, lng)
+	}
+
+	reading := s.currentReading(ctx, e, provider, lat, lng, periods)
+	reading.PublishedAt = publishTime(ctx)
 
-	response, err := http.DefaultClient.Do(request)
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("setting temperature for %s in %s to %.1f°C", e.Event, e.Location, reading.Temperature),
+		Severity: logging.Info,
+	})
+
+	latest, err := s.Store.UpdateWeather(ctx, e.Event, e.Location, reading, periods[0], s.Config.ReadingsRetention)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	data, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		return 0, err
+	// A late redelivery of an older event must not replace data stored
+	// by a newer one.
+	if !latest {
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("skipping update for %s: weather from a newer event is already stored", e.Event),
+			Severity: logging.Info,
+		})
+		return nil
 	}
 
-	response.Body.Close()
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("storing %d forecast periods for %s", len(periods), e.Event),
+		Severity: logging.Info,
+	})
 
-	var forecast HourlyForecast
-	if err := json.Unmarshal(data, &forecast); err != nil {
-		return 0, err
+	if err := s.Store.UpdateForecast(ctx, e.Event, periods); err != nil {
+		return err
 	}
 
-	return forecast.Properties.Periods[0].Temperature, nil
-}
+	if err := s.collectAlerts(ctx, e, provider, lat, lng); err != nil {
+		return err
+	}
 
-func geoFromLocation(ctx context.Context, location string) (float64, float64, error) {
-	ctx, span := trace.StartSpan(ctx, "google-maps-api")
-	defer span.End()
+	return s.collectDailyForecast(ctx, e, provider, lat, lng)
+}
 
-	id, err := findPlaceIDFromText(ctx, location)
-	if err != nil {
-		return 0, 0, err
+// handleError decides what happens to an event that failed to collect.
+// Transient failures are returned so the event is retried until it's
+// older than MaxEventAge or has been delivered MaxDeliveryAttempts
+// times. Permanent failures, and transient failures that are out of
+// retries, are published to the dead-letter topic and acknowledged.
+func (s *Service) handleError(ctx context.Context, m PubSubMessage, err error) error {
+	err = classify(err)
+	reason := err.Error()
+
+	meta, _ := metadataFromContext(ctx)
+
+	if _, ok := err.(*TransientError); ok {
+		retry, rerr := retryable(meta, time.Now(), s.Config.MaxEventAge, s.Config.MaxDeliveryAttempts)
+		if retry {
+			s.Logger.Log(logging.Entry{
+				Payload:  fmt.Sprintf("transient error collecting weather data, retrying: %v", err),
+				Severity: logging.Warning,
+			})
+			return err
+		}
+		reason = fmt.Sprintf("%v (not retried: %v)", err, rerr)
 	}
 
-	return getLatLng(ctx, id)
+	return s.deadLetter(ctx, m, meta, reason)
 }
 
-func findPlaceIDFromText(ctx context.Context, location string) (string, error) {
-	ctx, span := trace.StartSpan(ctx, "google-maps-find-place")
-	defer span.End()
+// deadLetter publishes the original payload of a failed event and the
+// reason it failed to the dead-letter topic. Events are only logged
+// when there's no dead-letter topic.
+func (s *Service) deadLetter(ctx context.Context, m PubSubMessage, meta *Metadata, reason string) error {
+	topic := s.Config.DeadLetterTopic
+	if topic == "" || s.Publisher == nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("dropping weather event %q: %s", m.Data, reason),
+			Severity: logging.Error,
+		})
+		return nil
+	}
 
-	r, err := mapsClient.FindPlaceFromText(context.Background(),
-		&maps.FindPlaceFromTextRequest{
-			Input:     location,
-			InputType: maps.FindPlaceFromTextInputTypeTextQuery,
-		},
-	)
+	attributes := map[string]string{"reason": reason}
+	if meta != nil {
+		attributes["eventId"] = meta.EventID
+	}
+
+	id, err := s.Publisher.Publish(ctx, topic, m.Data, attributes)
 	if err != nil {
-		return "", err
+		// Don't retry; a failing dead-letter topic would otherwise
+		// cause the retries this is meant to prevent. The payload is
+		// kept in the log entry.
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("error publishing weather event %q to %s: %v: %s", m.Data, topic, err, reason),
+			Severity: logging.Critical,
+		})
+		return nil
 	}
 
-	return r.Candidates[0].PlaceID, nil
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("published weather event to %s as message %s: %s", topic, id, reason),
+		Severity: logging.Error,
+	})
+
+	return nil
 }
 
-func getLatLng(ctx context.Context, id string) (float64, float64, error) {
-	ctx, span := trace.StartSpan(ctx, "google-maps-place-details")
-	defer span.End()
+// collectAlerts stores the active weather alerts for an event when the
+// provider publishes them.
+func (s *Service) collectAlerts(ctx context.Context, e WeatherEvent, provider WeatherProvider, lat, lng float64) error {
+	ap, ok := provider.(AlertProvider)
+	if !ok {
+		return nil
+	}
 
-	r, err := mapsClient.PlaceDetails(ctx, &maps.PlaceDetailsRequest{PlaceID: id})
+	alerts, err := ap.Alerts(ctx, lat, lng)
 	if err != nil {
-		return 0, 0, err
+		// Keep the previously stored alerts rather than failing the
+		// collection after the temperature has been updated.
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("error retrieving weather alerts for %s: %v", e.Event, err),
+			Severity: logging.Warning,
+		})
+		return nil
 	}
 
-	return r.Geometry.Location.Lat, r.Geometry.Location.Lng, nil
-}
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("storing %d active weather alerts for %s", len(alerts), e.Event),
+		Severity: logging.Info,
+	})
 
-func defaultConfigFunc() error {
-	var err error
+	return s.Store.UpdateAlerts(ctx, e.Event, alerts)
+}
 
-	if err := EnableStackdriverTrace(); err != nil {
-		return err
+// collectDailyForecast stores the daily forecast for each day of an
+// event with dates, when the provider publishes daily forecasts.
+func (s *Service) collectDailyForecast(ctx context.Context, e WeatherEvent, provider WeatherProvider, lat, lng float64) error {
+	dp, ok := provider.(DailyForecastProvider)
+	if !ok || e.Start == "" {
+		return nil
 	}
 
-	logger, err = NewStackdriverLogger()
+	periods, err := dp.DailyForecast(ctx, lat, lng)
 	if err != nil {
-		return err
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("error retrieving daily forecast for %s: %v", e.Event, err),
+			Severity: logging.Warning,
+		})
+		return nil
 	}
 
-	ctx := context.Background()
-
-	bucketName := os.Getenv("CONFIGURATION_BUCKET_NAME")
-	if bucketName == "" {
-		return fmt.Errorf("CONFIGURATION_BUCKET_NAME environment variable unset or missing")
+	eventDays := make([]Period, 0)
+	for _, p := range periods {
+		ok, err := e.onEventDay(p.StartTime)
+		if err != nil {
+			return err
+		}
+		if ok {
+			eventDays = append(eventDays, p)
+		}
 	}
 
-	storageClient, err := storage.NewClient(ctx)
-	if err != nil {
-		return err
-	}
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("storing %d daily forecast periods for %s", len(eventDays), e.Event),
+		Severity: logging.Info,
+	})
 
-	// Setup the Google maps API client
-	apiKey, err := objectToString(storageClient, bucketName, "maps-api-key")
-	if err != nil {
-		return err
+	return s.Store.UpdateDailyForecast(ctx, e.Event, eventDays)
+}
+
+// currentReading returns the latest observed temperature when the
+// provider reports observations, falling back to the first forecast
+// period when there's no observation or it's older than
+// ObservationMaxAge.
+func (s *Service) currentReading(ctx context.Context, e WeatherEvent, provider WeatherProvider, lat, lng float64, periods []Period) Reading {
+	forecast := Reading{
+		Temperature: periods[0].Temperature,
+		Source:      "forecast",
+		Provider:    providerName(e),
+		ObservedAt:  time.Now().UTC(),
 	}
 
-	mapsClient, err = maps.NewClient(maps.WithAPIKey(apiKey))
-	if err != nil {
-		return err
+	op, ok := provider.(ObservationProvider)
+	if !ok {
+		return forecast
 	}
 
-	// Fetch the Cloud SQL credentials and make them
-	// available to the lib/pq database driver.
-	password, err := objectToString(storageClient, bucketName, "password")
+	o, err := op.Observation(ctx, lat, lng)
 	if err != nil {
-		return err
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("error retrieving observation for %s, using forecast: %v", e.Event, err),
+			Severity: logging.Warning,
+		})
+		return forecast
 	}
 
-	clientCert, err := objectToTempFile(storageClient, bucketName, "client.pem")
-	if err != nil {
-		return err
+	if age := time.Since(o.ObservedAt); age > s.Config.ObservationMaxAge {
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("observation from %s for %s is %s old, using forecast", o.Station, e.Event, age.Round(time.Minute)),
+			Severity: logging.Info,
+		})
+		return forecast
 	}
 
-	clientKey, err := objectToTempFile(storageClient, bucketName, "client.key")
-	if err != nil {
-		return err
+	return Reading{
+		Temperature: o.Temperature,
+		Source:      "observed",
+		Provider:    providerName(e),
+		ObservedAt:  o.ObservedAt.UTC(),
 	}
+}
 
-	serverCert, err := objectToTempFile(storageClient, bucketName, "server.pem")
-	if err != nil {
+func defaultConfigFunc() error {
+	if err := stackdriver.EnableTrace(); err != nil {
 		return err
 	}
 
-	// Use environment variables to configure the database connection
-	// parameters because it allows us to leverage both run-time and
-	// deploy time configuration.
-	err = os.Setenv("PGSSLCERT", clientCert)
+	logger, err := stackdriver.NewLogger()
 	if err != nil {
 		return err
 	}
 
-	err = os.Setenv("PGSSLKEY", clientKey)
+	config, err := configFromEnv()
 	if err != nil {
 		return err
 	}
 
-	err = os.Setenv("PGSSLROOTCERT", serverCert)
+	ctx := context.Background()
+
+	source, err := secrets.NewSource(ctx)
 	if err != nil {
 		return err
 	}
 
-	// Don't store the decrypted database password in an environment
-	// variable to avoid security concerns. Instead store the password
-	// in a connection string that will be used to configure the
-	// database connection parameters.
-	//
-	// The `lib/pq` database driver supports configuring database
-	// connection parameters using both environment variables and
-	// a connection string. Environment variables take lower
-	// precedence.
-	//
-	// See the `lib/pq` docs for more details:
-	//
-	//     https://godoc.org/github.com/lib/pq
-	//
-	dsn := fmt.Sprintf("password='%s'", password)
-
-	db, err = sql.Open("postgres", dsn)
+	// Setup the Google maps API client
+	apiKey, err := secrets.String(ctx, source, "maps-api-key")
 	if err != nil {
 		return err
 	}
 
-	// Google Cloud Functions ensures a single request per function
-	// invocation. Avoid exhausting database connections by limiting
-	// this function to a single database connection.
-	//
-	// See the cloud functions docs for more details:
-	//
-	//    https://cloud.google.com/functions/docs/sql
-	//
-	db.SetMaxIdleConns(1)
-	db.SetMaxOpenConns(1)
-
-	return nil
-}
-
-func objectToString(client *storage.Client, bucketName, objectName string) (string, error) {
-	ctx := context.Background()
-	o, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	mapsClient, err := maps.NewClient(maps.WithAPIKey(apiKey))
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer o.Close()
 
-	data, err := ioutil.ReadAll(o)
-	if err != nil {
-		return "", err
+	if err := registerViews(); err != nil {
+		return err
 	}
 
-	return string(bytes.TrimSpace(data)), nil
-}
+	// The limiter is shared by every Maps API request of the instance.
+	mapsLimiter := rate.NewLimiter(rate.Every(config.MapsRateInterval), config.MapsBurst)
 
-func objectToTempFile(client *storage.Client, bucketName, objectName string) (string, error) {
-	ctx := context.Background()
-	o, err := client.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	pubsub, err := publisher.NewPubSub(ctx)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer o.Close()
 
-	t, err := ioutil.TempFile("", "")
+	store, err := openStore(ctx, source)
 	if err != nil {
-		return "", err
+		return err
 	}
-	defer t.Close()
 
-	if _, err := io.Copy(t, o); err != nil {
-		return "", err
+	service = &Service{
+		Store:     store,
+		Logger:    logger,
+		Geocoder:  &MapsGeocoder{Client: mapsClient, Limiter: mapsLimiter},
+		Providers: defaultProviders(),
+		Publisher: pubsub,
+		Config:    config,
 	}
 
-	return t.Name(), nil
+	return nil
 }
-
-var query = `INSERT INTO weather (event, location, temperature)
-  VALUES ($1, $2, $3)
-  ON CONFLICT (event)
-  DO UPDATE SET temperature = EXCLUDED.temperature;`
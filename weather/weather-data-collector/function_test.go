@@ -0,0 +1,661 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+	"github.com/kelseyhightower/weather-internal/health"
+	"github.com/kelseyhightower/weather-internal/publisher"
+)
+
+type testLogger struct {
+	entries []logging.Entry
+}
+
+func (l *testLogger) Log(e logging.Entry) {
+	l.entries = append(l.entries, e)
+}
+
+func (l *testLogger) Flush() error {
+	return nil
+}
+
+// testStore is an in-memory Store.
+type testStore struct {
+	weather  map[string]Reading
+	readings []Reading
+	forecast map[string][]Period
+	alerts   map[string][]Alert
+	places   map[string]cachedPlace // event to geocoded place
+	claimed  map[string]time.Time   // event ID to claim expiry
+	events   []RegisteredEvent
+	err      error
+	markErr  error // returned by MarkDispatched
+
+	retention time.Duration
+}
+
+func newTestStore() *testStore {
+	return &testStore{
+		weather:  make(map[string]Reading),
+		forecast: make(map[string][]Period),
+		alerts:   make(map[string][]Alert),
+		places:   make(map[string]cachedPlace),
+		claimed:  make(map[string]time.Time),
+	}
+}
+
+func (s *testStore) UpdateWeather(ctx context.Context, event, location string, r Reading, p Period, retention time.Duration) (bool, error) {
+	if s.err != nil {
+		return false, s.err
+	}
+	s.readings = append(s.readings, r)
+	s.retention = retention
+	if current, ok := s.weather[event]; ok && current.PublishedAt.After(r.PublishedAt) {
+		return false, nil
+	}
+	s.weather[event] = r
+	return true, nil
+}
+
+func (s *testStore) UpdateForecast(ctx context.Context, event string, periods []Period) error {
+	s.forecast[event] = periods
+	return nil
+}
+
+func (s *testStore) UpdateAlerts(ctx context.Context, event string, alerts []Alert) error {
+	s.alerts[event] = alerts
+	return nil
+}
+
+func (s *testStore) UpdateDailyForecast(ctx context.Context, event string, periods []Period) error {
+	return nil
+}
+
+// cachedPlace is a geocoded place cached by testStore.
+type cachedPlace struct {
+	location  string
+	place     *Place
+	updatedAt time.Time
+}
+
+func (s *testStore) CachedPlace(ctx context.Context, event, location string, ttl time.Duration) (*Place, error) {
+	c, ok := s.places[event]
+	if !ok || c.location != location || time.Since(c.updatedAt) > ttl {
+		return nil, nil
+	}
+	return c.place, nil
+}
+
+func (s *testStore) CachePlace(ctx context.Context, event, location string, p *Place) error {
+	s.places[event] = cachedPlace{location: location, place: p, updatedAt: time.Now()}
+	return nil
+}
+
+func (s *testStore) ClaimEvent(ctx context.Context, id string, lease time.Duration) (bool, error) {
+	if expires, ok := s.claimed[id]; ok && time.Now().Before(expires) {
+		return false, nil
+	}
+	s.claimed[id] = time.Now().Add(lease)
+	return true, nil
+}
+
+func (s *testStore) CompleteEvent(ctx context.Context, id string, ttl time.Duration) error {
+	s.claimed[id] = time.Now().Add(ttl)
+	return nil
+}
+
+func (s *testStore) ReleaseEvent(ctx context.Context, id string) error {
+	delete(s.claimed, id)
+	return nil
+}
+
+func (s *testStore) Event(ctx context.Context, name string) (*WeatherEvent, error) {
+	for _, e := range s.events {
+		if e.Slug == name || e.Event == name {
+			return &e.WeatherEvent, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *testStore) ActiveEvents(ctx context.Context) ([]RegisteredEvent, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return append([]RegisteredEvent(nil), s.events...), nil
+}
+
+func (s *testStore) MarkDispatched(ctx context.Context, slug string, t time.Time) error {
+	if s.markErr != nil {
+		return s.markErr
+	}
+	for i := range s.events {
+		if s.events[i].Slug == slug {
+			s.events[i].DispatchedAt = t
+		}
+	}
+	return nil
+}
+
+type testGeocoder struct {
+	calls int
+}
+
+func (g *testGeocoder) Geocode(ctx context.Context, location string) (*Place, error) {
+	g.calls++
+	if location == "Atlantis" {
+		return nil, &PermanentError{Err: errors.New("no places found for location \"Atlantis\"")}
+	}
+	return &Place{FormattedAddress: location, Lat: 39.7392, Lng: -104.9903}, nil
+}
+
+type testProvider struct {
+	temperature float64
+	alerts      []Alert
+	err         error
+	alertsErr   error
+}
+
+func (p *testProvider) Forecast(ctx context.Context, lat, lng float64) ([]Period, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	start := time.Now().Truncate(time.Hour)
+	return []Period{
+		{StartTime: start, EndTime: start.Add(time.Hour), Temperature: p.temperature},
+		{StartTime: start.Add(time.Hour), EndTime: start.Add(2 * time.Hour), Temperature: p.temperature + 1},
+	}, nil
+}
+
+func (p *testProvider) Alerts(ctx context.Context, lat, lng float64) ([]Alert, error) {
+	if p.alertsErr != nil {
+		return nil, p.alertsErr
+	}
+	return p.alerts, nil
+}
+
+type testPublisher struct {
+	topic      string
+	data       []byte
+	attributes map[string]string
+}
+
+func (p *testPublisher) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	p.topic, p.data, p.attributes = topic, data, attributes
+	return "1", nil
+}
+
+func newTestService() (*Service, *testStore, *testProvider, *testPublisher) {
+	store := newTestStore()
+	provider := &testProvider{temperature: 31, alerts: []Alert{{ID: "1", Type: "Heat Advisory"}}}
+	publisher := &testPublisher{}
+
+	config := defaultConfig
+	config.DeadLetterTopic = "weather-events-dead-letter"
+
+	s := &Service{
+		Store:     store,
+		Logger:    &testLogger{},
+		Geocoder:  &testGeocoder{},
+		Providers: map[string]WeatherProvider{"nws": provider},
+		Publisher: publisher,
+		Config:    config,
+	}
+	return s, store, provider, publisher
+}
+
+var gophercon = PubSubMessage{Data: []byte(`{"event": "GopherCon", "location": "Denver, Colorado, USA"}`)}
+
+func TestServiceCollect(t *testing.T) {
+	s, store, _, _ := newTestService()
+
+	if err := s.Collect(context.Background(), gophercon); err != nil {
+		t.Fatal(err)
+	}
+
+	r, ok := store.weather["GopherCon"]
+	if !ok {
+		t.Fatalf("missing weather for GopherCon")
+	}
+	if r.Temperature != 31 || r.Source != "forecast" || r.Provider != "nws" {
+		t.Errorf("wrong reading: got %+v", r)
+	}
+
+	if len(store.forecast["GopherCon"]) != 2 {
+		t.Errorf("wrong number of forecast periods: got %v want %v", len(store.forecast["GopherCon"]), 2)
+	}
+	if len(store.alerts["GopherCon"]) != 1 {
+		t.Errorf("wrong number of alerts: got %v want %v", len(store.alerts["GopherCon"]), 1)
+	}
+
+	geocoder := s.Geocoder.(*testGeocoder)
+	if err := s.Collect(context.Background(), gophercon); err != nil {
+		t.Fatal(err)
+	}
+	if geocoder.calls != 1 {
+		t.Errorf("wrong number of geocoder calls: got %v want %v", geocoder.calls, 1)
+	}
+}
+
+func TestServiceCollectForecast(t *testing.T) {
+	s, store, _, _ := newTestService()
+
+	if err := s.Collect(context.Background(), gophercon); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every forecast period is stored, not only the current hour.
+	periods := store.forecast["GopherCon"]
+	if len(periods) != 2 {
+		t.Fatalf("wrong number of forecast periods: got %v want %v", len(periods), 2)
+	}
+	if periods[0].Temperature != 31 || periods[1].Temperature != 32 {
+		t.Errorf("wrong forecast temperatures: got %v and %v want %v and %v", periods[0].Temperature, periods[1].Temperature, 31, 32)
+	}
+	for i, p := range periods {
+		if p.StartTime.IsZero() || p.EndTime.Sub(p.StartTime) != time.Hour {
+			t.Errorf("wrong times for forecast period %d: got %v to %v", i, p.StartTime, p.EndTime)
+		}
+	}
+	if !periods[1].StartTime.Equal(periods[0].EndTime) {
+		t.Errorf("forecast periods aren't consecutive: got %v and %v", periods[0].EndTime, periods[1].StartTime)
+	}
+}
+
+func TestServiceCollectReadings(t *testing.T) {
+	s, store, provider, _ := newTestService()
+	s.Config.ReadingsRetention = 7 * 24 * time.Hour
+
+	for _, temperature := range []float64{31, 33} {
+		provider.temperature = temperature
+		if err := s.Collect(context.Background(), gophercon); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every reading is appended to the history while the weather holds
+	// the latest.
+	if len(store.readings) != 2 || store.readings[0].Temperature != 31 || store.readings[1].Temperature != 33 {
+		t.Fatalf("wrong readings: got %+v", store.readings)
+	}
+	for _, r := range store.readings {
+		if r.Source != "forecast" || r.ObservedAt.IsZero() {
+			t.Errorf("wrong reading source or observation time: got %+v", r)
+		}
+	}
+	if store.weather["GopherCon"].Temperature != 33 {
+		t.Errorf("wrong latest temperature: got %v want %v", store.weather["GopherCon"].Temperature, 33)
+	}
+	if store.retention != s.Config.ReadingsRetention {
+		t.Errorf("wrong retention: got %v want %v", store.retention, s.Config.ReadingsRetention)
+	}
+}
+
+func TestServiceCollectAlerts(t *testing.T) {
+	s, store, provider, _ := newTestService()
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	provider.alerts = []Alert{{ID: "1", Type: "Heat Advisory", Severity: "Moderate", Headline: "Heat Advisory until 8 PM", Expires: expires}}
+
+	if err := s.Collect(context.Background(), gophercon); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := store.alerts["GopherCon"]
+	if len(alerts) != 1 || alerts[0].Severity != "Moderate" || alerts[0].Headline != "Heat Advisory until 8 PM" || !alerts[0].Expires.Equal(expires) {
+		t.Fatalf("wrong alerts: got %+v", alerts)
+	}
+
+	// The stored alerts are kept when the alerts feed fails.
+	provider.alertsErr = errors.New("503 Service Unavailable")
+	if err := s.Collect(context.Background(), gophercon); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.alerts["GopherCon"]) != 1 {
+		t.Errorf("stored alerts replaced after an alerts error: got %+v", store.alerts["GopherCon"])
+	}
+
+	// Alerts that are no longer active are removed.
+	provider.alertsErr = nil
+	provider.alerts = nil
+	if err := s.Collect(context.Background(), gophercon); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.alerts["GopherCon"]) != 0 {
+		t.Errorf("inactive alerts weren't removed: got %+v", store.alerts["GopherCon"])
+	}
+}
+
+func TestServiceGeocode(t *testing.T) {
+	s, store, _, _ := newTestService()
+	geocoder := s.Geocoder.(*testGeocoder)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		location string
+		age      time.Duration // age of the cache entry before geocoding
+		calls    int
+	}{
+		{"miss", "Denver, Colorado, USA", 0, 1},
+		{"hit", "Denver, Colorado, USA", 0, 1},
+		{"hit before the ttl", "Denver, Colorado, USA", s.Config.GeocodeCacheTTL - time.Hour, 1},
+		{"expired", "Denver, Colorado, USA", s.Config.GeocodeCacheTTL + time.Hour, 2},
+		{"location changed", "San Diego, California, USA", 0, 3},
+	}
+
+	for _, tt := range tests {
+		if c, ok := store.places["GopherCon"]; ok {
+			c.updatedAt = time.Now().Add(-tt.age)
+			store.places["GopherCon"] = c
+		}
+
+		place, err := s.geocode(ctx, "GopherCon", tt.location)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if place.FormattedAddress != tt.location {
+			t.Errorf("%s: wrong place: got %+v", tt.name, place)
+		}
+		if geocoder.calls != tt.calls {
+			t.Errorf("%s: wrong number of geocoder calls: got %v want %v", tt.name, geocoder.calls, tt.calls)
+		}
+		if c := store.places["GopherCon"]; c.location != tt.location || time.Since(c.updatedAt) > s.Config.GeocodeCacheTTL {
+			t.Errorf("%s: wrong cache entry: got %+v", tt.name, c)
+		}
+	}
+}
+
+func TestServiceGeocodeError(t *testing.T) {
+	s, store, _, _ := newTestService()
+
+	if _, err := s.geocode(context.Background(), "Gophers of Atlantis", "Atlantis"); err == nil {
+		t.Fatal("expected an error for a location without places")
+	}
+	if _, ok := store.places["Gophers of Atlantis"]; ok {
+		t.Errorf("failed geocode was cached")
+	}
+}
+
+func TestServiceCollectPermanentError(t *testing.T) {
+	tests := []string{
+		`{"event": "GopherCon"`,
+		`{"event": "GoLab", "location": "Florence, Italy", "provider": "met-office"}`,
+		`{"event": "GopherCon", "location": "Atlantis"}`,
+		`{"event": "GoLab"}`,
+		`{}`,
+	}
+
+	for _, data := range tests {
+		s, _, _, publisher := newTestService()
+
+		if err := s.Collect(context.Background(), PubSubMessage{Data: []byte(data)}); err != nil {
+			t.Errorf("permanent errors must not be retried: got %v for %s", err, data)
+		}
+
+		if publisher.topic != "weather-events-dead-letter" || string(publisher.data) != data {
+			t.Errorf("wrong dead-letter message for %s: got %v %s", data, publisher.topic, publisher.data)
+		}
+		if publisher.attributes["reason"] == "" {
+			t.Errorf("missing dead-letter reason for %s", data)
+		}
+	}
+}
+
+func TestServiceCollectTransientError(t *testing.T) {
+	s, store, provider, publisher := newTestService()
+	provider.err = errors.New("connection reset by peer")
+
+	ctx := newMetadataContext(context.Background(), &Metadata{
+		EventID:   "186226215410470",
+		Timestamp: time.Now().Add(-time.Minute),
+	})
+
+	if err := s.Collect(ctx, gophercon); err == nil {
+		t.Errorf("expected a transient error to be retried")
+	}
+	if publisher.topic != "" {
+		t.Errorf("transient errors must not be dead-lettered")
+	}
+	if _, ok := store.claimed["186226215410470"]; ok {
+		t.Errorf("failed events must be released")
+	}
+
+	// The retry is processed once the provider recovers.
+	provider.err = nil
+	if err := s.Collect(ctx, gophercon); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.weather["GopherCon"]; !ok {
+		t.Errorf("missing weather for GopherCon after retry")
+	}
+
+	// Stale events are dead-lettered instead of retried.
+	provider.err = errors.New("connection reset by peer")
+	ctx = newMetadataContext(context.Background(), &Metadata{
+		EventID:   "186226215410471",
+		Timestamp: time.Now().Add(-time.Hour),
+	})
+	if err := s.Collect(ctx, gophercon); err != nil {
+		t.Errorf("stale events must not be retried: got %v", err)
+	}
+	if publisher.attributes["eventId"] != "186226215410471" {
+		t.Errorf("wrong dead-letter event id: got %v", publisher.attributes["eventId"])
+	}
+
+	// A dead-lettered event stays claimed so redeliveries are skipped.
+	if expires, ok := store.claimed["186226215410471"]; !ok || time.Until(expires) <= s.Config.ClaimTimeout {
+		t.Errorf("dead-lettered event wasn't completed: got %v", expires)
+	}
+}
+
+func TestServiceCollectTransientErrorAttempts(t *testing.T) {
+	s, store, provider, publisher := newTestService()
+	provider.err = errors.New("connection reset by peer")
+
+	// Events without metadata are retried.
+	if err := s.Collect(context.Background(), gophercon); err == nil {
+		t.Errorf("expected a transient error without metadata to be retried")
+	}
+
+	// Events whose publish time is unknown are retried until they run
+	// out of delivery attempts.
+	for attempt := 1; attempt <= s.Config.MaxDeliveryAttempts; attempt++ {
+		ctx := newMetadataContext(context.Background(), &Metadata{
+			EventID:         "186226215410470",
+			DeliveryAttempt: attempt,
+		})
+
+		err := s.Collect(ctx, gophercon)
+		if last := attempt == s.Config.MaxDeliveryAttempts; last != (err == nil) {
+			t.Errorf("wrong result for delivery attempt %d: got %v", attempt, err)
+		}
+	}
+
+	if publisher.attributes["eventId"] != "186226215410470" {
+		t.Errorf("wrong dead-letter event id: got %v", publisher.attributes["eventId"])
+	}
+	if _, ok := store.claimed["186226215410470"]; !ok {
+		t.Errorf("dead-lettered event wasn't completed")
+	}
+}
+
+// useService makes F use s until the returned function is called.
+func useService(s *Service) func() {
+	savedService, savedInit := service, initService
+	service = s
+	initService = health.NewInitializer(func() error { return nil })
+	return func() { service, initService = savedService, savedInit }
+}
+
+func TestF(t *testing.T) {
+	s, store, provider, deadLetters := newTestService()
+	defer useService(s)()
+
+	m := PubSubMessage{
+		Data: gophercon.Data,
+		Attributes: map[string]string{
+			publisher.PublishIDAttribute:   "5f0c2ad3a1e04b7e",
+			publisher.PublishTimeAttribute: time.Now().Add(-time.Minute).Format(time.RFC3339Nano),
+		},
+	}
+
+	// Transient errors are retried using the publish time from the
+	// message attributes.
+	provider.err = errors.New("connection reset by peer")
+	if err := F(context.Background(), m); err == nil {
+		t.Errorf("expected a transient error to be retried")
+	}
+	if deadLetters.topic != "" {
+		t.Errorf("transient errors must not be dead-lettered")
+	}
+
+	provider.err = nil
+	if err := F(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.claimed["5f0c2ad3a1e04b7e"]; !ok {
+		t.Errorf("event 5f0c2ad3a1e04b7e wasn't claimed")
+	}
+
+	// A redelivery of the same message is skipped.
+	provider.temperature = 35
+	if err := F(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.readings) != 1 {
+		t.Errorf("wrong number of readings: got %v want %v", len(store.readings), 1)
+	}
+}
+
+func TestMessageMetadata(t *testing.T) {
+	if meta := messageMetadata(gophercon); meta != nil {
+		t.Errorf("wrong metadata for a message without attributes: got %+v want nil", meta)
+	}
+
+	published := time.Date(2018, 8, 28, 9, 0, 0, 0, time.UTC)
+	meta := messageMetadata(PubSubMessage{Attributes: map[string]string{
+		publisher.PublishIDAttribute:   "5f0c2ad3a1e04b7e",
+		publisher.PublishTimeAttribute: published.Format(time.RFC3339Nano),
+		deliveryAttemptAttribute:       "3",
+	}})
+	if meta == nil {
+		t.Fatal("missing metadata")
+	}
+	if meta.EventID != "5f0c2ad3a1e04b7e" {
+		t.Errorf("wrong event id: got %v want %v", meta.EventID, "5f0c2ad3a1e04b7e")
+	}
+	if !meta.Timestamp.Equal(published) {
+		t.Errorf("wrong timestamp: got %v want %v", meta.Timestamp, published)
+	}
+	if meta.DeliveryAttempt != 3 {
+		t.Errorf("wrong delivery attempt: got %v want %v", meta.DeliveryAttempt, 3)
+	}
+}
+
+func TestServiceCollectDuplicate(t *testing.T) {
+	s, store, provider, _ := newTestService()
+
+	ctx := newMetadataContext(context.Background(), &Metadata{
+		EventID:   "186226215410470",
+		Timestamp: time.Now(),
+	})
+
+	if err := s.Collect(ctx, gophercon); err != nil {
+		t.Fatal(err)
+	}
+
+	provider.temperature = 35
+	if err := s.Collect(ctx, gophercon); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.readings) != 1 {
+		t.Errorf("wrong number of readings: got %v want %v", len(store.readings), 1)
+	}
+}
+
+func TestServiceCollectClaims(t *testing.T) {
+	s, store, _, _ := newTestService()
+
+	ctx := newMetadataContext(context.Background(), &Metadata{
+		EventID:   "186226215410470",
+		Timestamp: time.Now(),
+	})
+
+	// An event claimed by another delivery is skipped.
+	store.claimed["186226215410470"] = time.Now().Add(time.Minute)
+	if err := s.Collect(ctx, gophercon); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.readings) != 0 {
+		t.Errorf("wrong number of readings: got %v want %v", len(store.readings), 0)
+	}
+
+	// An expired claim, left behind by an instance that crashed or
+	// timed out, doesn't stop the retry.
+	store.claimed["186226215410470"] = time.Now().Add(-time.Second)
+	if err := s.Collect(ctx, gophercon); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.readings) != 1 {
+		t.Errorf("wrong number of readings: got %v want %v", len(store.readings), 1)
+	}
+
+	// Once the event is processed it's remembered for ProcessedEventTTL.
+	expires := store.claimed["186226215410470"]
+	if min := time.Now().Add(s.Config.ProcessedEventTTL - time.Minute); expires.Before(min) {
+		t.Errorf("wrong claim expiry: got %v want after %v", expires, min)
+	}
+}
+
+func TestServiceCollectOutOfOrder(t *testing.T) {
+	s, store, provider, _ := newTestService()
+
+	newer := newMetadataContext(context.Background(), &Metadata{EventID: "2", Timestamp: time.Now()})
+	older := newMetadataContext(context.Background(), &Metadata{EventID: "1", Timestamp: time.Now().Add(-5 * time.Minute)})
+
+	if err := s.Collect(newer, gophercon); err != nil {
+		t.Fatal(err)
+	}
+
+	provider.temperature = 12
+	if err := s.Collect(older, gophercon); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := store.weather["GopherCon"].Temperature; got != 31 {
+		t.Errorf("wrong temperature after a late redelivery: got %v want %v", got, 31)
+	}
+	if len(store.readings) != 2 {
+		t.Errorf("wrong number of readings: got %v want %v", len(store.readings), 2)
+	}
+}
+
+func TestServiceCollectRegistry(t *testing.T) {
+	s, store, _, _ := newTestService()
+	store.events = []RegisteredEvent{
+		{Slug: "gophercon", WeatherEvent: WeatherEvent{Event: "GopherCon", Location: "Denver, Colorado, USA"}},
+		{Slug: "golab", WeatherEvent: WeatherEvent{Event: "GoLab", Location: "Florence, Italy", Lat: 43.7696, Lng: 11.2558}},
+	}
+
+	for _, data := range []string{`{"event": "gophercon"}`, `{"event": "GoLab"}`} {
+		if err := s.Collect(context.Background(), PubSubMessage{Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, event := range []string{"GopherCon", "GoLab"} {
+		if _, ok := store.weather[event]; !ok {
+			t.Errorf("missing weather for %s", event)
+		}
+	}
+
+	// Events with coordinates aren't geocoded.
+	if calls := s.Geocoder.(*testGeocoder).calls; calls != 1 {
+		t.Errorf("wrong number of geocoder calls: got %v want %v", calls, 1)
+	}
+}
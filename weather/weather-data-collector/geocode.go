@@ -0,0 +1,155 @@
+package function
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/logging"
+	"go.opencensus.io/trace"
+	"golang.org/x/time/rate"
+	"googlemaps.github.io/maps"
+)
+
+// Place holds the geocoded location of an event.
+type Place struct {
+	PlaceID          string
+	FormattedAddress string
+	Lat              float64
+	Lng              float64
+}
+
+// Geocoder finds the place for a location such as
+// "Denver, Colorado, USA".
+type Geocoder interface {
+	Geocode(ctx context.Context, location string) (*Place, error)
+}
+
+// geocode returns the geocoded location for an event. Results are
+// cached in the store and reused until the event location changes or
+// the cache entry is older than GeocodeCacheTTL.
+func (s *Service) geocode(ctx context.Context, event, location string) (*Place, error) {
+	ctx, span := trace.StartSpan(ctx, "google-maps-api")
+	defer span.End()
+
+	place, err := s.Store.CachedPlace(ctx, event, location, s.Config.GeocodeCacheTTL)
+	if err != nil {
+		// The cache is an optimization; fall back to the Maps API
+		// rather than failing the collection.
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("error reading geocode cache for %s: %v", event, err),
+			Severity: logging.Warning,
+		})
+	}
+	if place != nil {
+		return place, nil
+	}
+
+	place, err = s.Geocoder.Geocode(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Logger.Log(logging.Entry{
+		Payload:  fmt.Sprintf("caching geocoded location for %s: %s (%.4f,%.4f)", event, place.FormattedAddress, place.Lat, place.Lng),
+		Severity: logging.Info,
+	})
+
+	if err := s.Store.CachePlace(ctx, event, location, place); err != nil {
+		s.Logger.Log(logging.Entry{
+			Payload:  fmt.Sprintf("error updating geocode cache for %s: %v", event, err),
+			Severity: logging.Warning,
+		})
+	}
+
+	return place, nil
+}
+
+// MapsGeocoder is a Geocoder using the Google Maps Places API. Requests
+// are counted by method and status in the maps_requests metric.
+type MapsGeocoder struct {
+	Client *maps.Client
+
+	// Limiter limits the requests to every method of the Maps API so a
+	// burst of events can't exhaust the project's quota. It's shared
+	// by the instance; requests aren't limited when it's nil.
+	Limiter *rate.Limiter
+}
+
+func (g *MapsGeocoder) Geocode(ctx context.Context, location string) (*Place, error) {
+	id, err := g.findPlaceIDFromText(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	return g.getPlace(ctx, id)
+}
+
+func (g *MapsGeocoder) findPlaceIDFromText(ctx context.Context, location string) (string, error) {
+	ctx, span := trace.StartSpan(ctx, "google-maps-find-place")
+	defer span.End()
+
+	var r maps.FindPlaceFromTextResponse
+	err := g.do(ctx, "FindPlaceFromText", func() error {
+		var err error
+		r, err = g.Client.FindPlaceFromText(ctx,
+			&maps.FindPlaceFromTextRequest{
+				Input:     location,
+				InputType: maps.FindPlaceFromTextInputTypeTextQuery,
+			},
+		)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(r.Candidates) == 0 {
+		return "", &PermanentError{Err: fmt.Errorf("no places found for location %q", location)}
+	}
+
+	return r.Candidates[0].PlaceID, nil
+}
+
+func (g *MapsGeocoder) getPlace(ctx context.Context, id string) (*Place, error) {
+	ctx, span := trace.StartSpan(ctx, "google-maps-place-details")
+	defer span.End()
+
+	var r maps.PlaceDetailsResult
+	err := g.do(ctx, "PlaceDetails", func() error {
+		var err error
+		r, err = g.Client.PlaceDetails(ctx, &maps.PlaceDetailsRequest{PlaceID: id})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Place{
+		PlaceID:          id,
+		FormattedAddress: r.FormattedAddress,
+		Lat:              r.Geometry.Location.Lat,
+		Lng:              r.Geometry.Location.Lng,
+	}, nil
+}
+
+// do calls the Maps API method using f once Limiter allows it, and
+// records the response status. Over quota responses are returned as a
+// TransientError wrapping a QuotaError.
+func (g *MapsGeocoder) do(ctx context.Context, method string, f func() error) error {
+	if g.Limiter != nil {
+		if err := g.Limiter.Wait(ctx); err != nil {
+			return &TransientError{Err: fmt.Errorf("error waiting to call the Maps %s API: %v", method, err)}
+		}
+	}
+
+	err := f()
+
+	status := mapsStatus(err)
+	recordMapsRequest(ctx, method, status)
+
+	if status == "OVER_QUERY_LIMIT" {
+		return &TransientError{Err: &QuotaError{Method: method, Err: err}}
+	}
+
+	return err
+}
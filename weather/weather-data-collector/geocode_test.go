@@ -0,0 +1,140 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"golang.org/x/time/rate"
+	"googlemaps.github.io/maps"
+)
+
+func newTestMapsGeocoder(t *testing.T, ts *httptest.Server, limiter *rate.Limiter) *MapsGeocoder {
+	client, err := maps.NewClient(maps.WithAPIKey("test"), maps.WithBaseURL(ts.URL), maps.WithHTTPClient(ts.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MapsGeocoder{Client: client, Limiter: limiter}
+}
+
+// mapsRequestCount returns the number of requests to method that
+// returned status recorded by mapsRequestsView.
+func mapsRequestCount(t *testing.T, method, status string) int64 {
+	rows, err := view.RetrieveData(mapsRequestsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, row := range rows {
+		tags := make(map[tag.Key]string)
+		for _, t := range row.Tags {
+			tags[t.Key] = t.Value
+		}
+		if tags[methodKey] == method && tags[statusKey] == status {
+			return row.Data.(*view.CountData).Value
+		}
+	}
+
+	return 0
+}
+
+func TestMapsGeocoder(t *testing.T) {
+	if err := registerViews(); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(mapsRequestsView)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/maps/api/place/findplacefromtext/json":
+			fmt.Fprint(w, `{"status": "OK", "candidates": [{"place_id": "ChIJzxcfI6qAa4cR1jaKJ_j0jhE"}]}`)
+		case "/maps/api/place/details/json":
+			fmt.Fprint(w, `{"status": "OK", "result": {"formatted_address": "Denver, CO, USA",
+			  "geometry": {"location": {"lat": 39.7392, "lng": -104.9903}}}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	g := newTestMapsGeocoder(t, ts, rate.NewLimiter(rate.Every(time.Millisecond), 1))
+
+	place, err := g.Geocode(context.Background(), "Denver, Colorado, USA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if place.PlaceID != "ChIJzxcfI6qAa4cR1jaKJ_j0jhE" || place.Lat != 39.7392 {
+		t.Errorf("wrong place: got %+v", place)
+	}
+
+	for _, method := range []string{"FindPlaceFromText", "PlaceDetails"} {
+		if n := mapsRequestCount(t, method, "OK"); n != 1 {
+			t.Errorf("wrong number of %s requests: got %v want %v", method, n, 1)
+		}
+	}
+}
+
+func TestMapsGeocoderOverQueryLimit(t *testing.T) {
+	if err := registerViews(); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(mapsRequestsView)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status": "OVER_QUERY_LIMIT", "error_message": "You have exceeded your daily request quota for this API."}`)
+	}))
+	defer ts.Close()
+
+	g := newTestMapsGeocoder(t, ts, nil)
+
+	_, err := g.Geocode(context.Background(), "Denver, Colorado, USA")
+	te, ok := err.(*TransientError)
+	if !ok {
+		t.Fatalf("wrong error type: got %T want %T", err, &TransientError{})
+	}
+	qe, ok := te.Err.(*QuotaError)
+	if !ok {
+		t.Fatalf("wrong wrapped error type: got %T want %T", te.Err, &QuotaError{})
+	}
+	if qe.Method != "FindPlaceFromText" {
+		t.Errorf("wrong method: got %v want %v", qe.Method, "FindPlaceFromText")
+	}
+
+	if n := mapsRequestCount(t, "FindPlaceFromText", "OVER_QUERY_LIMIT"); n != 1 {
+		t.Errorf("wrong number of over quota requests: got %v want %v", n, 1)
+	}
+}
+
+func TestMapsGeocoderRateLimit(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"status": "ZERO_RESULTS", "candidates": []}`)
+	}))
+	defer ts.Close()
+
+	// The burst is used by the first request; the second can't be made
+	// before the context expires.
+	g := newTestMapsGeocoder(t, ts, rate.NewLimiter(rate.Every(time.Hour), 1))
+
+	if _, err := g.Geocode(context.Background(), "Atlantis"); err == nil {
+		t.Fatal("expected an error for a location without places")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := g.Geocode(ctx, "Atlantis")
+	if _, ok := err.(*TransientError); !ok {
+		t.Errorf("wrong error type: got %T want %T", err, &TransientError{})
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("wrong number of requests: got %v want %v", n, 1)
+	}
+}
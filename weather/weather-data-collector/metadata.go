@@ -0,0 +1,95 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kelseyhightower/weather-internal/publisher"
+)
+
+// pubsubPublishType is the event type of Pub/Sub messages delivered to
+// background functions.
+const pubsubPublishType = "google.pubsub.topic.publish"
+
+// deliveryAttemptAttribute is the message attribute Pub/Sub sets to the
+// delivery attempt on subscriptions with a dead-letter policy.
+const deliveryAttemptAttribute = "googclient_deliveryattempt"
+
+// Metadata holds the metadata of the event that triggered the function.
+//
+// It matches the Metadata type in cloud.google.com/go/functions/metadata,
+// which is newer than the vendored cloud.google.com/go release, plus the
+// delivery attempt reported by Pub/Sub. Until that dependency is
+// upgraded the metadata the runtime adds to the context isn't visible
+// here, so the entry point that decodes an event must add it with
+// newMetadataContext: ServeCloudEvent from the request and F from the
+// attributes set by publisher.PubSub.
+type Metadata struct {
+	EventID   string    `json:"eventId"`
+	Timestamp time.Time `json:"timestamp"`
+	EventType string    `json:"eventType"`
+	Resource  string    `json:"resource"`
+
+	// DeliveryAttempt counts the deliveries of the event, starting at
+	// 1. It's zero when the subscription doesn't count attempts, which
+	// Pub/Sub only does for subscriptions with a dead-letter policy.
+	DeliveryAttempt int `json:"deliveryAttempt,omitempty"`
+}
+
+type metadataKey struct{}
+
+// newMetadataContext returns a copy of ctx carrying m.
+func newMetadataContext(ctx context.Context, m *Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, m)
+}
+
+// metadataFromContext returns the event metadata carried by ctx.
+func metadataFromContext(ctx context.Context) (*Metadata, error) {
+	m, ok := ctx.Value(metadataKey{}).(*Metadata)
+	if !ok || m == nil {
+		return nil, fmt.Errorf("unable to find event metadata in context")
+	}
+	return m, nil
+}
+
+// messageMetadata returns the metadata of m from the publishId and
+// publishTime attributes set by publisher.PubSub, or nil when m was
+// published without them.
+func messageMetadata(m PubSubMessage) *Metadata {
+	id := m.Attributes[publisher.PublishIDAttribute]
+	if id == "" {
+		return nil
+	}
+
+	// An unparsable publish time is left zero, like a missing one.
+	timestamp, _ := time.Parse(time.RFC3339Nano, m.Attributes[publisher.PublishTimeAttribute])
+
+	return &Metadata{
+		EventID:         id,
+		Timestamp:       timestamp,
+		EventType:       pubsubPublishType,
+		DeliveryAttempt: messageDeliveryAttempt(m),
+	}
+}
+
+// messageDeliveryAttempt returns the delivery attempt Pub/Sub set on m,
+// or zero when it's unknown.
+func messageDeliveryAttempt(m PubSubMessage) int {
+	n, err := strconv.Atoi(m.Attributes[deliveryAttemptAttribute])
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// publishTime returns the time the event that triggered the function
+// was published, or the current time when the metadata is unknown.
+func publishTime(ctx context.Context) time.Time {
+	m, err := metadataFromContext(ctx)
+	if err != nil || m.Timestamp.IsZero() {
+		return time.Now().UTC()
+	}
+	return m.Timestamp.UTC()
+}
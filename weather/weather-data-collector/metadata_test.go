@@ -0,0 +1,24 @@
+package function
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPublishTime(t *testing.T) {
+	published := time.Date(2018, 8, 28, 15, 30, 0, 0, time.UTC)
+	ctx := newMetadataContext(context.Background(), &Metadata{
+		EventID:   "186226215410470",
+		Timestamp: published,
+	})
+
+	if got := publishTime(ctx); !got.Equal(published) {
+		t.Errorf("wrong publish time: got %v want %v", got, published)
+	}
+
+	before := time.Now()
+	if got := publishTime(context.Background()); got.Before(before) {
+		t.Errorf("wrong publish time without metadata: got %v want after %v", got, before)
+	}
+}
@@ -0,0 +1,45 @@
+package function
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	// mapsRequests counts the Google Maps API requests made by the
+	// instance, tagged with the API method and the response status.
+	mapsRequests = stats.Int64("weather-data-collector/maps_requests", "Google Maps API requests", stats.UnitDimensionless)
+
+	methodKey, _ = tag.NewKey("method")
+	statusKey, _ = tag.NewKey("status")
+
+	// mapsRequestsView is exported to Stackdriver Monitoring as
+	// custom.googleapis.com/opencensus/weather-data-collector/maps_requests.
+	mapsRequestsView = &view.View{
+		Name:        mapsRequests.Name(),
+		Description: "The number of Google Maps API requests by method and response status",
+		Measure:     mapsRequests,
+		TagKeys:     []tag.Key{methodKey, statusKey},
+		Aggregation: view.Count(),
+	}
+)
+
+// registerViews registers the views of the collector metrics. Metrics
+// are recorded before it's called but aren't aggregated or exported.
+func registerViews() error {
+	return view.Register(mapsRequestsView)
+}
+
+// recordMapsRequest counts a Google Maps API request to method that
+// returned status.
+func recordMapsRequest(ctx context.Context, method, status string) {
+	ctx, err := tag.New(ctx, tag.Upsert(methodKey, method), tag.Upsert(statusKey, status))
+	if err != nil {
+		return
+	}
+
+	stats.Record(ctx, mapsRequests.M(1))
+}
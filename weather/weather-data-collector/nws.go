@@ -0,0 +1,521 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// NoDataError is returned when api.weather.gov has no forecast data
+// for a point, either because the point is outside the United States
+// or because the forecast returned no periods. Retrying won't help.
+type NoDataError struct {
+	URL    string
+	Reason string
+}
+
+func (e *NoDataError) Error() string {
+	return fmt.Sprintf("no weather data from %s: %s", e.URL, e.Reason)
+}
+
+// StatusError is returned when api.weather.gov or Open-Meteo responds
+// with an unexpected status code, or api.weather.gov keeps responding
+// with a retryable status code after all retries have been used.
+type StatusError struct {
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("non 200 response code from %s: %d %s", e.URL, e.StatusCode, e.Body)
+}
+
+// NWSClient retrieves forecasts from the National Weather Service API
+// at api.weather.gov, which only covers the United States.
+//
+// Each request is bounded by Timeout and 5xx and 429 responses are
+// retried with exponential backoff. The /points lookup, which maps a
+// coordinate to its forecast gridpoint, is cached for GridpointTTL as
+// requested by the API docs:
+//
+//	https://www.weather.gov/documentation/services-web-api
+type NWSClient struct {
+	BaseURL      string
+	UserAgent    string
+	Client       *http.Client
+	Timeout      time.Duration
+	MaxRetries   int
+	MinBackoff   time.Duration
+	MaxBackoff   time.Duration
+	GridpointTTL time.Duration
+
+	mu         sync.Mutex
+	gridpoints map[string]gridpoint
+	stations   map[string]station
+}
+
+type gridpoint struct {
+	properties PointProperties
+	expires    time.Time
+}
+
+type station struct {
+	id      string
+	expires time.Time
+}
+
+// NewNWSClient returns an NWSClient for the api.weather.gov compatible
+// API at baseURL with the default timeouts and retry policy.
+func NewNWSClient(baseURL string) *NWSClient {
+	return &NWSClient{
+		BaseURL:      baseURL,
+		UserAgent:    "Weather Function 1.0",
+		Client:       &http.Client{},
+		Timeout:      10 * time.Second,
+		MaxRetries:   3,
+		MinBackoff:   250 * time.Millisecond,
+		MaxBackoff:   4 * time.Second,
+		GridpointTTL: 24 * time.Hour,
+	}
+}
+
+type Point struct {
+	Properties PointProperties
+}
+
+type PointProperties struct {
+	GridID         string
+	GridX          int
+	GridY          int
+	Forecast       string
+	ForecastHourly string
+}
+
+// HourlyForecast is the response from both the hourly and daily
+// api.weather.gov forecast endpoints, which only differ in the length
+// of their periods.
+type HourlyForecast struct {
+	Type       string
+	Properties Properties
+}
+
+type Properties struct {
+	Periods []ForecastPeriod
+}
+
+type ForecastPeriod struct {
+	Name                       string
+	StartTime                  time.Time
+	EndTime                    time.Time
+	IsDaytime                  bool
+	Temperature                float64
+	TemperatureUnit            string
+	WindSpeed                  string
+	WindDirection              string
+	RelativeHumidity           QuantitativeValue
+	ProbabilityOfPrecipitation QuantitativeValue
+	ShortForecast              string
+	DetailedForecast           string
+	Icon                       string
+}
+
+// period converts an api.weather.gov forecast period to a Period in
+// canonical units.
+func (fp ForecastPeriod) period() (Period, error) {
+	temperature, err := toCelsius(fp.Temperature, fp.TemperatureUnit)
+	if err != nil {
+		return Period{}, err
+	}
+
+	windSpeed, err := parseWindSpeed(fp.WindSpeed)
+	if err != nil {
+		return Period{}, err
+	}
+
+	return Period{
+		StartTime:                fp.StartTime,
+		EndTime:                  fp.EndTime,
+		IsDaytime:                fp.IsDaytime,
+		Temperature:              temperature,
+		Humidity:                 fp.RelativeHumidity.intValue(),
+		WindSpeed:                windSpeed,
+		WindDirection:            fp.WindDirection,
+		PrecipitationProbability: fp.ProbabilityOfPrecipitation.intValue(),
+		ShortForecast:            fp.ShortForecast,
+		Icon:                     fp.Icon,
+		Name:                     fp.Name,
+		DetailedForecast:         fp.DetailedForecast,
+	}, nil
+}
+
+// parseWindSpeed parses wind speeds such as "5 mph" and "5 to 10 km/h",
+// returning the highest speed in kilometres per hour.
+func parseWindSpeed(s string) (float64, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0, nil
+	}
+
+	var speed float64
+	for _, f := range fields[:len(fields)-1] {
+		if n, err := strconv.ParseFloat(f, 64); err == nil && n > speed {
+			speed = n
+		}
+	}
+
+	switch unit := fields[len(fields)-1]; unit {
+	case "mph":
+		return mphToKmh(speed), nil
+	case "km/h":
+		return speed, nil
+	default:
+		return 0, fmt.Errorf("unsupported wind speed unit %q in %q", unit, s)
+	}
+}
+
+// Alert is an active weather alert issued for a point. Expires is zero
+// for alerts without an expiry time, which the feed reports as null.
+type Alert struct {
+	ID       string    `json:"id"`
+	Type     string    `json:"event"`
+	Severity string    `json:"severity"`
+	Headline string    `json:"headline"`
+	Expires  time.Time `json:"expires"`
+}
+
+type AlertCollection struct {
+	Features []AlertFeature
+}
+
+type AlertFeature struct {
+	Properties Alert
+}
+
+// Alerts returns the active weather alerts for the point lat,lng.
+func (c *NWSClient) Alerts(ctx context.Context, lat, lng float64) ([]Alert, error) {
+	ctx, span := trace.StartSpan(ctx, "api.weather.gov/alerts/active")
+	defer span.End()
+
+	u := fmt.Sprintf("%s/alerts/active?point=%.4f,%.4f", c.BaseURL, lat, lng)
+
+	var collection AlertCollection
+	if err := c.get(ctx, u, &collection); err != nil {
+		return nil, err
+	}
+
+	alerts := make([]Alert, 0, len(collection.Features))
+	for _, f := range collection.Features {
+		alerts = append(alerts, f.Properties)
+	}
+
+	return alerts, nil
+}
+
+// Observation is the latest observed conditions reported by the
+// observation station nearest to a point.
+type Observation struct {
+	Station     string
+	Temperature float64
+	ObservedAt  time.Time
+}
+
+type StationCollection struct {
+	Features []StationFeature
+}
+
+type StationFeature struct {
+	Properties StationProperties
+}
+
+type StationProperties struct {
+	StationIdentifier string
+	Name              string
+}
+
+type LatestObservation struct {
+	Properties ObservationProperties
+}
+
+type ObservationProperties struct {
+	Timestamp   time.Time
+	Temperature QuantitativeValue
+}
+
+// QuantitativeValue is a measurement with a WMO unit code such as
+// wmoUnit:degC. Value is nil when the station didn't report it.
+type QuantitativeValue struct {
+	Value    *float64
+	UnitCode string
+}
+
+// intValue returns the value rounded to the nearest integer, or zero
+// when the value wasn't reported.
+func (q QuantitativeValue) intValue() int {
+	if q.Value == nil {
+		return 0
+	}
+	return int(math.Round(*q.Value))
+}
+
+// Observation returns the latest observation from the station nearest
+// to lat,lng.
+func (c *NWSClient) Observation(ctx context.Context, lat, lng float64) (*Observation, error) {
+	ctx, span := trace.StartSpan(ctx, "api.weather.gov/stations/observations/latest")
+	defer span.End()
+
+	id, err := c.Station(ctx, lat, lng)
+	if err != nil {
+		return nil, err
+	}
+
+	u := fmt.Sprintf("%s/stations/%s/observations/latest", c.BaseURL, id)
+
+	var latest LatestObservation
+	if err := c.get(ctx, u, &latest); err != nil {
+		return nil, err
+	}
+
+	t := latest.Properties.Temperature
+	if t.Value == nil {
+		return nil, &NoDataError{URL: u, Reason: "observation has no temperature"}
+	}
+
+	temperature, err := toCelsius(*t.Value, t.UnitCode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid observation from %s: %v", u, err)
+	}
+
+	return &Observation{
+		Station:     id,
+		Temperature: temperature,
+		ObservedAt:  latest.Properties.Timestamp,
+	}, nil
+}
+
+// Station returns the identifier of the observation station nearest
+// to lat,lng, using the cached value when one is available.
+func (c *NWSClient) Station(ctx context.Context, lat, lng float64) (string, error) {
+	key := fmt.Sprintf("%.4f,%.4f", lat, lng)
+
+	c.mu.Lock()
+	s, ok := c.stations[key]
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(s.expires) {
+		return s.id, nil
+	}
+
+	ctx, span := trace.StartSpan(ctx, "api.weather.gov/points/stations")
+	defer span.End()
+
+	u := c.pointURL(lat, lng) + "/stations"
+
+	// Stations are returned ordered by distance from the point.
+	var collection StationCollection
+	if err := c.get(ctx, u, &collection); err != nil {
+		return "", err
+	}
+
+	if len(collection.Features) == 0 {
+		return "", &NoDataError{URL: u, Reason: "no observation stations near point"}
+	}
+
+	id := collection.Features[0].Properties.StationIdentifier
+
+	c.mu.Lock()
+	if c.stations == nil {
+		c.stations = make(map[string]station)
+	}
+	c.stations[key] = station{id: id, expires: time.Now().Add(c.GridpointTTL)}
+	c.mu.Unlock()
+
+	return id, nil
+}
+
+// Forecast returns the hourly forecast for the gridpoint covering
+// lat,lng.
+func (c *NWSClient) Forecast(ctx context.Context, lat, lng float64) ([]Period, error) {
+	ctx, span := trace.StartSpan(ctx, "api.weather.gov/points/forecast/hourly")
+	defer span.End()
+
+	p, err := c.Point(ctx, lat, lng)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.ForecastHourly == "" {
+		return nil, &NoDataError{
+			URL:    c.pointURL(lat, lng),
+			Reason: "point has no hourly forecast",
+		}
+	}
+
+	return c.forecast(ctx, p.ForecastHourly)
+}
+
+// DailyForecast returns the 7 day forecast, in 12 hour day and night
+// periods, for the gridpoint covering lat,lng.
+func (c *NWSClient) DailyForecast(ctx context.Context, lat, lng float64) ([]Period, error) {
+	ctx, span := trace.StartSpan(ctx, "api.weather.gov/points/forecast")
+	defer span.End()
+
+	p, err := c.Point(ctx, lat, lng)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Forecast == "" {
+		return nil, &NoDataError{
+			URL:    c.pointURL(lat, lng),
+			Reason: "point has no forecast",
+		}
+	}
+
+	return c.forecast(ctx, p.Forecast)
+}
+
+func (c *NWSClient) forecast(ctx context.Context, u string) ([]Period, error) {
+	var forecast HourlyForecast
+	if err := c.get(ctx, u, &forecast); err != nil {
+		return nil, err
+	}
+
+	if len(forecast.Properties.Periods) == 0 {
+		return nil, &NoDataError{
+			URL:    u,
+			Reason: "forecast has no periods",
+		}
+	}
+
+	periods := make([]Period, 0, len(forecast.Properties.Periods))
+	for _, fp := range forecast.Properties.Periods {
+		period, err := fp.period()
+		if err != nil {
+			return nil, fmt.Errorf("invalid forecast period from %s: %v", u, err)
+		}
+		periods = append(periods, period)
+	}
+
+	return periods, nil
+}
+
+// Point returns the gridpoint metadata for lat,lng, using the cached
+// value when one is available.
+func (c *NWSClient) Point(ctx context.Context, lat, lng float64) (*PointProperties, error) {
+	key := fmt.Sprintf("%.4f,%.4f", lat, lng)
+
+	c.mu.Lock()
+	g, ok := c.gridpoints[key]
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(g.expires) {
+		return &g.properties, nil
+	}
+
+	ctx, span := trace.StartSpan(ctx, "api.weather.gov/points")
+	defer span.End()
+
+	var p Point
+	if err := c.get(ctx, c.pointURL(lat, lng), &p); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.gridpoints == nil {
+		c.gridpoints = make(map[string]gridpoint)
+	}
+	c.gridpoints[key] = gridpoint{properties: p.Properties, expires: time.Now().Add(c.GridpointTTL)}
+	c.mu.Unlock()
+
+	return &p.Properties, nil
+}
+
+func (c *NWSClient) pointURL(lat, lng float64) string {
+	return fmt.Sprintf("%s/points/%.4f,%.4f", c.BaseURL, lat, lng)
+}
+
+// get fetches u and decodes the JSON response into v, retrying 5xx
+// and 429 responses and transport errors up to MaxRetries times.
+func (c *NWSClient) get(ctx context.Context, u string, v interface{}) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryAfter time.Duration
+		retryAfter, err = c.do(ctx, u, v)
+		if retryAfter < 0 || attempt >= c.MaxRetries {
+			return err
+		}
+
+		backoff := c.MinBackoff << uint(attempt)
+		if retryAfter > backoff {
+			backoff = retryAfter
+		}
+		if backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// do performs a single request. A negative retryAfter means the error,
+// if any, must not be retried.
+func (c *NWSClient) do(ctx context.Context, u string, v interface{}) (retryAfter time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	request = request.WithContext(ctx)
+	request.Header.Add("User-Agent", c.UserAgent)
+	request.Header.Add("Accept", "application/geo+json")
+
+	// Redirects, which api.weather.gov uses to normalize coordinates,
+	// are followed by the http.Client.
+	response, err := c.Client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case response.StatusCode == http.StatusOK:
+	case response.StatusCode == http.StatusNotFound:
+		return -1, &NoDataError{URL: u, Reason: string(data)}
+	case response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500:
+		err := &StatusError{URL: u, StatusCode: response.StatusCode, Body: string(data)}
+		if s, perr := strconv.Atoi(response.Header.Get("Retry-After")); perr == nil {
+			return time.Duration(s) * time.Second, err
+		}
+		return 0, err
+	default:
+		return -1, &StatusError{URL: u, StatusCode: response.StatusCode, Body: string(data)}
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return -1, err
+	}
+
+	return -1, nil
+}
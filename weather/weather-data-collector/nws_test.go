@@ -0,0 +1,400 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const hourlyForecastResponse = `{
+  "type": "Feature",
+  "properties": {
+    "periods": [
+      {
+        "number": 1,
+        "startTime": "2018-08-28T10:00:00-06:00",
+        "endTime": "2018-08-28T11:00:00-06:00",
+        "isDaytime": true,
+        "temperature": 72,
+        "temperatureUnit": "F",
+        "probabilityOfPrecipitation": {"unitCode": "wmoUnit:percent", "value": 10},
+        "relativeHumidity": {"unitCode": "wmoUnit:percent", "value": 35},
+        "windSpeed": "5 mph",
+        "windDirection": "NW",
+        "icon": "https://api.weather.gov/icons/land/day/few?size=small",
+        "shortForecast": "Sunny"
+      },
+      {
+        "number": 2,
+        "startTime": "2018-08-28T11:00:00-06:00",
+        "endTime": "2018-08-28T12:00:00-06:00",
+        "temperature": 75,
+        "temperatureUnit": "F",
+        "isDaytime": true,
+        "probabilityOfPrecipitation": {"unitCode": "wmoUnit:percent", "value": null},
+        "windSpeed": "5 to 10 mph",
+        "windDirection": "W",
+        "shortForecast": "Mostly Sunny"
+      }
+    ]
+  }
+}`
+
+func newTestNWSClient(ts *httptest.Server) *NWSClient {
+	c := NewNWSClient(ts.URL)
+	c.Client = ts.Client()
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = 5 * time.Millisecond
+	return c
+}
+
+func pointsResponse(ts *httptest.Server) string {
+	return fmt.Sprintf(`{"properties": {"gridId": "BOU", "gridX": 62, "gridY": 60,
+	  "forecast": "%[1]s/gridpoints/BOU/62,60/forecast",
+	  "forecastHourly": "%[1]s/gridpoints/BOU/62,60/forecast/hourly"}}`, ts.URL)
+}
+
+func TestNWSClientForecast(t *testing.T) {
+	var pointsRequests int32
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") == "" {
+			t.Errorf("missing User-Agent header")
+		}
+		switch r.URL.Path {
+		case "/points/39.7392,-104.9903":
+			atomic.AddInt32(&pointsRequests, 1)
+			w.Write([]byte(pointsResponse(ts)))
+		case "/gridpoints/BOU/62,60/forecast/hourly":
+			w.Write([]byte(hourlyForecastResponse))
+		default:
+			t.Errorf("wrong request path: got %v", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	c := newTestNWSClient(ts)
+
+	for i := 0; i < 2; i++ {
+		periods, err := c.Forecast(context.Background(), 39.7392, -104.9903)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(periods) != 2 {
+			t.Fatalf("wrong number of periods: got %v want %v", len(periods), 2)
+		}
+
+		first := periods[0]
+		if !approxEqual(first.Temperature, 22.22) {
+			t.Errorf("wrong temperature: got %v want %v", first.Temperature, 22.22)
+		}
+		if !approxEqual(first.WindSpeed, 8.05) || first.WindDirection != "NW" {
+			t.Errorf("wrong wind: got %v %v want %v %v", first.WindSpeed, first.WindDirection, 8.05, "NW")
+		}
+		if first.Humidity != 35 || first.PrecipitationProbability != 10 {
+			t.Errorf("wrong humidity and precipitation: got %v %v want %v %v",
+				first.Humidity, first.PrecipitationProbability, 35, 10)
+		}
+		if first.ShortForecast != "Sunny" || !first.IsDaytime || first.Icon == "" {
+			t.Errorf("wrong conditions: got %v %v %v", first.ShortForecast, first.IsDaytime, first.Icon)
+		}
+
+		second := periods[1]
+		if !approxEqual(second.WindSpeed, 16.09) || second.PrecipitationProbability != 0 {
+			t.Errorf("wrong wind and precipitation: got %v %v want %v %v",
+				second.WindSpeed, second.PrecipitationProbability, 16.09, 0)
+		}
+		if got := first.EndTime.Sub(first.StartTime).Hours(); got != 1 {
+			t.Errorf("wrong period length: got %v want %v", got, 1)
+		}
+	}
+
+	if pointsRequests != 1 {
+		t.Errorf("gridpoint lookup not cached: got %v points requests want %v", pointsRequests, 1)
+	}
+}
+
+func TestNWSClientRetries(t *testing.T) {
+	var forecastRequests int32
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/points/39.7392,-104.9903":
+			w.Write([]byte(pointsResponse(ts)))
+		case "/gridpoints/BOU/62,60/forecast/hourly":
+			if atomic.AddInt32(&forecastRequests, 1) < 3 {
+				http.Error(w, `{"title": "Unexpected Problem"}`, http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(hourlyForecastResponse))
+		}
+	}))
+	defer ts.Close()
+
+	c := newTestNWSClient(ts)
+
+	if _, err := c.Forecast(context.Background(), 39.7392, -104.9903); err != nil {
+		t.Fatal(err)
+	}
+
+	if forecastRequests != 3 {
+		t.Errorf("wrong number of forecast requests: got %v want %v", forecastRequests, 3)
+	}
+}
+
+func TestNWSClientRetriesExhausted(t *testing.T) {
+	var requests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "", http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	c := newTestNWSClient(ts)
+
+	_, err := c.Forecast(context.Background(), 39.7392, -104.9903)
+
+	serr, ok := err.(*StatusError)
+	if !ok {
+		t.Fatalf("wrong error: got %v want *StatusError", err)
+	}
+	if serr.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("wrong status code: got %v want %v", serr.StatusCode, http.StatusTooManyRequests)
+	}
+
+	if want := int32(c.MaxRetries + 1); requests != want {
+		t.Errorf("wrong number of requests: got %v want %v", requests, want)
+	}
+}
+
+func TestNWSClientNoData(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/points/39.7392,-104.9903":
+			w.Write([]byte(pointsResponse(ts)))
+		case "/gridpoints/BOU/62,60/forecast/hourly":
+			w.Write([]byte(`{"properties": {"periods": []}}`))
+		default:
+			http.Error(w, `{"title": "Data Unavailable For Requested Point"}`, http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	c := newTestNWSClient(ts)
+
+	tests := []struct {
+		lat, lng float64
+	}{
+		{39.7392, -104.9903},
+		{52.5200, 13.4050},
+	}
+
+	for _, tt := range tests {
+		_, err := c.Forecast(context.Background(), tt.lat, tt.lng)
+		if _, ok := err.(*NoDataError); !ok {
+			t.Errorf("wrong error for (%v,%v): got %v want *NoDataError", tt.lat, tt.lng, err)
+		}
+	}
+}
+
+func TestNWSClientTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	c := newTestNWSClient(ts)
+	c.Timeout = 10 * time.Millisecond
+	c.MaxRetries = 0
+
+	if _, err := c.Forecast(context.Background(), 39.7392, -104.9903); err == nil {
+		t.Errorf("expected an error when the request times out")
+	}
+}
+
+func TestNWSClientAlerts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/alerts/active" || r.URL.Query().Get("point") != "39.7392,-104.9903" {
+			t.Errorf("wrong request: got %v", r.URL)
+		}
+		w.Write([]byte(`{
+		  "type": "FeatureCollection",
+		  "features": [
+		    {
+		      "properties": {
+		        "id": "urn:oid:2.49.0.1.840.0.1",
+		        "event": "Heat Advisory",
+		        "severity": "Moderate",
+		        "headline": "Heat Advisory issued August 28 at 10:00AM MDT until August 28 at 8:00PM MDT",
+		        "expires": "2018-08-28T20:00:00-06:00"
+		      }
+		    },
+		    {
+		      "properties": {
+		        "id": "urn:oid:2.49.0.1.840.0.2",
+		        "event": "Air Quality Alert",
+		        "severity": "Unknown",
+		        "headline": "Air Quality Alert issued August 28 at 9:00AM MDT",
+		        "expires": null
+		      }
+		    }
+		  ]
+		}`))
+	}))
+	defer ts.Close()
+
+	c := newTestNWSClient(ts)
+
+	alerts, err := c.Alerts(context.Background(), 39.7392, -104.9903)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(alerts) != 2 {
+		t.Fatalf("wrong number of alerts: got %v want %v", len(alerts), 2)
+	}
+
+	a := alerts[0]
+	if a.Type != "Heat Advisory" || a.Severity != "Moderate" {
+		t.Errorf("wrong alert: got %v %v want %v %v", a.Type, a.Severity, "Heat Advisory", "Moderate")
+	}
+	if a.Expires.IsZero() {
+		t.Errorf("missing alert expiry")
+	}
+	if !alerts[1].Expires.IsZero() {
+		t.Errorf("wrong expiry for an alert without one: got %v want the zero time", alerts[1].Expires)
+	}
+}
+
+func TestNWSClientObservation(t *testing.T) {
+	var stationsRequests int32
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/points/39.7392,-104.9903/stations":
+			atomic.AddInt32(&stationsRequests, 1)
+			w.Write([]byte(`{"features": [
+			  {"properties": {"stationIdentifier": "KBKF", "name": "Aurora, Buckley AFB"}},
+			  {"properties": {"stationIdentifier": "KDEN", "name": "Denver International Airport"}}
+			]}`))
+		case "/stations/KBKF/observations/latest":
+			w.Write([]byte(`{"properties": {
+			  "timestamp": "2018-08-28T16:53:00+00:00",
+			  "temperature": {"value": 22.2, "unitCode": "wmoUnit:degC"}
+			}}`))
+		case "/points/40.7128,-74.0060/stations":
+			w.Write([]byte(`{"features": [{"properties": {"stationIdentifier": "KNYC"}}]}`))
+		case "/stations/KNYC/observations/latest":
+			w.Write([]byte(`{"properties": {
+			  "timestamp": "2018-08-28T16:51:00+00:00",
+			  "temperature": {"value": null, "unitCode": "wmoUnit:degC"}
+			}}`))
+		default:
+			t.Errorf("wrong request path: got %v", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	c := newTestNWSClient(ts)
+
+	for i := 0; i < 2; i++ {
+		o, err := c.Observation(context.Background(), 39.7392, -104.9903)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if o.Station != "KBKF" {
+			t.Errorf("wrong station: got %v want %v", o.Station, "KBKF")
+		}
+		if o.Temperature != 22.2 {
+			t.Errorf("wrong temperature: got %v want %v", o.Temperature, 22.2)
+		}
+		want := time.Date(2018, 8, 28, 16, 53, 0, 0, time.UTC)
+		if !o.ObservedAt.Equal(want) {
+			t.Errorf("wrong observation time: got %v want %v", o.ObservedAt, want)
+		}
+	}
+
+	if stationsRequests != 1 {
+		t.Errorf("station lookup not cached: got %v stations requests want %v", stationsRequests, 1)
+	}
+
+	_, err := c.Observation(context.Background(), 40.7128, -74.0060)
+	if _, ok := err.(*NoDataError); !ok {
+		t.Errorf("wrong error for missing temperature: got %v want *NoDataError", err)
+	}
+}
+
+func TestNWSClientDailyForecast(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/points/39.7392,-104.9903":
+			w.Write([]byte(pointsResponse(ts)))
+		case "/gridpoints/BOU/62,60/forecast":
+			w.Write([]byte(`{"properties": {"periods": [
+			  {
+			    "name": "Tuesday",
+			    "startTime": "2018-08-28T06:00:00-06:00",
+			    "endTime": "2018-08-28T18:00:00-06:00",
+			    "isDaytime": true,
+			    "temperature": 88,
+			    "temperatureUnit": "F",
+			    "windSpeed": "5 to 10 mph",
+			    "windDirection": "S",
+			    "shortForecast": "Sunny",
+			    "detailedForecast": "Sunny, with a high near 88."
+			  },
+			  {
+			    "name": "Tuesday Night",
+			    "startTime": "2018-08-28T18:00:00-06:00",
+			    "endTime": "2018-08-29T06:00:00-06:00",
+			    "isDaytime": false,
+			    "temperature": 59,
+			    "temperatureUnit": "F",
+			    "windSpeed": "5 mph",
+			    "windDirection": "SW",
+			    "shortForecast": "Mostly Clear",
+			    "detailedForecast": "Mostly clear, with a low around 59."
+			  }
+			]}}`))
+		default:
+			t.Errorf("wrong request path: got %v", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	c := newTestNWSClient(ts)
+
+	periods, err := c.DailyForecast(context.Background(), 39.7392, -104.9903)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(periods) != 2 {
+		t.Fatalf("wrong number of periods: got %v want %v", len(periods), 2)
+	}
+
+	night := periods[1]
+	if night.Name != "Tuesday Night" || night.IsDaytime {
+		t.Errorf("wrong period: got %v %v want %v %v", night.Name, night.IsDaytime, "Tuesday Night", false)
+	}
+	if !approxEqual(night.Temperature, 15) {
+		t.Errorf("wrong temperature: got %v want %v", night.Temperature, 15)
+	}
+	if night.DetailedForecast == "" {
+		t.Errorf("missing detailed forecast")
+	}
+}
@@ -0,0 +1,182 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// OpenMeteoProvider retrieves forecasts from the Open-Meteo API, which
+// has global coverage and doesn't require an API key.
+//
+// See the Open-Meteo docs for more details:
+//
+//	https://open-meteo.com/en/docs
+type OpenMeteoProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+type openMeteoForecast struct {
+	Hourly openMeteoHourly `json:"hourly"`
+}
+
+type openMeteoHourly struct {
+	Time                     []int64   `json:"time"`
+	IsDay                    []int     `json:"is_day"`
+	Temperature              []float64 `json:"temperature_2m"`
+	Humidity                 []float64 `json:"relative_humidity_2m"`
+	PrecipitationProbability []float64 `json:"precipitation_probability"`
+	WeatherCode              []int     `json:"weather_code"`
+	WindSpeed                []float64 `json:"wind_speed_10m"`
+	WindDirection            []float64 `json:"wind_direction_10m"`
+}
+
+func (p *OpenMeteoProvider) Forecast(ctx context.Context, lat, lng float64) ([]Period, error) {
+	ctx, span := trace.StartSpan(ctx, "api.open-meteo.com/v1/forecast")
+	defer span.End()
+
+	u := fmt.Sprintf("%s/v1/forecast?latitude=%.4f&longitude=%.4f"+
+		"&hourly=is_day,temperature_2m,relative_humidity_2m,precipitation_probability,"+
+		"weather_code,wind_speed_10m,wind_direction_10m"+
+		"&temperature_unit=celsius&wind_speed_unit=kmh&timeformat=unixtime&forecast_days=7",
+		p.BaseURL, lat, lng)
+
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request = request.WithContext(ctx)
+	request.Header.Add("User-Agent", "Weather Function 1.0")
+
+	response, err := p.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response.Body.Close()
+
+	switch code := response.StatusCode; {
+	case code == http.StatusOK:
+	case code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests:
+		// Open-Meteo rejects coordinates it can't forecast with a 400
+		// response; retrying the event won't change that.
+		return nil, &PermanentError{Err: &StatusError{URL: u, StatusCode: code, Body: string(data)}}
+	default:
+		return nil, &StatusError{URL: u, StatusCode: code, Body: string(data)}
+	}
+
+	var forecast openMeteoForecast
+	if err := json.Unmarshal(data, &forecast); err != nil {
+		return nil, err
+	}
+
+	h := forecast.Hourly
+	n := len(h.Time)
+	if len(h.IsDay) != n || len(h.Temperature) != n || len(h.Humidity) != n ||
+		len(h.PrecipitationProbability) != n || len(h.WeatherCode) != n ||
+		len(h.WindSpeed) != n || len(h.WindDirection) != n {
+		return nil, fmt.Errorf("malformed open-meteo response: hourly series lengths differ")
+	}
+
+	// Open-Meteo returns whole days starting at midnight; skip the
+	// hours that have already passed so the first period is the
+	// current hour, matching the api.weather.gov hourly forecast.
+	now := time.Now()
+
+	periods := make([]Period, 0, len(h.Time))
+	for i, t := range h.Time {
+		start := time.Unix(t, 0).UTC()
+		end := start.Add(time.Hour)
+		if !end.After(now) {
+			continue
+		}
+
+		periods = append(periods, Period{
+			StartTime:                start,
+			EndTime:                  end,
+			IsDaytime:                h.IsDay[i] == 1,
+			Temperature:              h.Temperature[i],
+			Humidity:                 int(math.Round(h.Humidity[i])),
+			WindSpeed:                h.WindSpeed[i],
+			WindDirection:            compassDirection(h.WindDirection[i]),
+			PrecipitationProbability: int(math.Round(h.PrecipitationProbability[i])),
+			ShortForecast:            weatherCodeText(h.WeatherCode[i]),
+		})
+	}
+
+	return periods, nil
+}
+
+var compassPoints = []string{
+	"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE",
+	"S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW",
+}
+
+// compassDirection converts a direction in degrees to the 16 point
+// compass abbreviation used by api.weather.gov.
+func compassDirection(degrees float64) string {
+	i := int(math.Floor(math.Mod(degrees, 360)/22.5+0.5)) % len(compassPoints)
+	if i < 0 {
+		i += len(compassPoints)
+	}
+	return compassPoints[i]
+}
+
+// weatherCodeText converts a WMO weather interpretation code to a short
+// forecast description.
+func weatherCodeText(code int) string {
+	switch code {
+	case 0:
+		return "Clear"
+	case 1:
+		return "Mostly Clear"
+	case 2:
+		return "Partly Cloudy"
+	case 3:
+		return "Overcast"
+	case 45, 48:
+		return "Fog"
+	case 51, 53, 55:
+		return "Drizzle"
+	case 56, 57:
+		return "Freezing Drizzle"
+	case 61:
+		return "Light Rain"
+	case 63:
+		return "Rain"
+	case 65:
+		return "Heavy Rain"
+	case 66, 67:
+		return "Freezing Rain"
+	case 71:
+		return "Light Snow"
+	case 73:
+		return "Snow"
+	case 75:
+		return "Heavy Snow"
+	case 77:
+		return "Snow Grains"
+	case 80, 81, 82:
+		return "Rain Showers"
+	case 85, 86:
+		return "Snow Showers"
+	case 95:
+		return "Thunderstorms"
+	case 96, 99:
+		return "Thunderstorms With Hail"
+	}
+	return "Unknown"
+}
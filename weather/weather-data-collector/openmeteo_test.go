@@ -0,0 +1,121 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOpenMeteoProviderForecast(t *testing.T) {
+	// The first hour has already passed and should be skipped.
+	start := time.Now().Truncate(time.Hour).Add(-2 * time.Hour)
+
+	var forecast openMeteoForecast
+	for i := 0; i < 4; i++ {
+		h := &forecast.Hourly
+		h.Time = append(h.Time, start.Add(time.Duration(i)*time.Hour).Unix())
+		h.IsDay = append(h.IsDay, 1)
+		h.Temperature = append(h.Temperature, 60.4+float64(i))
+		h.Humidity = append(h.Humidity, 48)
+		h.PrecipitationProbability = append(h.PrecipitationProbability, 20)
+		h.WeatherCode = append(h.WeatherCode, 2)
+		h.WindSpeed = append(h.WindSpeed, 7.6)
+		h.WindDirection = append(h.WindDirection, 315)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/forecast" {
+			t.Errorf("wrong request path: got %v", r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("latitude") != "52.5200" || q.Get("longitude") != "13.4050" {
+			t.Errorf("wrong coordinates: got %v,%v", q.Get("latitude"), q.Get("longitude"))
+		}
+		json.NewEncoder(w).Encode(forecast)
+	}))
+	defer ts.Close()
+
+	p := &OpenMeteoProvider{BaseURL: ts.URL, Client: ts.Client()}
+
+	periods, err := p.Forecast(context.Background(), 52.52, 13.405)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(periods) != 2 {
+		t.Fatalf("wrong number of periods: got %v want %v", len(periods), 2)
+	}
+
+	first := periods[0]
+	if !first.StartTime.Equal(start.Add(2 * time.Hour)) {
+		t.Errorf("wrong start time: got %v want %v", first.StartTime, start.Add(2*time.Hour))
+	}
+	if !approxEqual(first.Temperature, 62.4) {
+		t.Errorf("wrong temperature: got %v want %v", first.Temperature, 62.4)
+	}
+	if first.WindSpeed != 7.6 || first.WindDirection != "NW" {
+		t.Errorf("wrong wind: got %v %v want %v %v", first.WindSpeed, first.WindDirection, 7.6, "NW")
+	}
+	if first.Humidity != 48 || first.PrecipitationProbability != 20 || !first.IsDaytime {
+		t.Errorf("wrong conditions: got %v %v %v", first.Humidity, first.PrecipitationProbability, first.IsDaytime)
+	}
+	if first.ShortForecast != "Partly Cloudy" {
+		t.Errorf("wrong short forecast: got %v want %v", first.ShortForecast, "Partly Cloudy")
+	}
+}
+
+func TestOpenMeteoProviderError(t *testing.T) {
+	tests := []struct {
+		code      int
+		permanent bool
+	}{
+		{http.StatusBadRequest, true},
+		{http.StatusNotFound, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	}
+
+	for _, tt := range tests {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, `{"error": true, "reason": "Latitude must be in range of -90 to 90°."}`, tt.code)
+		}))
+
+		p := &OpenMeteoProvider{BaseURL: ts.URL, Client: ts.Client()}
+
+		_, err := p.Forecast(context.Background(), 152.52, 13.405)
+		ts.Close()
+		if err == nil {
+			t.Errorf("expected an error for a %d response", tt.code)
+			continue
+		}
+		if _, ok := classify(err).(*PermanentError); ok != tt.permanent {
+			t.Errorf("wrong error classification for a %d response: got %T", tt.code, classify(err))
+		}
+	}
+}
+
+func TestCompassDirection(t *testing.T) {
+	tests := []struct {
+		degrees float64
+		want    string
+	}{
+		{0, "N"},
+		{11, "N"},
+		{12, "NNE"},
+		{90, "E"},
+		{200, "SSW"},
+		{350, "N"},
+		{360, "N"},
+	}
+
+	for _, tt := range tests {
+		if got := compassDirection(tt.degrees); got != tt.want {
+			t.Errorf("wrong direction for %v: got %v want %v", tt.degrees, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// defaultProviderName is used for events that don't name a provider.
+// api.weather.gov only covers the United States; events elsewhere
+// should set the provider field to a global provider such as
+// open-meteo.
+const defaultProviderName = "nws"
+
+// WeatherProvider retrieves the hourly forecast for a point. The
+// first period returned is treated as the current conditions.
+type WeatherProvider interface {
+	Forecast(ctx context.Context, lat, lng float64) ([]Period, error)
+}
+
+// AlertProvider is implemented by weather providers that also publish
+// active weather alerts, such as heat advisories and storm warnings.
+type AlertProvider interface {
+	Alerts(ctx context.Context, lat, lng float64) ([]Alert, error)
+}
+
+// ObservationProvider is implemented by weather providers that report
+// observed conditions in addition to forecasts.
+type ObservationProvider interface {
+	Observation(ctx context.Context, lat, lng float64) (*Observation, error)
+}
+
+// DailyForecastProvider is implemented by weather providers that
+// publish a multi-day forecast in day and night periods.
+type DailyForecastProvider interface {
+	DailyForecast(ctx context.Context, lat, lng float64) ([]Period, error)
+}
+
+// defaultProviders returns the available weather providers keyed by
+// the name used in the provider field of a WeatherEvent.
+func defaultProviders() map[string]WeatherProvider {
+	return map[string]WeatherProvider{
+		"nws": NewNWSClient("https://api.weather.gov"),
+		"open-meteo": &OpenMeteoProvider{
+			BaseURL: "https://api.open-meteo.com",
+			Client:  &http.Client{Timeout: 10 * time.Second},
+		},
+	}
+}
+
+func providerName(e WeatherEvent) string {
+	if e.Provider == "" {
+		return defaultProviderName
+	}
+	return e.Provider
+}
+
+func (s *Service) provider(e WeatherEvent) (WeatherProvider, error) {
+	name := providerName(e)
+	p, ok := s.Providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown weather provider %q for event %s", name, e.Event)
+	}
+	return p, nil
+}
@@ -0,0 +1,334 @@
+package function
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// SQLiteStore is a Store backed by a SQLite database file, for local
+// use and tests without Cloud SQL. It's selected with STORE=sqlite; see
+// openStore.
+type SQLiteStore struct {
+	DB *sql.DB
+}
+
+func (s *SQLiteStore) UpdateWeather(ctx context.Context, event, location string, r Reading, p Period, retention time.Duration) (latest bool, err error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	result, err := tx.Exec(sqliteWeatherQuery, event, location, r.Temperature, r.Source, r.ObservedAt.UTC(),
+		p.Humidity, p.WindSpeed, p.WindDirection, p.PrecipitationProbability,
+		p.ShortForecast, p.Icon, p.IsDaytime, r.PublishedAt.UTC())
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	_, err = tx.Exec(sqliteReadingQuery, event, r.Temperature, r.Source, r.Provider, r.ObservedAt.UTC(), r.PublishedAt.UTC())
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	if retention > 0 {
+		_, err := tx.Exec(sqlitePruneReadingsQuery, event, r.ObservedAt.Add(-retention).UTC())
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	return n > 0, tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateForecast(ctx context.Context, event string, periods []Period) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(sqlitePruneForecastQuery, event, time.Now().UTC()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, p := range periods {
+		_, err := tx.Exec(sqliteForecastQuery, event, p.StartTime.UTC(), p.EndTime.UTC(), p.IsDaytime,
+			p.Temperature, p.Humidity, p.WindSpeed, p.WindDirection,
+			p.PrecipitationProbability, p.ShortForecast, p.Icon)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateAlerts(ctx context.Context, event string, alerts []Alert) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(sqliteDeleteAlertsQuery, event); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, a := range alerts {
+		_, err := tx.Exec(sqliteAlertQuery, event, a.ID, a.Type, a.Severity, a.Headline, nullTime(a.Expires.UTC()))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) UpdateDailyForecast(ctx context.Context, event string, periods []Period) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(sqlitePruneDailyForecastQuery, event, time.Now().UTC()); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, p := range periods {
+		_, err := tx.Exec(sqliteDailyForecastQuery, event, p.StartTime.UTC(), p.EndTime.UTC(), p.Name, p.IsDaytime,
+			p.Temperature, p.WindSpeed, p.WindDirection, p.PrecipitationProbability,
+			p.ShortForecast, p.DetailedForecast, p.Icon)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) CachedPlace(ctx context.Context, event, location string, ttl time.Duration) (*Place, error) {
+	var (
+		p              Place
+		cachedLocation string
+		updatedAt      time.Time
+	)
+
+	err := s.DB.QueryRow(sqliteGeocodeQuery, event).Scan(&cachedLocation, &p.PlaceID,
+		&p.FormattedAddress, &p.Lat, &p.Lng, &updatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if cachedLocation != location || time.Since(updatedAt) > ttl {
+		return nil, nil
+	}
+
+	return &p, nil
+}
+
+func (s *SQLiteStore) CachePlace(ctx context.Context, event, location string, p *Place) error {
+	_, err := s.DB.Exec(sqliteCacheGeocodeQuery, event, location, p.PlaceID, p.FormattedAddress, p.Lat, p.Lng, time.Now().UTC())
+	return err
+}
+
+func (s *SQLiteStore) ClaimEvent(ctx context.Context, id string, lease time.Duration) (claimed bool, err error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec(sqlitePruneProcessedEventsQuery, now); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	result, err := tx.Exec(sqliteClaimEventQuery, id, now, now.Add(lease))
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return n > 0, tx.Commit()
+}
+
+func (s *SQLiteStore) CompleteEvent(ctx context.Context, id string, ttl time.Duration) error {
+	_, err := s.DB.Exec(sqliteCompleteEventQuery, id, time.Now().Add(ttl).UTC())
+	return err
+}
+
+func (s *SQLiteStore) ReleaseEvent(ctx context.Context, id string) error {
+	_, err := s.DB.Exec(sqliteReleaseEventQuery, id)
+	return err
+}
+
+func (s *SQLiteStore) Event(ctx context.Context, name string) (*WeatherEvent, error) {
+	e, err := scanEvent(s.DB.QueryRow(sqliteEventQuery, name))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (s *SQLiteStore) ActiveEvents(ctx context.Context) ([]RegisteredEvent, error) {
+	rows, err := s.DB.Query(sqliteActiveEventsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]RegisteredEvent, 0)
+	for rows.Next() {
+		var (
+			r            RegisteredEvent
+			pollInterval int
+			dispatchedAt pq.NullTime
+		)
+
+		e, err := scanEvent(rows, &r.Slug, &pollInterval, &dispatchedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		r.WeatherEvent = *e
+		r.PollInterval = time.Duration(pollInterval) * time.Second
+		r.DispatchedAt = dispatchedAt.Time
+		events = append(events, r)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *SQLiteStore) MarkDispatched(ctx context.Context, slug string, t time.Time) error {
+	_, err := s.DB.Exec(sqliteMarkDispatchedQuery, slug, t.UTC())
+	return err
+}
+
+// The SQLite queries match the PostgresStore queries, with times
+// passed as parameters instead of now().
+
+var sqliteWeatherQuery = `INSERT INTO weather (event, location, temperature, source, observed_at,
+    humidity, wind_speed, wind_direction, precipitation_probability, short_forecast, icon, is_daytime, published_at)
+  VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13)
+  ON CONFLICT (event)
+  DO UPDATE SET temperature = excluded.temperature,
+    source = excluded.source,
+    observed_at = excluded.observed_at,
+    humidity = excluded.humidity,
+    wind_speed = excluded.wind_speed,
+    wind_direction = excluded.wind_direction,
+    precipitation_probability = excluded.precipitation_probability,
+    short_forecast = excluded.short_forecast,
+    icon = excluded.icon,
+    is_daytime = excluded.is_daytime,
+    published_at = excluded.published_at
+  WHERE weather.published_at <= excluded.published_at;`
+
+var sqliteReadingQuery = `INSERT INTO readings (event, temperature, source, provider, observed_at, published_at)
+  VALUES (?1, ?2, ?3, ?4, ?5, ?6);`
+
+var sqlitePruneReadingsQuery = `DELETE FROM readings WHERE event = ?1 AND observed_at < ?2;`
+
+var sqliteAlertQuery = `INSERT INTO alerts (event, alert_id, alert_type, severity, headline, expires_at)
+  VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+  ON CONFLICT (event, alert_id) DO NOTHING;`
+
+var sqliteDeleteAlertsQuery = `DELETE FROM alerts WHERE event = ?1;`
+
+var sqliteForecastQuery = `INSERT INTO forecast (event, start_time, end_time, is_daytime, temperature,
+    humidity, wind_speed, wind_direction, precipitation_probability, short_forecast, icon)
+  VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11)
+  ON CONFLICT (event, start_time)
+  DO UPDATE SET end_time = excluded.end_time,
+    is_daytime = excluded.is_daytime,
+    temperature = excluded.temperature,
+    humidity = excluded.humidity,
+    wind_speed = excluded.wind_speed,
+    wind_direction = excluded.wind_direction,
+    precipitation_probability = excluded.precipitation_probability,
+    short_forecast = excluded.short_forecast,
+    icon = excluded.icon;`
+
+var sqlitePruneForecastQuery = `DELETE FROM forecast WHERE event = ?1 AND end_time < ?2;`
+
+var sqliteDailyForecastQuery = `INSERT INTO daily_forecast (event, start_time, end_time, name, is_daytime, temperature,
+    wind_speed, wind_direction, precipitation_probability, short_forecast, detailed_forecast, icon)
+  VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12)
+  ON CONFLICT (event, start_time)
+  DO UPDATE SET end_time = excluded.end_time,
+    name = excluded.name,
+    is_daytime = excluded.is_daytime,
+    temperature = excluded.temperature,
+    wind_speed = excluded.wind_speed,
+    wind_direction = excluded.wind_direction,
+    precipitation_probability = excluded.precipitation_probability,
+    short_forecast = excluded.short_forecast,
+    detailed_forecast = excluded.detailed_forecast,
+    icon = excluded.icon;`
+
+var sqlitePruneDailyForecastQuery = `DELETE FROM daily_forecast WHERE event = ?1 AND end_time < ?2;`
+
+var sqliteGeocodeQuery = `SELECT location, place_id, formatted_address, lat, lng, updated_at
+  FROM geocodes
+  WHERE event = ?1;`
+
+var sqliteCacheGeocodeQuery = `INSERT INTO geocodes (event, location, place_id, formatted_address, lat, lng, updated_at)
+  VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)
+  ON CONFLICT (event)
+  DO UPDATE SET location = excluded.location,
+    place_id = excluded.place_id,
+    formatted_address = excluded.formatted_address,
+    lat = excluded.lat,
+    lng = excluded.lng,
+    updated_at = excluded.updated_at;`
+
+var sqliteClaimEventQuery = `INSERT INTO processed_events (event_id, processed_at, expires_at) VALUES (?1, ?2, ?3)
+  ON CONFLICT (event_id) DO NOTHING;`
+
+var sqliteCompleteEventQuery = `UPDATE processed_events SET expires_at = ?2 WHERE event_id = ?1;`
+
+var sqliteReleaseEventQuery = `DELETE FROM processed_events WHERE event_id = ?1;`
+
+var sqlitePruneProcessedEventsQuery = `DELETE FROM processed_events WHERE expires_at < ?1;`
+
+var sqliteEventColumns = `name, location, lat, lng, timezone, provider, start_date, end_date`
+
+var sqliteEventQuery = `SELECT ` + sqliteEventColumns + `
+  FROM events
+  WHERE (slug = ?1 OR name = ?1) AND active;`
+
+var sqliteActiveEventsQuery = `SELECT ` + sqliteEventColumns + `, slug, poll_interval, dispatched_at
+  FROM events
+  WHERE active
+  ORDER BY name;`
+
+var sqliteMarkDispatchedQuery = `UPDATE events SET dispatched_at = ?2 WHERE slug = ?1;`
@@ -0,0 +1,392 @@
+package function
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kelseyhightower/weather-internal/database"
+)
+
+// newTestSQLiteStore returns a SQLiteStore for a new, migrated database
+// in a temporary directory. The events registry starts empty rather
+// than with the events seeded by the migrations.
+func newTestSQLiteStore(t *testing.T) (*SQLiteStore, func()) {
+	dir, err := ioutil.TempDir("", "weather")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := database.OpenSQLite(filepath.Join(dir, "weather.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	done := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+
+	m := &database.Migrator{DB: db, Migrations: database.Migrations, SQLite: true}
+	if _, err := m.Up(context.Background()); err != nil {
+		done()
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM events`); err != nil {
+		done()
+		t.Fatal(err)
+	}
+
+	return &SQLiteStore{DB: db}, done
+}
+
+func TestOpenStoreSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "weather-data-collector")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("STORE", "sqlite")
+	os.Setenv("SQLITE_PATH", filepath.Join(dir, "weather.db"))
+	defer os.Unsetenv("STORE")
+	defer os.Unsetenv("SQLITE_PATH")
+
+	ctx := context.Background()
+
+	// The database is migrated once; reopening it keeps the data.
+	store, err := openStore(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.(*SQLiteStore)
+	err = s.CachePlace(ctx, "GopherCon", "Denver, Colorado, USA", &Place{Lat: 39.7392})
+	s.DB.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = openStore(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = store.(*SQLiteStore)
+	defer s.DB.Close()
+
+	p, err := s.CachedPlace(ctx, "GopherCon", "Denver, Colorado, USA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || p.Lat != 39.7392 {
+		t.Errorf("wrong cached place after reopening the database: got %+v", p)
+	}
+
+	// The events registry is seeded by the migrations.
+	e, err := s.Event(ctx, "gophercon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e == nil || e.Event != "GopherCon" || e.Timezone != "America/Denver" {
+		t.Errorf("wrong seeded event: got %+v", e)
+	}
+}
+
+func TestSQLiteStoreUpdateWeather(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	now := time.Now().Truncate(time.Second)
+	reading := Reading{Temperature: 31, Source: "observed", Provider: "nws", ObservedAt: now, PublishedAt: now}
+	period := Period{Humidity: 20, ShortForecast: "Sunny", IsDaytime: true}
+
+	latest, err := s.UpdateWeather(ctx, "GopherCon", "Denver, Colorado, USA", reading, period, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !latest {
+		t.Errorf("first reading isn't the latest")
+	}
+
+	// A redelivered event published earlier is kept in the history but
+	// doesn't replace the current weather.
+	older := Reading{Temperature: 25, Source: "forecast", Provider: "nws", ObservedAt: now.Add(-time.Hour), PublishedAt: now.Add(-time.Hour)}
+	latest, err = s.UpdateWeather(ctx, "GopherCon", "Denver, Colorado, USA", older, period, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest {
+		t.Errorf("older reading replaced the current weather")
+	}
+
+	var (
+		temperature   float64
+		shortForecast string
+		observedAt    time.Time
+	)
+	err = s.DB.QueryRow(`SELECT temperature, short_forecast, observed_at FROM weather WHERE event = ?1`, "GopherCon").
+		Scan(&temperature, &shortForecast, &observedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if temperature != 31 || shortForecast != "Sunny" || !observedAt.Equal(now) {
+		t.Errorf("wrong current weather: got %v %v %v", temperature, shortForecast, observedAt)
+	}
+
+	if n := countRows(t, s, "readings"); n != 2 {
+		t.Errorf("wrong number of readings: got %v want %v", n, 2)
+	}
+
+	// Readings older than the retention window are pruned.
+	newer := Reading{Temperature: 32, Source: "observed", Provider: "nws", ObservedAt: now.Add(time.Hour), PublishedAt: now.Add(time.Hour)}
+	if _, err := s.UpdateWeather(ctx, "GopherCon", "Denver, Colorado, USA", newer, period, 90*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, s, "readings"); n != 2 {
+		t.Errorf("wrong number of readings after pruning: got %v want %v", n, 2)
+	}
+}
+
+// countRows returns the number of rows in table.
+func countRows(t *testing.T, s *SQLiteStore, table string) int {
+	var n int
+	if err := s.DB.QueryRow(`SELECT count(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSQLiteStoreUpdateForecast(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	start := time.Now().Truncate(time.Hour)
+	period := func(offset int, temperature float64) Period {
+		return Period{
+			StartTime:   start.Add(time.Duration(offset) * time.Hour),
+			EndTime:     start.Add(time.Duration(offset+1) * time.Hour),
+			Temperature: temperature,
+		}
+	}
+
+	if err := s.UpdateForecast(ctx, "GopherCon", []Period{period(-2, 20), period(0, 21), period(1, 22)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateForecast(ctx, "GopherCon", []Period{period(2, 24), period(1, 23)}); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := s.DB.Query(`SELECT temperature FROM forecast WHERE event = ?1 ORDER BY start_time`, "GopherCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	// The ended period is dropped and the updated period replaced.
+	var got []float64
+	for rows.Next() {
+		var temperature float64
+		if err := rows.Scan(&temperature); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, temperature)
+	}
+	want := []float64{21, 23, 24}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("wrong forecast temperatures: got %v want %v", got, want)
+	}
+}
+
+func TestSQLiteStoreAlerts(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	alerts := []Alert{
+		{ID: "1", Type: "Heat Advisory", Severity: "Moderate", Expires: time.Now().Add(time.Hour)},
+		{ID: "2", Type: "Air Quality Alert", Severity: "Unknown"},
+	}
+	if err := s.UpdateAlerts(ctx, "GopherCon", alerts); err != nil {
+		t.Fatal(err)
+	}
+
+	var withoutExpiry int
+	if err := s.DB.QueryRow(`SELECT count(*) FROM alerts WHERE expires_at IS NULL`).Scan(&withoutExpiry); err != nil {
+		t.Fatal(err)
+	}
+	if withoutExpiry != 1 {
+		t.Errorf("wrong number of alerts without an expiry: got %v want %v", withoutExpiry, 1)
+	}
+
+	// Alerts dropped from the feed are removed.
+	if err := s.UpdateAlerts(ctx, "GopherCon", alerts[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, s, "alerts"); n != 1 {
+		t.Errorf("wrong number of alerts: got %v want %v", n, 1)
+	}
+}
+
+func TestSQLiteStoreClaimEvent(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	tests := []struct {
+		claim   bool
+		lease   time.Duration
+		claimed bool
+	}{
+		{true, time.Hour, true},
+		{true, time.Hour, false},
+		{false, -time.Minute, true},
+		// Expired claims are forgotten.
+		{true, time.Hour, true},
+		{true, time.Hour, false},
+	}
+
+	for i, tt := range tests {
+		if !tt.claim {
+			if err := s.ReleaseEvent(ctx, "186226215410470"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		claimed, err := s.ClaimEvent(ctx, "186226215410470", tt.lease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != tt.claimed {
+			t.Errorf("%d: wrong claimed: got %v want %v", i, claimed, tt.claimed)
+		}
+	}
+
+	// Completing an event replaces the expiry of its claim.
+	if err := s.CompleteEvent(ctx, "186226215410470", -time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	claimed, err := s.ClaimEvent(ctx, "186226215410470", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Errorf("wrong claimed after the completed claim expired: got %v want %v", claimed, true)
+	}
+}
+
+func TestSQLiteStorePlace(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	place := &Place{PlaceID: "ChIJzxcfI6qAa4cR1jaKJ_j0jhE", FormattedAddress: "Denver, CO, USA", Lat: 39.7392, Lng: -104.9903}
+	if err := s.CachePlace(ctx, "GopherCon", "Denver, Colorado, USA", place); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := s.CachedPlace(ctx, "GopherCon", "Denver, Colorado, USA", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil || *p != *place {
+		t.Errorf("wrong cached place: got %+v want %+v", p, place)
+	}
+
+	p, err = s.CachedPlace(ctx, "GopherCon", "San Diego, California, USA", time.Hour)
+	if err != nil || p != nil {
+		t.Errorf("cached place returned for a new location: got %+v, %v", p, err)
+	}
+
+	// Entries older than the TTL aren't reused.
+	if _, err := s.DB.Exec(`UPDATE geocodes SET updated_at = ?1`, time.Now().Add(-2*time.Hour).UTC()); err != nil {
+		t.Fatal(err)
+	}
+	p, err = s.CachedPlace(ctx, "GopherCon", "Denver, Colorado, USA", time.Hour)
+	if err != nil || p != nil {
+		t.Errorf("cached place returned after the TTL: got %+v, %v", p, err)
+	}
+}
+
+func TestSQLiteStoreEvents(t *testing.T) {
+	s, done := newTestSQLiteStore(t)
+	defer done()
+
+	ctx := context.Background()
+
+	// The registry is written by weather-api.
+	_, err := s.DB.Exec(`INSERT INTO events (slug, name, location, lat, lng, poll_interval, active) VALUES
+    ('gophercon', 'GopherCon', 'Denver, Colorado, USA', 39.7392, -104.9903, 300, true),
+    ('go-northwest', 'Go Northwest', 'Seattle, Washington, USA', NULL, NULL, 600, true),
+    ('gotham-go', 'GothamGo', 'New York, New York, USA', NULL, NULL, 300, false)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"gophercon", "GopherCon"} {
+		e, err := s.Event(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e == nil || e.Event != "GopherCon" || e.Lat != 39.7392 {
+			t.Errorf("wrong event for %s: got %+v", name, e)
+		}
+	}
+
+	e, err := s.Event(ctx, "GothamGo")
+	if err != nil || e != nil {
+		t.Errorf("inactive event returned: got %+v, %v", e, err)
+	}
+
+	active, err := s.ActiveEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(active) != 2 || active[0].Slug != "go-northwest" || active[1].Slug != "gophercon" {
+		t.Fatalf("wrong active events: got %+v", active)
+	}
+	if active[0].PollInterval != 10*time.Minute || !active[0].DispatchedAt.IsZero() {
+		t.Errorf("wrong poll interval or dispatched at: got %v, %v", active[0].PollInterval, active[0].DispatchedAt)
+	}
+
+	dispatchedAt := time.Now().Truncate(time.Second)
+	if err := s.MarkDispatched(ctx, "gophercon", dispatchedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	active, err = s.ActiveEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !active[1].DispatchedAt.Equal(dispatchedAt) {
+		t.Errorf("wrong dispatched at: got %v want %v", active[1].DispatchedAt, dispatchedAt)
+	}
+}
+
+func TestServiceCollectSQLite(t *testing.T) {
+	store, done := newTestSQLiteStore(t)
+	defer done()
+
+	s, _, _, _ := newTestService()
+	s.Store = store
+
+	if err := s.Collect(context.Background(), gophercon); err != nil {
+		t.Fatal(err)
+	}
+
+	for table, want := range map[string]int{"weather": 1, "readings": 1, "forecast": 2, "alerts": 1, "geocodes": 1} {
+		if n := countRows(t, store, table); n != want {
+			t.Errorf("wrong number of %s rows: got %v want %v", table, n, want)
+		}
+	}
+}
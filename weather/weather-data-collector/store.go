@@ -0,0 +1,520 @@
+package function
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/kelseyhightower/weather-internal/database"
+	"github.com/kelseyhightower/weather-internal/firestoredb"
+	"github.com/kelseyhightower/weather-internal/secrets"
+	"github.com/lib/pq"
+	"go.opencensus.io/trace"
+)
+
+// Store persists the collected weather data.
+type Store interface {
+	// UpdateWeather appends r to the event readings and sets it as the
+	// current weather for the event, unless the current weather was
+	// published after r. latest is false when the current weather
+	// wasn't replaced. Readings older than retention are pruned; zero
+	// keeps them forever.
+	UpdateWeather(ctx context.Context, event, location string, r Reading, p Period, retention time.Duration) (latest bool, err error)
+
+	// UpdateForecast stores the hourly forecast periods for an event.
+	UpdateForecast(ctx context.Context, event string, periods []Period) error
+
+	// UpdateAlerts replaces the active weather alerts for an event.
+	UpdateAlerts(ctx context.Context, event string, alerts []Alert) error
+
+	// UpdateDailyForecast stores the daily forecast periods for the
+	// event days.
+	UpdateDailyForecast(ctx context.Context, event string, periods []Period) error
+
+	// CachedPlace returns the geocoded place for event, or nil if
+	// there's no cache entry for location newer than ttl.
+	CachedPlace(ctx context.Context, event, location string, ttl time.Duration) (*Place, error)
+
+	// CachePlace caches the geocoded place for an event location.
+	CachePlace(ctx context.Context, event, location string, p *Place) error
+
+	// ClaimEvent records that the event with the given ID is being
+	// processed, for at most lease, and forgets expired claims. claimed
+	// is false when an earlier delivery holds an unexpired claim. A
+	// claim left behind by an instance that crashed or timed out
+	// expires after lease, so the retry is processed.
+	ClaimEvent(ctx context.Context, id string, lease time.Duration) (claimed bool, err error)
+
+	// CompleteEvent extends the claim on an event that was processed
+	// to ttl, so duplicate deliveries within ttl are skipped.
+	CompleteEvent(ctx context.Context, id string, ttl time.Duration) error
+
+	// ReleaseEvent removes the claim on an event that failed so it can
+	// be processed again when it's retried.
+	ReleaseEvent(ctx context.Context, id string) error
+
+	// Event returns the active event in the events registry with the
+	// given slug or name, or nil if there's no such event.
+	Event(ctx context.Context, name string) (*WeatherEvent, error)
+
+	// ActiveEvents returns the active events in the events registry.
+	ActiveEvents(ctx context.Context) ([]RegisteredEvent, error)
+
+	// MarkDispatched records that the event with the given slug was
+	// published by the dispatcher at t.
+	MarkDispatched(ctx context.Context, slug string, t time.Time) error
+}
+
+// openStore opens the Store selected by the STORE environment
+// variable: postgres, the default, for the Cloud SQL weather database,
+// firestore, which also works with the Firestore emulator, or sqlite
+// for the SQLite database file at SQLITE_PATH.
+func openStore(ctx context.Context, source secrets.Source) (Store, error) {
+	switch backend := os.Getenv("STORE"); backend {
+	case "", "postgres":
+		db, err := database.OpenPostgres(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+
+		// Google Cloud Functions ensures a single request per function
+		// invocation. Avoid exhausting database connections by limiting
+		// this function to a single database connection.
+		//
+		// See the cloud functions docs for more details:
+		//
+		//    https://cloud.google.com/functions/docs/sql
+		//
+		db.SetMaxIdleConns(1)
+		db.SetMaxOpenConns(1)
+
+		// Apply pending schema migrations on cold start when
+		// MIGRATE_ON_START is set, instead of running weather-migrate.
+		if os.Getenv("MIGRATE_ON_START") == "true" {
+			m := &database.Migrator{DB: db, Migrations: database.Migrations}
+			if _, err := m.Up(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		return &PostgresStore{DB: db}, nil
+	case "firestore":
+		client, err := firestoredb.NewClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &FirestoreStore{Client: client}, nil
+	case "sqlite":
+		db, err := database.OpenSQLite(os.Getenv("SQLITE_PATH"))
+		if err != nil {
+			return nil, err
+		}
+
+		// SQLite databases are local, so they're always migrated.
+		m := &database.Migrator{DB: db, Migrations: database.Migrations, SQLite: true}
+		if _, err := m.Up(ctx); err != nil {
+			return nil, err
+		}
+
+		return &SQLiteStore{DB: db}, nil
+	default:
+		return nil, fmt.Errorf("unknown STORE %q", backend)
+	}
+}
+
+// PostgresStore is a Store backed by the Cloud SQL weather database.
+type PostgresStore struct {
+	DB *sql.DB
+}
+
+func (s *PostgresStore) UpdateWeather(ctx context.Context, event, location string, r Reading, p Period, retention time.Duration) (latest bool, err error) {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	result, err := tx.Exec(query, event, location, r.Temperature, r.Source, r.ObservedAt,
+		p.Humidity, p.WindSpeed, p.WindDirection, p.PrecipitationProbability,
+		p.ShortForecast, p.Icon, p.IsDaytime, r.PublishedAt)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	_, err = tx.Exec(readingQuery, event, r.Temperature, r.Source, r.Provider, r.ObservedAt, r.PublishedAt)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	// Prune readings older than the retention window. Pruning per event
+	// on each collection keeps every delete small.
+	if retention > 0 {
+		_, err := tx.Exec(pruneReadingsQuery, event, r.ObservedAt.Add(-retention))
+		if err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	return n > 0, tx.Commit()
+}
+
+func (s *PostgresStore) UpdateForecast(ctx context.Context, event string, periods []Period) error {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(pruneForecastQuery, event); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, p := range periods {
+		_, err := tx.Exec(forecastQuery, event, p.StartTime, p.EndTime, p.IsDaytime,
+			p.Temperature, p.Humidity, p.WindSpeed, p.WindDirection,
+			p.PrecipitationProbability, p.ShortForecast, p.Icon)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) UpdateAlerts(ctx context.Context, event string, alerts []Alert) error {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Alerts that are no longer active are dropped from the feed, so
+	// replace the stored alerts for the event rather than merging.
+	if _, err := tx.Exec(deleteAlertsQuery, event); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, a := range alerts {
+		_, err := tx.Exec(alertQuery, event, a.ID, a.Type, a.Severity, a.Headline, nullTime(a.Expires))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) UpdateDailyForecast(ctx context.Context, event string, periods []Period) error {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(pruneDailyForecastQuery, event); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	for _, p := range periods {
+		_, err := tx.Exec(dailyForecastQuery, event, p.StartTime, p.EndTime, p.Name, p.IsDaytime,
+			p.Temperature, p.WindSpeed, p.WindDirection, p.PrecipitationProbability,
+			p.ShortForecast, p.DetailedForecast, p.Icon)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) CachedPlace(ctx context.Context, event, location string, ttl time.Duration) (*Place, error) {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	var (
+		p              Place
+		cachedLocation string
+		updatedAt      time.Time
+	)
+
+	err := s.DB.QueryRow(geocodeQuery, event).Scan(&cachedLocation, &p.PlaceID,
+		&p.FormattedAddress, &p.Lat, &p.Lng, &updatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if cachedLocation != location || time.Since(updatedAt) > ttl {
+		return nil, nil
+	}
+
+	return &p, nil
+}
+
+func (s *PostgresStore) CachePlace(ctx context.Context, event, location string, p *Place) error {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	_, err := s.DB.Exec(cacheGeocodeQuery, event, location, p.PlaceID, p.FormattedAddress, p.Lat, p.Lng)
+	return err
+}
+
+func (s *PostgresStore) ClaimEvent(ctx context.Context, id string, lease time.Duration) (claimed bool, err error) {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	// Prune expired claims first so an ID redelivered after its claim
+	// expired is processed again.
+	now := time.Now()
+	if _, err := tx.Exec(pruneProcessedEventsQuery, now); err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	result, err := tx.Exec(claimEventQuery, id, now.Add(lease))
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+
+	return n > 0, tx.Commit()
+}
+
+func (s *PostgresStore) CompleteEvent(ctx context.Context, id string, ttl time.Duration) error {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	_, err := s.DB.Exec(completeEventQuery, id, time.Now().Add(ttl))
+	return err
+}
+
+func (s *PostgresStore) ReleaseEvent(ctx context.Context, id string) error {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	_, err := s.DB.Exec(releaseEventQuery, id)
+	return err
+}
+
+func (s *PostgresStore) Event(ctx context.Context, name string) (*WeatherEvent, error) {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	e, err := scanEvent(s.DB.QueryRow(eventQuery, name))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (s *PostgresStore) ActiveEvents(ctx context.Context) ([]RegisteredEvent, error) {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	rows, err := s.DB.Query(activeEventsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]RegisteredEvent, 0)
+	for rows.Next() {
+		var (
+			r            RegisteredEvent
+			pollInterval int
+			dispatchedAt pq.NullTime
+		)
+
+		e, err := scanEvent(rows, &r.Slug, &pollInterval, &dispatchedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		r.WeatherEvent = *e
+		r.PollInterval = time.Duration(pollInterval) * time.Second
+		r.DispatchedAt = dispatchedAt.Time
+		events = append(events, r)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *PostgresStore) MarkDispatched(ctx context.Context, slug string, t time.Time) error {
+	ctx, span := trace.StartSpan(ctx, "cloud-sql")
+	defer span.End()
+
+	_, err := s.DB.Exec(markDispatchedQuery, slug, t)
+	return err
+}
+
+// scanEvent scans a row selected by eventColumns, followed by any
+// extra columns into extra. Coordinates and dates are optional.
+func scanEvent(row interface {
+	Scan(dest ...interface{}) error
+}, extra ...interface{}) (*WeatherEvent, error) {
+	var (
+		e          WeatherEvent
+		lat, lng   sql.NullFloat64
+		start, end sql.NullString
+	)
+
+	dest := []interface{}{&e.Event, &e.Location, &lat, &lng, &e.Timezone, &e.Provider, &start, &end}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	e.Lat, e.Lng = lat.Float64, lng.Float64
+	e.Start, e.End = start.String, end.String
+
+	return &e, nil
+}
+
+// nullTime stores zero times, such as alerts without an expiry, as
+// NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+var query = `INSERT INTO weather (event, location, temperature, source, observed_at,
+    humidity, wind_speed, wind_direction, precipitation_probability, short_forecast, icon, is_daytime, published_at)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+  ON CONFLICT (event)
+  DO UPDATE SET temperature = EXCLUDED.temperature,
+    source = EXCLUDED.source,
+    observed_at = EXCLUDED.observed_at,
+    humidity = EXCLUDED.humidity,
+    wind_speed = EXCLUDED.wind_speed,
+    wind_direction = EXCLUDED.wind_direction,
+    precipitation_probability = EXCLUDED.precipitation_probability,
+    short_forecast = EXCLUDED.short_forecast,
+    icon = EXCLUDED.icon,
+    is_daytime = EXCLUDED.is_daytime,
+    published_at = EXCLUDED.published_at
+  WHERE weather.published_at <= EXCLUDED.published_at;`
+
+var readingQuery = `INSERT INTO readings (event, temperature, source, provider, observed_at, published_at)
+  VALUES ($1, $2, $3, $4, $5, $6);`
+
+var pruneReadingsQuery = `DELETE FROM readings WHERE event = $1 AND observed_at < $2;`
+
+var alertQuery = `INSERT INTO alerts (event, alert_id, alert_type, severity, headline, expires_at)
+  VALUES ($1, $2, $3, $4, $5, $6)
+  ON CONFLICT (event, alert_id) DO NOTHING;`
+
+var deleteAlertsQuery = `DELETE FROM alerts WHERE event = $1;`
+
+var forecastQuery = `INSERT INTO forecast (event, start_time, end_time, is_daytime, temperature,
+    humidity, wind_speed, wind_direction, precipitation_probability, short_forecast, icon)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+  ON CONFLICT (event, start_time)
+  DO UPDATE SET end_time = EXCLUDED.end_time,
+    is_daytime = EXCLUDED.is_daytime,
+    temperature = EXCLUDED.temperature,
+    humidity = EXCLUDED.humidity,
+    wind_speed = EXCLUDED.wind_speed,
+    wind_direction = EXCLUDED.wind_direction,
+    precipitation_probability = EXCLUDED.precipitation_probability,
+    short_forecast = EXCLUDED.short_forecast,
+    icon = EXCLUDED.icon;`
+
+var pruneForecastQuery = `DELETE FROM forecast WHERE event = $1 AND end_time < now();`
+
+var dailyForecastQuery = `INSERT INTO daily_forecast (event, start_time, end_time, name, is_daytime, temperature,
+    wind_speed, wind_direction, precipitation_probability, short_forecast, detailed_forecast, icon)
+  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+  ON CONFLICT (event, start_time)
+  DO UPDATE SET end_time = EXCLUDED.end_time,
+    name = EXCLUDED.name,
+    is_daytime = EXCLUDED.is_daytime,
+    temperature = EXCLUDED.temperature,
+    wind_speed = EXCLUDED.wind_speed,
+    wind_direction = EXCLUDED.wind_direction,
+    precipitation_probability = EXCLUDED.precipitation_probability,
+    short_forecast = EXCLUDED.short_forecast,
+    detailed_forecast = EXCLUDED.detailed_forecast,
+    icon = EXCLUDED.icon;`
+
+var pruneDailyForecastQuery = `DELETE FROM daily_forecast WHERE event = $1 AND end_time < now();`
+
+var geocodeQuery = `SELECT location, place_id, formatted_address, lat, lng, updated_at
+  FROM geocodes
+  WHERE event = $1;`
+
+var cacheGeocodeQuery = `INSERT INTO geocodes (event, location, place_id, formatted_address, lat, lng, updated_at)
+  VALUES ($1, $2, $3, $4, $5, $6, now())
+  ON CONFLICT (event)
+  DO UPDATE SET location = EXCLUDED.location,
+    place_id = EXCLUDED.place_id,
+    formatted_address = EXCLUDED.formatted_address,
+    lat = EXCLUDED.lat,
+    lng = EXCLUDED.lng,
+    updated_at = EXCLUDED.updated_at;`
+
+var claimEventQuery = `INSERT INTO processed_events (event_id, expires_at) VALUES ($1, $2)
+  ON CONFLICT (event_id) DO NOTHING;`
+
+var completeEventQuery = `UPDATE processed_events SET expires_at = $2 WHERE event_id = $1;`
+
+var releaseEventQuery = `DELETE FROM processed_events WHERE event_id = $1;`
+
+var pruneProcessedEventsQuery = `DELETE FROM processed_events WHERE expires_at < $1;`
+
+var eventColumns = `name, location, lat, lng, timezone, provider,
+    to_char(start_date, 'YYYY-MM-DD'), to_char(end_date, 'YYYY-MM-DD')`
+
+var eventQuery = `SELECT ` + eventColumns + `
+  FROM events
+  WHERE (slug = $1 OR name = $1) AND active;`
+
+var activeEventsQuery = `SELECT ` + eventColumns + `, slug, poll_interval, dispatched_at
+  FROM events
+  WHERE active
+  ORDER BY name;`
+
+var markDispatchedQuery = `UPDATE events SET dispatched_at = $2 WHERE slug = $1;`
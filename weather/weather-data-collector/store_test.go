@@ -0,0 +1,172 @@
+package function
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+	"time"
+)
+
+func TestPostgresStoreUpdateWeather(t *testing.T) {
+	s, tdb := newTestPostgresStore()
+
+	observedAt := time.Date(2018, 8, 28, 16, 0, 0, 0, time.UTC)
+	r := Reading{Temperature: 22.2, Source: "forecast", Provider: "nws", ObservedAt: observedAt, PublishedAt: observedAt}
+	retention := 7 * 24 * time.Hour
+
+	latest, err := s.UpdateWeather(context.Background(), "GopherCon", "Denver, Colorado, USA", r, Period{Humidity: 40}, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !latest {
+		t.Errorf("reading wasn't stored as the latest weather")
+	}
+
+	weather := tdb.statements(query)
+	if len(weather) != 1 || weather[0].args[0] != "GopherCon" || weather[0].args[2] != 22.2 || weather[0].args[5] != int64(40) {
+		t.Errorf("wrong weather statements: got %+v", weather)
+	}
+
+	// Every reading is appended to the history.
+	readings := tdb.statements(readingQuery)
+	if len(readings) != 1 {
+		t.Fatalf("wrong number of readings: got %v want %v", len(readings), 1)
+	}
+	args := readings[0].args
+	if args[0] != "GopherCon" || args[1] != 22.2 || args[2] != "forecast" || args[3] != "nws" || args[4] != observedAt || args[5] != observedAt {
+		t.Errorf("wrong reading: got %v", args)
+	}
+
+	pruned := tdb.statements(pruneReadingsQuery)
+	if len(pruned) != 1 || pruned[0].args[1] != observedAt.Add(-retention) {
+		t.Errorf("wrong prune statements: got %+v", pruned)
+	}
+}
+
+func TestPostgresStoreUpdateWeatherKeepReadings(t *testing.T) {
+	s, tdb := newTestPostgresStore()
+
+	r := Reading{Temperature: 22.2, Source: "forecast", Provider: "nws", ObservedAt: time.Now().UTC()}
+	if _, err := s.UpdateWeather(context.Background(), "GopherCon", "Denver, Colorado, USA", r, Period{}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if pruned := tdb.statements(pruneReadingsQuery); len(pruned) != 0 {
+		t.Errorf("readings pruned with a zero retention: got %+v", pruned)
+	}
+}
+
+func TestPostgresStoreUpdateForecast(t *testing.T) {
+	s, tdb := newTestPostgresStore()
+
+	start := time.Date(2018, 8, 28, 16, 0, 0, 0, time.UTC)
+	periods := []Period{
+		{StartTime: start, EndTime: start.Add(time.Hour), Temperature: 22.2, Humidity: 40, WindSpeed: 8, WindDirection: "NW", ShortForecast: "Sunny"},
+		{StartTime: start.Add(time.Hour), EndTime: start.Add(2 * time.Hour), Temperature: 23.9, Humidity: 35, WindSpeed: 16, WindDirection: "W", ShortForecast: "Mostly Sunny"},
+	}
+
+	if err := s.UpdateForecast(context.Background(), "GopherCon", periods); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned := tdb.statements(pruneForecastQuery)
+	if len(pruned) != 1 || pruned[0].args[0] != "GopherCon" {
+		t.Errorf("wrong prune statements: got %+v", pruned)
+	}
+
+	// Every period is stored, not only the current one.
+	stored := tdb.statements(forecastQuery)
+	if len(stored) != len(periods) {
+		t.Fatalf("wrong number of stored periods: got %v want %v", len(stored), len(periods))
+	}
+	for i, s := range stored {
+		p := periods[i]
+		if s.args[0] != "GopherCon" || s.args[1] != p.StartTime || s.args[4] != p.Temperature || s.args[5] != int64(p.Humidity) || s.args[9] != p.ShortForecast {
+			t.Errorf("wrong period %d: got %v", i, s.args)
+		}
+	}
+}
+
+func TestPostgresStoreUpdateAlerts(t *testing.T) {
+	s, tdb := newTestPostgresStore()
+
+	expires := time.Date(2018, 8, 28, 20, 0, 0, 0, time.UTC)
+	alerts := []Alert{
+		{ID: "1", Type: "Heat Advisory", Severity: "Moderate", Headline: "Heat Advisory until 8 PM", Expires: expires},
+		{ID: "2", Type: "Air Quality Alert", Severity: "Minor", Headline: "Air Quality Alert", Expires: expires.Add(time.Hour)},
+	}
+
+	if err := s.UpdateAlerts(context.Background(), "GopherCon", alerts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alerts that are no longer active are dropped by replacing the
+	// stored alerts for the event.
+	deleted := tdb.statements(deleteAlertsQuery)
+	if len(deleted) != 1 || deleted[0].args[0] != "GopherCon" {
+		t.Errorf("wrong delete statements: got %+v", deleted)
+	}
+
+	stored := tdb.statements(alertQuery)
+	if len(stored) != len(alerts) {
+		t.Fatalf("wrong number of stored alerts: got %v want %v", len(stored), len(alerts))
+	}
+	for i, s := range stored {
+		a := alerts[i]
+		if s.args[0] != "GopherCon" || s.args[1] != a.ID || s.args[2] != a.Type || s.args[3] != a.Severity || s.args[5] != a.Expires {
+			t.Errorf("wrong alert %d: got %v", i, s.args)
+		}
+	}
+}
+
+func TestPostgresStoreCachedPlace(t *testing.T) {
+	s, tdb := newTestPostgresStore()
+	ttl := 30 * 24 * time.Hour
+
+	cached := func(location string, age time.Duration) [][]driver.Value {
+		return [][]driver.Value{{location, "denver", "Denver, CO, USA", 39.7392, -104.9903, time.Now().Add(-age)}}
+	}
+
+	tests := []struct {
+		name string
+		rows [][]driver.Value
+		hit  bool
+	}{
+		{"miss", nil, false},
+		{"hit", cached("Denver, Colorado, USA", time.Hour), true},
+		{"expired", cached("Denver, Colorado, USA", ttl+time.Hour), false},
+		{"location changed", cached("San Diego, California, USA", time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		tdb.rows[geocodeQuery] = tt.rows
+
+		p, err := s.CachedPlace(context.Background(), "GopherCon", "Denver, Colorado, USA", ttl)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !tt.hit {
+			if p != nil {
+				t.Errorf("%s: unexpected cached place: got %+v", tt.name, p)
+			}
+			continue
+		}
+		if p == nil || p.PlaceID != "denver" || p.Lat != 39.7392 || p.Lng != -104.9903 {
+			t.Errorf("%s: wrong place: got %+v", tt.name, p)
+		}
+	}
+}
+
+func TestPostgresStoreCachePlace(t *testing.T) {
+	s, tdb := newTestPostgresStore()
+
+	p := &Place{PlaceID: "denver", FormattedAddress: "Denver, CO, USA", Lat: 39.7392, Lng: -104.9903}
+	if err := s.CachePlace(context.Background(), "GopherCon", "Denver, Colorado, USA", p); err != nil {
+		t.Fatal(err)
+	}
+
+	updates := tdb.statements(cacheGeocodeQuery)
+	if len(updates) != 1 || updates[0].args[0] != "GopherCon" || updates[0].args[1] != "Denver, Colorado, USA" || updates[0].args[2] != "denver" {
+		t.Errorf("wrong cache updates: got %+v", updates)
+	}
+}
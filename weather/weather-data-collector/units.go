@@ -0,0 +1,30 @@
+package function
+
+import (
+	"fmt"
+)
+
+// Measurements are stored in canonical metric units: temperatures in
+// degrees Celsius and wind speeds in kilometres per hour. Providers
+// convert readings to these units and weather-api converts them to the
+// units requested by clients.
+
+func fahrenheitToCelsius(f float64) float64 {
+	return (f - 32) * 5 / 9
+}
+
+func mphToKmh(mph float64) float64 {
+	return mph * 1.609344
+}
+
+// toCelsius converts a temperature reported in unit, which may be an
+// api.weather.gov temperatureUnit or WMO unit code, to Celsius.
+func toCelsius(t float64, unit string) (float64, error) {
+	switch unit {
+	case "C", "wmoUnit:degC", "unit:degC":
+		return t, nil
+	case "F", "wmoUnit:degF", "unit:degF":
+		return fahrenheitToCelsius(t), nil
+	}
+	return 0, fmt.Errorf("unsupported temperature unit %q", unit)
+}
@@ -0,0 +1,65 @@
+package function
+
+import (
+	"math"
+	"testing"
+)
+
+// approxEqual reports whether a and b are equal to two decimal places.
+func approxEqual(a, b float64) bool {
+	return math.Abs(a-b) < 0.005
+}
+
+func TestToCelsius(t *testing.T) {
+	tests := []struct {
+		temperature float64
+		unit        string
+		want        float64
+	}{
+		{72, "F", 22.22},
+		{32, "wmoUnit:degF", 0},
+		{21.5, "C", 21.5},
+		{-3.9, "wmoUnit:degC", -3.9},
+	}
+
+	for _, tt := range tests {
+		got, err := toCelsius(tt.temperature, tt.unit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !approxEqual(got, tt.want) {
+			t.Errorf("wrong temperature for %v %v: got %v want %v", tt.temperature, tt.unit, got, tt.want)
+		}
+	}
+
+	if _, err := toCelsius(300, "K"); err == nil {
+		t.Errorf("expected an error for an unsupported unit")
+	}
+}
+
+func TestParseWindSpeed(t *testing.T) {
+	tests := []struct {
+		speed string
+		want  float64
+	}{
+		{"", 0},
+		{"0 mph", 0},
+		{"5 mph", 8.05},
+		{"5 to 10 mph", 16.09},
+		{"15 km/h", 15},
+	}
+
+	for _, tt := range tests {
+		got, err := parseWindSpeed(tt.speed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !approxEqual(got, tt.want) {
+			t.Errorf("wrong wind speed for %q: got %v want %v", tt.speed, got, tt.want)
+		}
+	}
+
+	if _, err := parseWindSpeed("5 knots"); err == nil {
+		t.Errorf("expected an error for an unsupported unit")
+	}
+}
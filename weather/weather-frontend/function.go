@@ -1,39 +1,85 @@
 package function
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
-	"sync"
-	"text/template"
+	"time"
 
 	"cloud.google.com/go/logging"
 	"contrib.go.opencensus.io/exporter/stackdriver/propagation"
+	"github.com/kelseyhightower/weather-internal/conditions"
+	"github.com/kelseyhightower/weather-internal/health"
+	"github.com/kelseyhightower/weather-internal/stackdriver"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/trace"
 )
 
 var (
-	htmlTemplate  *template.Template
-	httpClient    *http.Client
-	logger        *logging.Logger
-	once          sync.Once
-	weatherApiUrl string
+	service *Service
+
+	// initService runs configFunc until it succeeds.
+	initService = health.NewInitializer(func() error { return configFunc() })
 )
 
-// configFunc sets the global configuration; it's overridden in tests.
+// configFunc sets the global service; it's overridden in tests.
 var configFunc = defaultConfigFunc
 
+// Logger logs structured log entries; *logging.Logger satisfies it.
+type Logger interface {
+	Log(e logging.Entry)
+	Flush() error
+}
+
+// WeatherAPI retrieves the weather for an event, and the events in the
+// events registry, from the weather-api.
+type WeatherAPI interface {
+	Weather(ctx context.Context, event, units string) (*Weather, error)
+	Events(ctx context.Context) (Events, error)
+}
+
+// Service renders the weather page. F uses the service created by
+// configFunc; tests create their own.
+type Service struct {
+	API      WeatherAPI
+	Template *template.Template
+	Logger   Logger
+}
+
 type Weather struct {
-	Event       string
-	Location    string
-	Temperature int
+	Event                    string
+	Location                 string
+	Units                    string
+	Temperature              float64
+	Source                   string
+	ObservedAt               time.Time
+	Humidity                 int
+	WindSpeed                float64
+	WindDirection            string
+	PrecipitationProbability int
+	ShortForecast            string
+	Icon                     string
+	Alerts                   []Alert
+}
+
+type Alert struct {
+	Type     string
+	Severity string
+	Headline string
 }
 
+// defaultEvent is shown when the event query parameter isn't set.
+const defaultEvent = "GopherCon"
+
 type Events []Event
 
 type Event struct {
@@ -42,12 +88,22 @@ type Event struct {
 }
 
 func F(w http.ResponseWriter, r *http.Request) {
-	once.Do(func() {
-		if err := configFunc(); err != nil {
-			panic(err)
-		}
-	})
+	if path.Base(r.URL.Path) == "healthz" {
+		initService.ServeHealth(w, r)
+		return
+	}
+
+	if err := initService.Do(); err != nil {
+		initService.ServeUnavailable(w, err)
+		return
+	}
+
+	defer service.Logger.Flush()
 
+	service.ServeHTTP(w, r)
+}
+
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var span *trace.Span
 
@@ -63,14 +119,14 @@ func F(w http.ResponseWriter, r *http.Request) {
 
 	event := r.FormValue("event")
 	if event == "" {
-		event = "GopherCon"
+		event = defaultEvent
 	}
 
-	u := fmt.Sprintf("%s/api?event=%s", weatherApiUrl, url.QueryEscape(event))
+	units := unitsFromRequest(w, r)
 
-	request, err := http.NewRequest("GET", u, nil)
+	weather, err := s.API.Weather(ctx, event, units)
 	if err != nil {
-		logger.Log(logging.Entry{
+		s.Logger.Log(logging.Entry{
 			Payload:  "Error calling the weather api: " + err.Error(),
 			Severity: logging.Error,
 		})
@@ -78,65 +134,35 @@ func F(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	request = request.WithContext(ctx)
-
-	response, err := httpClient.Do(request)
+	events, err := s.API.Events(ctx)
 	if err != nil {
-		logger.Log(logging.Entry{
-			Payload:  "Error calling the weather api: " + err.Error(),
-			Severity: logging.Error,
-		})
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	var weatherResponse Weather
-	body, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		logger.Log(logging.Entry{
-			Payload:  err.Error(),
-			Severity: logging.Error,
+		// The page is still useful without the event menu; list
+		// only the current event.
+		s.Logger.Log(logging.Entry{
+			Payload:  "Error listing events from the weather api: " + err.Error(),
+			Severity: logging.Warning,
 		})
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		events = Events{Event{Name: weather.Event}}
 	}
 
-	defer response.Body.Close()
-
-	if err := json.Unmarshal(body, &weatherResponse); err != nil {
-		logger.Log(logging.Entry{
-			Payload:  err.Error(),
-			Severity: logging.Error,
-		})
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	events := Events{
-		Event{"GopherCon", false},
-		Event{"Florida Golang", false},
-		Event{"Go Northwest", false},
-		Event{"GothamGo", false},
-		Event{"CapitalGo", false},
-		Event{"Gopherpalooza", false},
+	for i := range events {
+		events[i].Selected = events[i].Name == weather.Event
 	}
 
 	data := struct {
-		Event       string
-		Location    string
-		Temperature int
-		Events      Events
+		Weather
+		Conditions string
+		Events     Events
 	}{
-		weatherResponse.Event,
-		weatherResponse.Location,
-		weatherResponse.Temperature,
+		*weather,
+		conditions.Summary(weather.ShortForecast, weather.WindSpeed, weather.Units),
 		events,
 	}
 
 	var html strings.Builder
 
-	if err := htmlTemplate.Execute(&html, data); err != nil {
-		logger.Log(logging.Entry{
+	if err := s.Template.Execute(&html, data); err != nil {
+		s.Logger.Log(logging.Entry{
 			Payload:  err.Error(),
 			Severity: logging.Error,
 		})
@@ -144,40 +170,103 @@ func F(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Fprintf(w, html.String())
+	io.WriteString(w, html.String())
+}
+
+// APIClient is a WeatherAPI client for the weather-api function at URL.
+type APIClient struct {
+	URL    string
+	Client *http.Client
+}
+
+func (c *APIClient) Weather(ctx context.Context, event, units string) (*Weather, error) {
+	u := fmt.Sprintf("%s/api?event=%s&units=%s", c.URL, url.QueryEscape(event), units)
+
+	var weather Weather
+	if err := c.get(ctx, u, &weather); err != nil {
+		return nil, err
+	}
+
+	return &weather, nil
+}
+
+func (c *APIClient) Events(ctx context.Context) (Events, error) {
+	var events Events
+	if err := c.get(ctx, c.URL+"/api/events", &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// get decodes the JSON response to a weather-api request into v.
+func (c *APIClient) get(ctx context.Context, u string, v interface{}) error {
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+
+	request = request.WithContext(ctx)
+
+	response, err := c.Client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		return fmt.Errorf("non 200 response code from the weather api: %s", string(body))
+	}
+
+	return json.Unmarshal(body, v)
 }
 
 func defaultConfigFunc() error {
 	var err error
 
-	weatherApiUrl = os.Getenv("WEATHER_API_URL")
+	weatherApiUrl := os.Getenv("WEATHER_API_URL")
 	if weatherApiUrl == "" {
 		return fmt.Errorf("WEATHER_API_URL environment variable unset or missing")
 	}
 
-	if err := EnableStackdriverTrace(); err != nil {
+	if err := stackdriver.EnableTrace(); err != nil {
 		return err
 	}
 
-	logger, err = NewStackdriverLogger()
+	logger, err := stackdriver.NewLogger()
 	if err != nil {
 		return err
 	}
 
+	staticDir := os.Getenv("STATIC_DIR")
+	if staticDir == "" {
+		staticDir = "static"
+	}
+
 	t := template.New("index.html")
-	t, err = t.ParseFiles("static/index.html")
+	t, err = t.ParseFiles(filepath.Join(staticDir, "index.html"))
 	if err != nil {
 		return err
 	}
 
-	htmlTemplate = t
-
-	httpClient = &http.Client{
+	httpClient := &http.Client{
 		Transport: &ochttp.Transport{
 			Propagation:    &propagation.HTTPFormat{},
 			FormatSpanName: func(r *http.Request) string { return "weather-api" },
 		},
 	}
 
+	service = &Service{
+		API:      &APIClient{URL: weatherApiUrl, Client: httpClient},
+		Template: t,
+		Logger:   logger,
+	}
+
 	return nil
 }
@@ -0,0 +1,214 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/logging"
+)
+
+type testLogger struct {
+	entries []logging.Entry
+}
+
+func (l *testLogger) Log(e logging.Entry) {
+	l.entries = append(l.entries, e)
+}
+
+func (l *testLogger) Flush() error {
+	return nil
+}
+
+type testAPI struct {
+	weather *Weather
+	events  Events
+	err     error
+
+	event, units string
+}
+
+func (a *testAPI) Weather(ctx context.Context, event, units string) (*Weather, error) {
+	a.event, a.units = event, units
+	if a.err != nil {
+		return nil, a.err
+	}
+	w := *a.weather
+	w.Units = units
+	return &w, nil
+}
+
+func (a *testAPI) Events(ctx context.Context) (Events, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	return append(Events(nil), a.events...), nil
+}
+
+func newTestService(t *testing.T, api WeatherAPI) *Service {
+	tmpl, err := template.New("index.html").ParseFiles("static/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Service{API: api, Template: tmpl, Logger: &testLogger{}}
+}
+
+func TestServiceRendersWeather(t *testing.T) {
+	api := &testAPI{events: Events{{Name: "GopherCon"}, {Name: "GothamGo"}}, weather: &Weather{
+		Event:         "GothamGo",
+		Location:      "New York, New York, USA",
+		Temperature:   71.6,
+		ShortForecast: "Sunny",
+		Alerts:        []Alert{{Type: "Heat Advisory", Severity: "Moderate", Headline: "Heat Advisory until 8 PM"}},
+	}}
+	s := newTestService(t, api)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/?event=GothamGo&units=metric", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+
+	if api.event != "GothamGo" || api.units != metric {
+		t.Errorf("wrong weather api request: got %v %v want %v %v", api.event, api.units, "GothamGo", metric)
+	}
+
+	body := w.Body.String()
+	for _, want := range []string{"72&#8451;", "sunny, calm", "Heat Advisory until 8 PM", "New York, New York, USA",
+		`<option value="GopherCon">`, `<option value="GothamGo" selected>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page is missing %q", want)
+		}
+	}
+}
+
+func TestServiceRendersAlerts(t *testing.T) {
+	tests := []struct {
+		alerts []Alert
+		want   []string
+	}{
+		{nil, nil},
+		{[]Alert{{Type: "Heat Advisory", Severity: "Moderate", Headline: "Heat Advisory until 8 PM"}}, []string{"alert-warning"}},
+		{[]Alert{{Type: "Severe Thunderstorm Warning", Severity: "Severe"}, {Type: "Heat Advisory", Severity: "Minor"}}, []string{"alert-danger", "alert-warning"}},
+		{[]Alert{{Type: "Tornado Warning", Severity: "Extreme"}}, []string{"alert-danger"}},
+	}
+
+	for _, tt := range tests {
+		api := &testAPI{weather: &Weather{Event: "GopherCon", Alerts: tt.alerts}}
+		s := newTestService(t, api)
+
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+		body := w.Body.String()
+		if n := strings.Count(body, `role="alert"`); n != len(tt.want) {
+			t.Errorf("wrong number of alert banners for %v: got %v want %v", tt.alerts, n, len(tt.want))
+		}
+		for i, class := range tt.want {
+			if !strings.Contains(body, `<div class="alert `+class+`" role="alert">`) {
+				t.Errorf("missing %s banner for %v", class, tt.alerts[i].Type)
+			}
+			if !strings.Contains(body, "<strong>"+tt.alerts[i].Type+"</strong>") {
+				t.Errorf("banner is missing the alert type %q", tt.alerts[i].Type)
+			}
+		}
+	}
+}
+
+func TestServiceEscapesWeather(t *testing.T) {
+	api := &testAPI{events: Events{{Name: `<script>alert("GopherCon")</script>`}}, weather: &Weather{
+		Event:    `<script>alert("GopherCon")</script>`,
+		Location: "Denver, Colorado, USA",
+		Icon:     `javascript:alert("GopherCon")`,
+		Alerts:   []Alert{{Type: "Heat Advisory", Headline: `<img src=x onerror=alert(1)>`}},
+	}}
+	s := newTestService(t, api)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status code: got %v want %v", w.Code, http.StatusOK)
+	}
+
+	body := w.Body.String()
+	for _, unsafe := range []string{"<script>", "<img src=x", `src="javascript:`} {
+		if strings.Contains(body, unsafe) {
+			t.Errorf("page contains unescaped %q", unsafe)
+		}
+	}
+	if !strings.Contains(body, "&lt;script&gt;") {
+		t.Errorf("page is missing the escaped event name")
+	}
+}
+
+func TestServiceDefaultEvent(t *testing.T) {
+	api := &testAPI{weather: &Weather{Event: "GopherCon"}}
+	s := newTestService(t, api)
+
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if api.event != "GopherCon" {
+		t.Errorf("wrong default event: got %v want %v", api.event, "GopherCon")
+	}
+}
+
+func TestServiceAPIError(t *testing.T) {
+	s := newTestService(t, &testAPI{err: errors.New("connection refused")})
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("wrong status code: got %v want %v", w.Code, http.StatusInternalServerError)
+	}
+	if len(s.Logger.(*testLogger).entries) != 1 {
+		t.Errorf("wrong number of log entries: got %v want %v", len(s.Logger.(*testLogger).entries), 1)
+	}
+}
+
+func TestAPIClient(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/events" {
+			w.Write([]byte(`[{"Name": "GopherCon", "Slug": "gophercon"}, {"Name": "Go Northwest", "Slug": "go-northwest"}]`))
+			return
+		}
+		if r.URL.Path != "/api" {
+			t.Errorf("wrong request path: got %v want %v", r.URL.Path, "/api")
+		}
+		switch r.FormValue("event") {
+		case "Go Northwest":
+			w.Write([]byte(`{"Event": "Go Northwest", "Units": "imperial", "Temperature": 63}`))
+		default:
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	c := &APIClient{URL: ts.URL, Client: ts.Client()}
+
+	weather, err := c.Weather(context.Background(), "Go Northwest", imperial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weather.Temperature != 63 {
+		t.Errorf("wrong temperature: got %v want %v", weather.Temperature, 63)
+	}
+
+	if _, err := c.Weather(context.Background(), "Unknown", imperial); err == nil {
+		t.Errorf("expected an error for a non 200 response")
+	}
+
+	events, err := c.Events(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].Name != "Go Northwest" {
+		t.Errorf("wrong events: got %+v", events)
+	}
+}
@@ -0,0 +1,40 @@
+package function
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	metric   = "metric"
+	imperial = "imperial"
+)
+
+// unitsCookieMaxAge is how long the units selected by a visitor are
+// remembered.
+const unitsCookieMaxAge = 365 * 24 * time.Hour
+
+// unitsFromRequest returns the units selected with the units query
+// parameter, falling back to the units cookie and then imperial. When
+// the query parameter is set the selection is stored in the cookie.
+func unitsFromRequest(w http.ResponseWriter, r *http.Request) string {
+	switch units := r.FormValue("units"); units {
+	case metric, imperial:
+		http.SetCookie(w, &http.Cookie{
+			Name:   "units",
+			Value:  units,
+			Path:   "/",
+			MaxAge: int(unitsCookieMaxAge.Seconds()),
+		})
+		return units
+	}
+
+	if c, err := r.Cookie("units"); err == nil {
+		switch c.Value {
+		case metric, imperial:
+			return c.Value
+		}
+	}
+
+	return imperial
+}
@@ -0,0 +1,45 @@
+package function
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnitsFromRequest(t *testing.T) {
+	tests := []struct {
+		url    string
+		cookie string
+		want   string
+	}{
+		{"/", "", imperial},
+		{"/?units=metric", "", metric},
+		{"/", "metric", metric},
+		{"/?units=imperial", "metric", imperial},
+		{"/?units=kelvin", "", imperial},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "units", Value: tt.cookie})
+		}
+		w := httptest.NewRecorder()
+
+		if got := unitsFromRequest(w, r); got != tt.want {
+			t.Errorf("wrong units for %v with cookie %q: got %v want %v", tt.url, tt.cookie, got, tt.want)
+		}
+	}
+}
+
+func TestUnitsFromRequestSetsCookie(t *testing.T) {
+	r := httptest.NewRequest("GET", "/?units=metric", nil)
+	w := httptest.NewRecorder()
+
+	unitsFromRequest(w, r)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "units" || cookies[0].Value != metric {
+		t.Errorf("wrong cookies: got %v want units=%v", cookies, metric)
+	}
+}